@@ -0,0 +1,106 @@
+package fileScheduler
+
+import (
+  "container/heap"
+  "sync"
+  "time"
+)
+
+/*
+ * Types that FileScheduler and FileLocker used before they were rebuilt on
+ * lockManager. Nothing in this package uses them anymore; they are kept so
+ * that code referring to them still compiles.
+ */
+
+// Deprecated: FileScheduler now queues lockManager.Task values internally.
+type Task struct {
+  Paths [][]string // paths to lock
+  Channel chan bool // callback in which to complete the task
+  EnqueueTime int64
+  IsComplete bool
+  RoutineId int64
+  Priority int64 // priority queue
+}
+
+// Deprecated: FileScheduler now queues lockManager.Task values internally.
+func MakeTask(routineId int64, paths [][]string, priority int64, isComplete bool) *Task {
+  return &Task{
+    Paths: paths,
+    Channel: make(chan bool),
+    EnqueueTime: time.Now().UnixNano(),
+    IsComplete: isComplete,
+    Priority: priority,
+    RoutineId: routineId,
+  }
+}
+
+// Deprecated: Use lockManager.TaskPriorityQueue.
+type TaskPriorityQueue struct {
+  tasks []*Task
+  mu *sync.Mutex // a pointer so that the value receivers share it
+}
+
+// Deprecated: Use lockManager.MakeTaskPriorityQueue.
+func MakeTaskPriorityQueue() TaskPriorityQueue {
+  return TaskPriorityQueue{tasks: make([]*Task, 0), mu: &sync.Mutex{}}
+}
+
+func (pq TaskPriorityQueue) Length() int {
+  if pq.mu == nil {
+    // Nothing has been pushed yet.
+    return len(pq.tasks)
+  }
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  return pq.Len()
+}
+
+func (pq *TaskPriorityQueue) Push(x interface{}) {
+  if pq.mu == nil {
+    pq.mu = &sync.Mutex{}
+  }
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  n := len(pq.tasks)
+  task := x.(*Task)
+  pq.tasks = append(pq.tasks, task)
+  heap.Fix(pq, n)
+}
+
+func (pq *TaskPriorityQueue) Peek() interface{} {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  return pq.tasks[len(pq.tasks)-1]
+}
+
+func (pq *TaskPriorityQueue) Pop() interface{} {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  old := pq.tasks
+  n := len(old)
+  task := old[n-1]
+  old[n-1] = nil  // avoid memory leak
+  pq.tasks = old[0 : n-1]
+  return task
+}
+
+func (pq TaskPriorityQueue) Len() int {
+  return len(pq.tasks)
+}
+
+func (pq TaskPriorityQueue) Less(i, j int) bool {
+  return pq.tasks[i].Priority > pq.tasks[j].Priority
+}
+
+func (pq TaskPriorityQueue) Swap(i, j int) {
+  pq.tasks[i], pq.tasks[j] = pq.tasks[j], pq.tasks[i]
+}
+
+// Deprecated: FileLocker is now backed by a lockManager.Trie, which has its own nodes.
+type FileLockerPathNode struct {
+  name string
+  parent *FileLockerPathNode
+  children map[string]*FileLockerPathNode
+  explicit bool // zero for all implicit nodes
+  routineId int64 // "" for all implicit nodes
+}
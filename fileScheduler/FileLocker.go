@@ -2,23 +2,55 @@ package fileScheduler
 
 import (
   "errors"
-  "fmt"
+  "strconv"
   "strings"
+
+  "github.com/Thomas-Redding/go_util/lockManager"
 )
 
 /*
+ * A non-reentrant lockManager.Trie keyed by int64 routine IDs. Paths are
+ * canonicalized (see lockManager.Path), so ["foo", ""], ["foo", ".", "bar"]
+ * and ["foo/bar"] all refer to "/foo/bar"; paths that climb above the root
+ * are refused with ErrInvalidPath.
+ *
  * MakeFileLocker() FileLocker
  *
  * // Reserves the item (and all its descendants) for the routine.
  * // This lock is NOT recursive.
  * Lock(path []string, routineId int64) error
  *
+ * // Reserves the item (and all its descendants) for reading by the routine.
+ * // Any number of routines may share an item, but no other routine may hold
+ * // an exclusive lock on it, its ancestors or its descendants.
+ * RLock(path []string, routineId int64) error
+ *
  * // Releases the item (and all its descendants) from the routine.
  * Unlock(path []string, routineId int64) error
  *
- * // Returns true iff the item is locked by a different routine.
+ * // Like Lock(), RLock() and Unlock(), but each component is a path.Match()
+ * // pattern, so ["configs", "*.json"] reserves every JSON file in "configs"
+ * // without reserving "configs" itself. A pattern conflicts with locks on
+ * // every item it matches (and their ancestors and descendants) and with
+ * // overlapping patterns.
+ * LockPattern(pattern []string, routineId int64) error
+ * RLockPattern(pattern []string, routineId int64) error
+ * UnlockPattern(pattern []string, routineId int64) error
+ *
+ * // Releases every item locked by the routine. Fails if it held nothing.
+ * UnlockAll(routineId int64) error
+ *
+ * // Returns true iff the item can't be exclusively locked by the routine
+ * // because it, an ancestor or a descendant is locked by a different routine.
  * Locked(path []string, routineId int64) bool
  *
+ * // Returns true iff the item can't be shared by the routine because it, an
+ * // ancestor or a descendant is exclusively locked by a different routine.
+ * RLocked(path []string, routineId int64) bool
+ *
+ * // Returns every held lock, ordered by path.
+ * Held() []HeldLock
+ *
  * // Prints the tree.
  * Print()
  *
@@ -26,165 +58,114 @@ import (
  * NumLockedPaths() int
  */
 
-type FileLockerPathNode struct {
-  name string
-  parent *FileLockerPathNode
-  children map[string]*FileLockerPathNode
-  explicit bool // zero for all implicit nodes
-  routineId int64 // "" for all implicit nodes
-}
-
 type FileLocker struct {
-  root *FileLockerPathNode
+  trie lockManager.Trie
 }
 
 func MakeFileLocker() FileLocker {
-  return FileLocker{root: makeImplicitNode("", nil)}
+  return FileLocker{trie: lockManager.MakeTrie(false)}
 }
 
 func (fileLocker *FileLocker)Lock(path []string, routineId int64) error {
-  node := fileLocker.lockedNode(path)
-  if node != nil && node.routineId != routineId {
-    return errors.New("FileLocker.go: Attempted to lock from multiple routines.");
-  }
-  node = fileLocker.root
-  for i, part := range path {
-    child, ok := node.children[part]
-    if ok {
-      node = child
-      if i == len(path) - 1 {
-        return errors.New("FileLocker.go: Attempted to lock item multiple times.");
-      }
-    } else {
-      var newNode *FileLockerPathNode
-      if i == len(path) - 1 {
-        newNode = makeExplicitNode(part, node, routineId)
-      } else {
-        newNode = makeImplicitNode(part, node)
-      }
-      node.children[part] = newNode
-      node = newNode
-    }
+  parsed, err := lockManager.ParsePath(strings.Join(path, "/"))
+  if err != nil {
+    return err
   }
-  return nil
+  return fileLocker.lock(parsed, routineId, false)
 }
 
-// TODO: Make this function more efficient.
-func doesOtherRoutineShareNode(node *FileLockerPathNode, routineId int64) bool {
-  if node.routineId != 0 && node.routineId != routineId {
-    return true
-  }
-  for _, child := range node.children {
-    if doesOtherRoutineShareNode(child, routineId) {
-      return true
-    }
+func (fileLocker *FileLocker)RLock(path []string, routineId int64) error {
+  parsed, err := lockManager.ParsePath(strings.Join(path, "/"))
+  if err != nil {
+    return err
   }
-  return false
+  return fileLocker.lock(parsed, routineId, true)
 }
 
 func (fileLocker *FileLocker)Unlock(path []string, routineId int64) error {
-  node := fileLocker.root
-  for i, part := range path {
-    child, ok := node.children[part]
-    if ok {
-      node = child
-    } else {
-      return errors.New("FileLocker.go: Attempted to remove an item that wasn't locked.");
-    }
-    if i == len(path) - 1 {
-      if (node.routineId != routineId) {
-        return errors.New("FileLocker.go: Attempted to remove an item from the wrong routine.");
-      }
-      node.explicit = false
-      maybeRemoveRecentlyImplictedNode(node)
-      return nil;
-    }
+  parsed, err := lockManager.ParsePath(strings.Join(path, "/"))
+  if err != nil {
+    return err
   }
-  return errors.New("FileLocker.go: This should never happen");
+  return fileLocker.unlock(parsed, routineId)
 }
 
-func (fileLocker *FileLocker)Locked(path []string, routineId int64) bool {
-  node := fileLocker.lockedNode(path)
-  return node != nil && node.routineId != routineId
+func (fileLocker *FileLocker)LockPattern(pattern []string, routineId int64) error {
+  parsed, err := lockManager.ParsePattern(strings.Join(pattern, "/"))
+  if err != nil {
+    return err
+  }
+  return fileLocker.lock(parsed, routineId, false)
 }
 
-func (fileLocker *FileLocker)UnlockAll(routineId int64) error {
-  // TODO(b/1)
-  return nil
+func (fileLocker *FileLocker)RLockPattern(pattern []string, routineId int64) error {
+  parsed, err := lockManager.ParsePattern(strings.Join(pattern, "/"))
+  if err != nil {
+    return err
+  }
+  return fileLocker.lock(parsed, routineId, true)
 }
 
-func (fileLocker *FileLocker)Print() {
-  print(fileLocker.root, 0)
+func (fileLocker *FileLocker)UnlockPattern(pattern []string, routineId int64) error {
+  parsed, err := lockManager.ParsePattern(strings.Join(pattern, "/"))
+  if err != nil {
+    return err
+  }
+  return fileLocker.unlock(parsed, routineId)
 }
 
-func (fileLocker *FileLocker)NumLockedPaths() int {
-  return numLockedPaths(fileLocker.root)
+func (fileLocker *FileLocker)Locked(path []string, routineId int64) bool {
+  parsed, err := lockManager.ParsePath(strings.Join(path, "/"))
+  if err != nil {
+    return false
+  }
+  isLocked, _ := fileLocker.trie.Conflict(parsed, strconv.FormatInt(routineId, 10), false)
+  return isLocked
 }
 
-func numLockedPaths(node *FileLockerPathNode) int {
-  rtn := 0
-  if node.explicit {
-    rtn += 1
-  }
-  for _, child := range node.children {
-    rtn += numLockedPaths(child)
+func (fileLocker *FileLocker)RLocked(path []string, routineId int64) bool {
+  parsed, err := lockManager.ParsePath(strings.Join(path, "/"))
+  if err != nil {
+    return false
   }
-  return rtn
+  isLocked, _ := fileLocker.trie.Conflict(parsed, strconv.FormatInt(routineId, 10), true)
+  return isLocked
 }
 
-/*
- * Fetches the explicit node if the path is locked; otherwise returns nil.
- */
-func (fileLocker *FileLocker)lockedNode(path []string) *FileLockerPathNode {
-  node := fileLocker.root
-  if node.explicit {
-    return node
-  }
-  for _, part := range path {
-    val, ok := node.children[part]
-    if !ok {
-      break
-    }
-    node = val
-    if node.explicit {
-      return node
-    }
+func (fileLocker *FileLocker)UnlockAll(routineId int64) error {
+  if len(fileLocker.trie.RemoveAll(strconv.FormatInt(routineId, 10))) == 0 {
+    return errors.New("FileLocker.go: Routine holds no locks.");
   }
   return nil
 }
 
-func maybeRemoveRecentlyImplictedNode(node *FileLockerPathNode) {
-  if !node.explicit && len(node.children) == 0 && node.parent != nil {
-    delete(node.parent.children, node.name)
-    maybeRemoveRecentlyImplictedNode(node.parent)
-  }
+func (fileLocker *FileLocker)Held() []HeldLock {
+  return fileLocker.trie.Held()
 }
 
-// unused
-func fullPathFromNode(node *FileLockerPathNode) []string {
-  rtn := make([]string, 0)
-  for node.parent != nil {
-    rtn = append(rtn, node.name)
-    node = node.parent
-  }
-  // Reverse array
-  for i, j := 0, len(rtn)-1; i < j; i, j = i+1, j-1 {
-    rtn[i], rtn[j] = rtn[j], rtn[i]
-  }
-  return rtn
+func (fileLocker *FileLocker)Print() {
+  fileLocker.trie.Print()
 }
 
-func print(node *FileLockerPathNode, indents int) {
-  fmt.Println(strings.Repeat(" ", 2*indents), node.name, node.explicit, node.routineId)
-  for _, child := range node.children {
-    print(child, indents + 1)
-  }
+func (fileLocker *FileLocker)NumLockedPaths() int {
+  return fileLocker.trie.NumLockedPaths()
 }
 
-func makeImplicitNode(name string, parent *FileLockerPathNode) *FileLockerPathNode {
-  return &FileLockerPathNode{name: name, parent: parent, children: make(map[string]*FileLockerPathNode, 0), explicit: false, routineId: 0}
+func (fileLocker *FileLocker)lock(path lockManager.Path, routineId int64, shared bool) error {
+  value := strconv.FormatInt(routineId, 10)
+  if isLocked, _ := fileLocker.trie.Conflict(path, value, shared); isLocked {
+    if shared {
+      return errors.New("FileLocker.go: Attempted to share an item locked by another routine.");
+    }
+    return errors.New("FileLocker.go: Attempted to lock from multiple routines.");
+  }
+  return fileLocker.trie.Add(path, value, shared)
 }
 
-func makeExplicitNode(name string, parent *FileLockerPathNode, routineId int64) *FileLockerPathNode {
-  return &FileLockerPathNode{name: name, parent: parent, children: make(map[string]*FileLockerPathNode, 0), explicit: true, routineId: routineId}
+func (fileLocker *FileLocker)unlock(path lockManager.Path, routineId int64) error {
+  value := strconv.FormatInt(routineId, 10)
+  if fileLocker.trie.Remove(path, value, true) == nil {
+    return nil
+  }
+  return fileLocker.trie.Remove(path, value, false)
 }
@@ -1,132 +1,391 @@
 package fileScheduler
 
 import (
-  "strings"
-  "sync"
+  "context"
+  "net/http"
+  "strconv"
+  "sync/atomic"
   "time"
+
+  "github.com/Thomas-Redding/go_util/lockManager"
+  "github.com/Thomas-Redding/go_util/metrics"
+)
+
+/*
+ * FileScheduler is a wrapper around a non-reentrant lockManager.Manager that
+ * gives each lock request its own ID. Since a fresh ID never holds anything
+ * while it waits, FileScheduler can't deadlock.
+ */
+
+/********** Errors **********/
+
+// Returned by TryLock() and TryRLock() when the paths aren't available.
+var ErrWouldBlock = lockManager.ErrWouldBlock
+
+// Wrapped by the *LockError returned for a path that climbs above the root.
+var ErrInvalidPath = lockManager.ErrInvalidPath
+
+// Wrapped by the *LockError returned for a pattern path.Match() can't parse.
+var ErrInvalidPattern = lockManager.ErrInvalidPattern
+
+// Wrapped by the *LockError returned once the FileScheduler is closing.
+var ErrClosed = lockManager.ErrClosed
+
+// Wrapped by the *LockError returned by Upgrade() or Downgrade() when the ID
+// doesn't hold the paths in the mode it is converting from.
+var ErrNotHeld = lockManager.ErrNotHeld
+
+// Wrapped by the *LockError returned by Upgrade() when a different ID is
+// already waiting to upgrade an overlapping path.
+var ErrUpgradeConflict = lockManager.ErrUpgradeConflict
+
+/*
+ * Returned when paths could not be locked. `Err` is ErrWouldBlock,
+ * ErrInvalidPath, ErrInvalidPattern, ErrClosed, ErrNotHeld, ErrUpgradeConflict, context.Canceled
+ * or context.DeadlineExceeded, so callers can use errors.Is().
+ */
+type LockError = lockManager.LockError
+
+/********** Types **********/
+
+type PriorityClass = lockManager.PriorityClass
+
+const (
+  PriorityUrgent = lockManager.PriorityUrgent
+  PriorityNormal = lockManager.PriorityNormal
+  PriorityBackground = lockManager.PriorityBackground
+)
+
+type Snapshot = lockManager.Snapshot
+type HeldLock = lockManager.HeldLock
+type Waiter = lockManager.Waiter
+type LockMode = lockManager.LockMode
+
+const (
+  ModeExclusive = lockManager.ModeExclusive
+  ModeShared = lockManager.ModeShared
 )
 
 /********** FileScheduler **********/
 
+/*
+ * Everything a FileScheduler refers to lives behind pointers, so copies of it
+ * (e.g. the value returned by MakeFileScheduler()) share the same locks.
+ */
 type FileScheduler struct {
-  fileLocker FileLocker
-  channel chan *Task
-  priorityQueue TaskPriorityQueue
-  routinePaths map[int64][][]string
-  enqueuedRoutines map[int64]bool
-  counterLock sync.Mutex
-  counter int64
+  manager *lockManager.Manager
+  counter *int64 // the last ID handed out; use atomically
 }
 
 func MakeFileScheduler() FileScheduler {
-  rtn := FileScheduler{
-    fileLocker: MakeFileLocker(),
-    channel: make(chan *Task, 0),
-    priorityQueue: MakeTaskPriorityQueue(),
-    routinePaths: make(map[int64][][]string),
-    enqueuedRoutines: make(map[int64]bool),
-    counter: 0,
-  }
+  return FileScheduler{manager: lockManager.MakeManager(false), counter: new(int64)}
+}
 
-  // Add tasks to the priority queue.
-  // Only this channel is allowed to use rtn.enqueuedRoutines
-  go func() {
-    for task := range rtn.channel {
-      _, ok := rtn.enqueuedRoutines[task.RoutineId]
-      if task.IsComplete {
-        if ok {
-          delete(rtn.enqueuedRoutines, task.RoutineId)
-        } else {
-          // Error: This routine has already released all its resources.
-          continue
-        }
-      } else {
-        if ok {
-          // Error: This routine already has locked items. To prevent deadlock, give up.
-          task.Channel <- false
-          continue
-        } else {
-          rtn.enqueuedRoutines[task.RoutineId] = true
-        }
-      }
-      rtn.priorityQueue.Push(task)
-    }
-  }()
-  go func() {
-    counter := 0
-    for {
-      counter = (counter + 1) % 1000
-      time.Sleep(time.Millisecond)
-      // Now process tasks:
-      for rtn.priorityQueue.Length() != 0 {
-        task := rtn.priorityQueue.Peek().(*Task)
-        if !task.IsComplete {
-          // Task needs to be done. Attempt to acquire locks.
-          blocked := false
-          for _, path := range task.Paths {
-            isLocked := rtn.fileLocker.Locked(path, task.RoutineId)
-            if isLocked {
-              // File is locked by a different routine
-              blocked = true
-              break
-            }
-          }
-          if blocked {
-            break
-          }
-          rtn.routinePaths[task.RoutineId] = task.Paths
-          for _, path := range task.Paths {
-            rtn.fileLocker.Lock(path, task.RoutineId)
-          }
-          task.Channel <- true // Tell task to start
-          rtn.priorityQueue.Pop()
-        } else {
-          // Task is done. Release all locks.
-          for _, path := range rtn.routinePaths[task.RoutineId] {
-            err := rtn.fileLocker.Unlock(path, task.RoutineId)
-            if err != nil {
-              // TODO: Log
-            }
-          }
-          delete(rtn.routinePaths, task.RoutineId)
-          rtn.priorityQueue.Pop()
-        }
-      }
-    }
-  }()
-  return rtn
+/*
+ * Like MakeFileScheduler(), but returns a pointer, for callers that would
+ * rather not copy the FileScheduler around.
+ */
+func NewFileScheduler() *FileScheduler {
+  fileScheduler := MakeFileScheduler()
+  return &fileScheduler
 }
 
+/*
+ * Exclusively lock the path (and all its descendants).
+ * Returns an ID to pass to Unlock() or 0 on failure. Prefer LockGuard() or
+ * WithLock(), which can't be unlocked with the wrong ID and report why they
+ * failed.
+ */
 func (fileScheduler *FileScheduler) Lock(path string) int64 {
-  return fileScheduler.lock([]string{path})
+  return fileScheduler.lock([]string{path}, false, PriorityNormal)
 }
 
 func (fileScheduler *FileScheduler) LockAll(paths []string) int64 {
-  return fileScheduler.lock(paths)
+  return fileScheduler.lock(paths, false, PriorityNormal)
+}
+
+/*
+ * Like Lock(), but the request is granted before any waiting normal or
+ * background requests.
+ */
+func (fileScheduler *FileScheduler) LockUrgent(path string) int64 {
+  return fileScheduler.lock([]string{path}, false, PriorityUrgent)
+}
+
+func (fileScheduler *FileScheduler) LockAllUrgent(paths []string) int64 {
+  return fileScheduler.lock(paths, false, PriorityUrgent)
 }
 
-func (fileScheduler *FileScheduler)lock(paths []string) int64 {
-  pathArray := make([][]string, len(paths))
-  for i, path := range paths {
-    pathArray[i] = strings.Split(path, "/")
+/*
+ * Like Lock(), but the request is granted after any waiting urgent or normal
+ * requests. Background requests are promoted to normal once they have waited
+ * for the aging interval, so they are delayed but never starved.
+ */
+func (fileScheduler *FileScheduler) LockBackground(path string) int64 {
+  return fileScheduler.lock([]string{path}, false, PriorityBackground)
+}
+
+func (fileScheduler *FileScheduler) LockAllBackground(paths []string) int64 {
+  return fileScheduler.lock(paths, false, PriorityBackground)
+}
+
+/*
+ * Lock the path (and all its descendants) for reading. Any number of readers
+ * may share a path, but they exclude (and are excluded by) exclusive locks on
+ * the path, its ancestors and its descendants.
+ * Returns an ID to pass to Unlock() or 0 on failure.
+ */
+func (fileScheduler *FileScheduler) RLock(path string) int64 {
+  return fileScheduler.lock([]string{path}, true, PriorityNormal)
+}
+
+func (fileScheduler *FileScheduler) RLockAll(paths []string) int64 {
+  return fileScheduler.lock(paths, true, PriorityNormal)
+}
+
+/*
+ * Exclusively lock every path matching the pattern, whose components use
+ * path.Match() syntax. E.g. "configs/*.json" locks every JSON file in
+ * "configs" (and anything under them) but not "configs" itself, so unrelated
+ * files there can still be locked. It waits for locks on matching paths, their
+ * ancestors and descendants, and overlapping patterns, and new matching
+ * requests wait for it, even for files created while it is held.
+ * Returns an ID to pass to Unlock() or 0 on failure.
+ */
+func (fileScheduler *FileScheduler) LockPattern(pattern string) int64 {
+  id, err := fileScheduler.lockPatternsContext(context.Background(), []string{pattern}, false)
+  if err != nil {
+    return 0
   }
-  priority := time.Now().UnixNano()
-  fileScheduler.counterLock.Lock()
-  fileScheduler.counter += 1
-  id := fileScheduler.counter
-  fileScheduler.counterLock.Unlock()
-  task := MakeTask(id, pathArray, priority, false)
-  fileScheduler.channel <- task
-  didSucceed := <- task.Channel // wait to lock files
-  if didSucceed {
-    return id
-  } else {
+  return id
+}
+
+func (fileScheduler *FileScheduler) RLockPattern(pattern string) int64 {
+  id, err := fileScheduler.lockPatternsContext(context.Background(), []string{pattern}, true)
+  if err != nil {
     return 0
   }
+  return id
+}
+
+/*
+ * Like LockPattern(), but for several patterns at once, giving up once the
+ * context is done. Fails with a *LockError wrapping ErrInvalidPattern if a
+ * pattern is malformed.
+ */
+func (fileScheduler *FileScheduler) LockPatternsContext(ctx context.Context, patterns []string) (int64, error) {
+  return fileScheduler.lockPatternsContext(ctx, patterns, false)
+}
+
+func (fileScheduler *FileScheduler) RLockPatternsContext(ctx context.Context, patterns []string) (int64, error) {
+  return fileScheduler.lockPatternsContext(ctx, patterns, true)
+}
+
+/*
+ * Like LockAll(), but gives up once the context is done. In that case, the
+ * request is removed from the queue and a *LockError is returned.
+ */
+func (fileScheduler *FileScheduler) LockContext(ctx context.Context, paths []string) (int64, error) {
+  return fileScheduler.lockContext(ctx, paths, false, PriorityNormal)
+}
+
+func (fileScheduler *FileScheduler) RLockContext(ctx context.Context, paths []string) (int64, error) {
+  return fileScheduler.lockContext(ctx, paths, true, PriorityNormal)
+}
+
+/*
+ * Like LockAll(), but never waits. If the paths are locked or a waiting request
+ * needs them, a *LockError wrapping ErrWouldBlock is returned.
+ */
+func (fileScheduler *FileScheduler) TryLock(paths []string) (int64, error) {
+  return fileScheduler.tryLock(paths, false)
+}
+
+func (fileScheduler *FileScheduler) TryRLock(paths []string) (int64, error) {
+  return fileScheduler.tryLock(paths, true)
+}
+
+/*
+ * Atomically turns the ID's read locks on the paths into exclusive locks,
+ * waiting until nobody else reads them. The ID keeps reading the paths in the
+ * meantime, so nothing can change between checking them and writing to them:
+ *
+ *   id := fileScheduler.RLock("foo")
+ *   defer fileScheduler.Unlock(id)
+ *   if !exists("foo/bar") {
+ *     if err := fileScheduler.Upgrade(ctx, id, []string{"foo"}); err != nil {
+ *       return err
+ *     }
+ *     create("foo/bar")
+ *   }
+ *
+ * Two readers upgrading the same path would wait for each other forever, so
+ * if another ID is already waiting to upgrade an overlapping path, this fails
+ * straight away with ErrUpgradeConflict; unlock and try again. It fails with
+ * ErrNotHeld if the ID doesn't read every path. If the context is done first,
+ * the ID keeps its read locks.
+ */
+func (fileScheduler *FileScheduler) Upgrade(ctx context.Context, id int64, paths []string) error {
+  return fileScheduler.manager.Upgrade(ctx, routineId(id), paths)
+}
+
+/*
+ * Atomically turns the ID's exclusive locks on the paths into read locks,
+ * letting other readers in. Fails with ErrNotHeld (and changes nothing) if the
+ * ID doesn't exclusively hold every path.
+ */
+func (fileScheduler *FileScheduler) Downgrade(id int64, paths []string) error {
+  return fileScheduler.manager.Downgrade(routineId(id), paths)
 }
 
 func (fileScheduler *FileScheduler) Unlock(id int64) {
-  task := MakeTask(id, nil, -1, true)
-  task.IsComplete = true
-  fileScheduler.channel <- task // no need to wait for files to become unlocked
+  fileScheduler.Release(id)
+}
+
+/*
+ * Like LockAll(), but the paths are released automatically unless the lease is
+ * renewed at least once every `ttl`. See Lease.
+ */
+func (fileScheduler *FileScheduler) LockWithLease(paths []string, ttl time.Duration) (*Lease, error) {
+  id := fileScheduler.nextId()
+  lease, err := fileScheduler.manager.AcquireWithLease(context.Background(), routineId(id), paths, false, PriorityNormal, ttl)
+  if err != nil {
+    return nil, err
+  }
+  return &Lease{Id: id, Paths: paths, lease: lease}, nil
+}
+
+/*
+ * Registers a function to call (from the scheduling routine) whenever a lease
+ * expires. It must not block.
+ */
+func (fileScheduler *FileScheduler) OnLeaseExpired(observer func(lease *Lease)) {
+  fileScheduler.manager.OnLeaseExpired(func(lease *lockManager.Lease) {
+    id, _ := strconv.ParseInt(lease.RoutineId, 10, 64)
+    observer(&Lease{Id: id, Paths: lease.Paths, lease: lease})
+  })
+}
+
+/*
+ * Sets how long a background request must wait to be promoted to normal.
+ * Zero disables aging. Defaults to a second.
+ */
+func (fileScheduler *FileScheduler) SetAgingInterval(agingInterval time.Duration) {
+  fileScheduler.manager.SetAgingInterval(agingInterval)
+}
+
+/*
+ * Reports wait times, hold times, queue depth and grant/deny counts to the
+ * recorder, e.g. a metrics.Registry. Pass metrics.Discard to stop reporting.
+ */
+func (fileScheduler *FileScheduler) SetMetrics(recorder metrics.Recorder) {
+  fileScheduler.manager.SetMetrics(recorder)
+}
+
+/*
+ * Stops accepting lock requests, waits for every held path to be unlocked and
+ * then stops the scheduling routine. Requests that are already waiting fail
+ * with ErrClosed unless SetDrainOnClose(true) was called. If the context is
+ * done first, the routine is stopped anyway and the context's error is
+ * returned.
+ */
+func (fileScheduler *FileScheduler) Close(ctx context.Context) error {
+  return fileScheduler.manager.Close(ctx)
+}
+
+/*
+ * Makes every lock also exclude other processes that enabled process locks
+ * with the same directory, e.g. a batch job working on the same files. A
+ * request is only granted once no other process holds its paths either.
+ * Call it before locking anything, and keep `lockDir` outside the locked tree.
+ * Close() releases this process's locks in the directory.
+ */
+func (fileScheduler *FileScheduler) EnableProcessLocks(lockDir string) error {
+  processLocks, err := lockManager.OpenProcessLocks(lockDir)
+  if err != nil {
+    return err
+  }
+  fileScheduler.manager.SetProcessLocks(processLocks)
+  return nil
+}
+
+/*
+ * Sets whether Close() still grants requests that are already waiting.
+ * Defaults to false.
+ */
+func (fileScheduler *FileScheduler) SetDrainOnClose(drainOnClose bool) {
+  fileScheduler.manager.SetDrainOnClose(drainOnClose)
+}
+
+/*
+ * Returns the locks currently held and the tasks waiting for them. Routine IDs
+ * are the IDs returned by the lock methods, in decimal.
+ */
+func (fileScheduler *FileScheduler) Snapshot() Snapshot {
+  return fileScheduler.manager.Snapshot()
+}
+
+/*
+ * Returns a handler that responds to every request with Snapshot() as JSON.
+ */
+func (fileScheduler *FileScheduler) SnapshotHandler() http.Handler {
+  return fileScheduler.manager.SnapshotHandler()
+}
+
+/*
+ * Releases every path locked under the ID. Unlike Unlock(), this reports
+ * whether anything was actually held, so it is safe to call more than once,
+ * e.g. both explicitly and in a deferred cleanup that runs if the routine
+ * panics:
+ *
+ *   id := fileScheduler.Lock("foo")
+ *   defer fileScheduler.Release(id)
+ */
+func (fileScheduler *FileScheduler) Release(id int64) bool {
+  return fileScheduler.manager.ReleaseAll(routineId(id))
+}
+
+func (fileScheduler *FileScheduler)lock(paths []string, shared bool, class PriorityClass) int64 {
+  id, err := fileScheduler.lockContext(context.Background(), paths, shared, class)
+  if err != nil {
+    return 0
+  }
+  return id
+}
+
+func (fileScheduler *FileScheduler)lockContext(ctx context.Context, paths []string, shared bool, class PriorityClass) (int64, error) {
+  id := fileScheduler.nextId()
+  err := fileScheduler.manager.Acquire(ctx, routineId(id), paths, shared, class)
+  if err != nil {
+    return 0, err
+  }
+  return id, nil
+}
+
+func (fileScheduler *FileScheduler)lockPatternsContext(ctx context.Context, patterns []string, shared bool) (int64, error) {
+  id := fileScheduler.nextId()
+  err := fileScheduler.manager.AcquirePatterns(ctx, routineId(id), patterns, shared, PriorityNormal)
+  if err != nil {
+    return 0, err
+  }
+  return id, nil
+}
+
+func (fileScheduler *FileScheduler)tryLock(paths []string, shared bool) (int64, error) {
+  id := fileScheduler.nextId()
+  err := fileScheduler.manager.TryAcquire(routineId(id), paths, shared)
+  if err != nil {
+    return 0, err
+  }
+  return id, nil
+}
+
+func (fileScheduler *FileScheduler)nextId() int64 {
+  return atomic.AddInt64(fileScheduler.counter, 1)
+}
+
+/********** Classless Functions **********/
+
+func routineId(id int64) string {
+  return strconv.FormatInt(id, 10)
 }
@@ -0,0 +1,771 @@
+package fileScheduler
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "sort"
+  "strconv"
+  "testing"
+  "time"
+)
+
+/*
+ * Stops the FileScheduler without waiting for the locks the test left held.
+ */
+func closeNow(fileScheduler *FileScheduler) {
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  fileScheduler.Close(ctx)
+}
+
+/*
+ * Waits until `n` requests are waiting.
+ */
+func waitForWaiting(t *testing.T, fileScheduler *FileScheduler, n int) {
+  deadline := time.Now().Add(5 * time.Second)
+  for len(fileScheduler.Snapshot().Waiting) != n {
+    if time.Now().After(deadline) {
+      t.Fatalf("expected %d waiting requests, got %+v", n, fileScheduler.Snapshot().Waiting)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+/*
+ * Locks the paths in a new goroutine and returns the channel its ID and error
+ * go to.
+ */
+func lockAsync(fileScheduler *FileScheduler, ctx context.Context, paths []string) chan lockResult {
+  rtn := make(chan lockResult, 1)
+  go func() {
+    id, err := fileScheduler.LockContext(ctx, paths)
+    rtn <- lockResult{id, err}
+  }()
+  return rtn
+}
+
+type lockResult struct {
+  id int64
+  err error
+}
+
+func expectResult(t *testing.T, result chan lockResult) lockResult {
+  select {
+  case rtn := <- result:
+    return rtn
+  case <- time.After(5 * time.Second):
+    t.Fatal("lock request never returned")
+  }
+  return lockResult{}
+}
+
+/*
+ * MakeFileScheduler() returns a value, and copies of it share the same locks
+ * and never hand out the same ID.
+ */
+func TestFileSchedulerCopiesShareLocks(t *testing.T) {
+  var fileScheduler FileScheduler = MakeFileScheduler()
+  defer fileScheduler.Close(context.Background())
+  fileSchedulerCopy := fileScheduler
+
+  id := fileSchedulerCopy.Lock("a")
+  if id == 0 {
+    t.Fatal("Lock failed")
+  }
+  if _, err := fileScheduler.TryLock([]string{"a/b"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryLock of a/b while a copy holds a: %v, want ErrWouldBlock", err)
+  }
+  otherId, err := fileScheduler.TryLock([]string{"b"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if otherId == id {
+    t.Errorf("both copies handed out ID %d", id)
+  }
+  fileScheduler.Unlock(id)
+  fileSchedulerCopy.Unlock(otherId)
+  if len(fileScheduler.Snapshot().Held) != 0 {
+    t.Errorf("locks still held: %+v", fileScheduler.Snapshot().Held)
+  }
+}
+
+/*
+ * The deprecated TaskPriorityQueue still works by value as a sort.Interface.
+ */
+func TestDeprecatedTaskPriorityQueue(t *testing.T) {
+  pq := MakeTaskPriorityQueue()
+  for _, priority := range []int64{2, 3, 1} {
+    pq.Push(MakeTask(priority, nil, priority, false))
+  }
+  var sorter sort.Interface = pq
+  sort.Sort(sorter)
+  if pq.Length() != 3 || pq.Pop().(*Task).Priority != 1 || pq.Peek().(*Task).Priority != 2 {
+    t.Errorf("unexpected order after sorting")
+  }
+}
+
+func TestTryLock(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  id := fileScheduler.Lock("a")
+  for _, paths := range [][]string{{"a"}, {"a/b"}, {""}, {"c", "a/b"}} {
+    _, err := fileScheduler.TryLock(paths)
+    var lockError *LockError
+    if !errors.Is(err, ErrWouldBlock) || !errors.As(err, &lockError) {
+      t.Errorf("TryLock(%q) while a is held: %v, want a *LockError wrapping ErrWouldBlock", paths, err)
+    }
+  }
+  if _, err := fileScheduler.TryRLock([]string{"a"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryRLock(a) while a is held: %v, want ErrWouldBlock", err)
+  }
+
+  // Paths a waiting request needs are taken too, even if nobody holds them.
+  result := lockAsync(fileScheduler, context.Background(), []string{"a", "c"})
+  waitForWaiting(t, fileScheduler, 1)
+  if _, err := fileScheduler.TryLock([]string{"c"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryLock(c) while a request waits for it: %v, want ErrWouldBlock", err)
+  }
+  otherId, err := fileScheduler.TryLock([]string{"d"})
+  if err != nil {
+    t.Fatalf("TryLock(d): %v", err)
+  }
+  fileScheduler.Unlock(otherId)
+  fileScheduler.Unlock(id)
+  if waiter := expectResult(t, result); waiter.err != nil {
+    t.Fatal(waiter.err)
+  } else {
+    fileScheduler.Unlock(waiter.id)
+  }
+}
+
+/*
+ * A request whose context is done stops waiting and leaves the queue, so it
+ * doesn't hold up anyone else.
+ */
+func TestLockContextGivesUp(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  id := fileScheduler.Lock("a")
+
+  ctx, cancel := context.WithCancel(context.Background())
+  result := lockAsync(fileScheduler, ctx, []string{"a", "b"})
+  waitForWaiting(t, fileScheduler, 1)
+  cancel()
+  if canceled := expectResult(t, result); !errors.Is(canceled.err, context.Canceled) || canceled.id != 0 {
+    t.Errorf("cancelled LockContext: %d, %v, want 0 and context.Canceled", canceled.id, canceled.err)
+  }
+  waitForWaiting(t, fileScheduler, 0)
+  // b would be unavailable if the cancelled request were still waiting for it.
+  if otherId, err := fileScheduler.TryLock([]string{"b"}); err != nil {
+    t.Errorf("TryLock(b) after the request for it was cancelled: %v", err)
+  } else {
+    fileScheduler.Unlock(otherId)
+  }
+
+  ctx, cancel = context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  if _, err := fileScheduler.RLockContext(ctx, []string{"a"}); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("RLockContext past its deadline: %v, want context.DeadlineExceeded", err)
+  }
+  waitForWaiting(t, fileScheduler, 0)
+  fileScheduler.Unlock(id)
+}
+
+/*
+ * A request skips ahead of an earlier one that is blocked as long as it
+ * doesn't need any of the paths held or waited for.
+ */
+func TestLockSkipsBlockedRequests(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  id := fileScheduler.Lock("a")
+  blocked := lockAsync(fileScheduler, context.Background(), []string{"a/x", "c"})
+  waitForWaiting(t, fileScheduler, 1)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+  defer cancel()
+  skipper, err := fileScheduler.LockContext(ctx, []string{"b/y"})
+  if err != nil {
+    t.Fatalf("LockContext(b/y) behind a blocked request for a/x: %v", err)
+  }
+  fileScheduler.Unlock(skipper)
+
+  // c is free, but the blocked request is waiting for it, so a later request
+  // for c waits its turn.
+  later := lockAsync(fileScheduler, context.Background(), []string{"c"})
+  waitForWaiting(t, fileScheduler, 2)
+  fileScheduler.Unlock(id)
+  first := expectResult(t, blocked)
+  if first.err != nil {
+    t.Fatal(first.err)
+  }
+  select {
+  case <- later:
+    t.Fatal("the later request for c was granted while the earlier one held it")
+  case <- time.After(20 * time.Millisecond):
+  }
+  fileScheduler.Unlock(first.id)
+  if second := expectResult(t, later); second.err != nil {
+    t.Fatal(second.err)
+  } else {
+    fileScheduler.Unlock(second.id)
+  }
+}
+
+/*
+ * Locks "a" with each of the lock functions in turn, once the previous one is
+ * waiting, and returns the order they were granted in after `holder` unlocks.
+ */
+func grantOrder(t *testing.T, fileScheduler *FileScheduler, holder int64, lockFunctions map[string]func(string) int64, names []string) []string {
+  granted := make(chan string, len(names))
+  for i, name := range names {
+    go func(name string) {
+      id := lockFunctions[name]("a")
+      granted <- name
+      fileScheduler.Unlock(id)
+    }(name)
+    waitForWaiting(t, fileScheduler, i + 1)
+  }
+  fileScheduler.Unlock(holder)
+  rtn := make([]string, 0)
+  for range names {
+    select {
+    case name := <- granted:
+      rtn = append(rtn, name)
+    case <- time.After(5 * time.Second):
+      t.Fatalf("only %v were granted", rtn)
+    }
+  }
+  return rtn
+}
+
+func TestPriorityClasses(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  fileScheduler.SetAgingInterval(0)
+  lockFunctions := map[string]func(string) int64{
+    "background": fileScheduler.LockBackground,
+    "normal": fileScheduler.Lock,
+    "urgent": fileScheduler.LockUrgent,
+  }
+  holder := fileScheduler.Lock("a")
+  names := []string{"background", "normal", "urgent"}
+  order := grantOrder(t, fileScheduler, holder, lockFunctions, names)
+  if want := []string{"urgent", "normal", "background"}; !reflect.DeepEqual(order, want) {
+    t.Errorf("granted %v, want %v", order, want)
+  }
+}
+
+/*
+ * A background request that has waited for the aging interval is promoted, so
+ * it goes before normal requests that arrived after it.
+ */
+func TestAgingPromotesBackgroundRequests(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  fileScheduler.SetAgingInterval(50 * time.Millisecond)
+  holder := fileScheduler.Lock("a")
+  granted := make(chan string, 2)
+  go func() {
+    id := fileScheduler.LockBackground("a")
+    granted <- "background"
+    fileScheduler.Unlock(id)
+  }()
+  waitForWaiting(t, fileScheduler, 1)
+  time.Sleep(100 * time.Millisecond)
+  go func() {
+    id := fileScheduler.Lock("a")
+    granted <- "normal"
+    fileScheduler.Unlock(id)
+  }()
+  waitForWaiting(t, fileScheduler, 2)
+  fileScheduler.Unlock(holder)
+  for _, want := range []string{"background", "normal"} {
+    select {
+    case name := <- granted:
+      if name != want {
+        t.Fatalf("%s was granted first, want %s", name, want)
+      }
+    case <- time.After(5 * time.Second):
+      t.Fatalf("%s was never granted", want)
+    }
+  }
+}
+
+func TestLeaseExpiry(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  expired := make(chan *Lease, 1)
+  fileScheduler.OnLeaseExpired(func(lease *Lease) {
+    expired <- lease
+  })
+  ttl := 100 * time.Millisecond
+
+  // A lease that is renewed stays held.
+  renewed, err := fileScheduler.LockWithLease([]string{"a"}, ttl)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 10; i++ {
+    time.Sleep(ttl / 4)
+    if err := renewed.Renew(); err != nil {
+      t.Fatalf("Renew: %v", err)
+    }
+  }
+  if _, err := fileScheduler.TryLock([]string{"a"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryLock(a) while its lease is renewed: %v, want ErrWouldBlock", err)
+  }
+  if !renewed.Release() || renewed.Release() {
+    t.Error("Release should report true only the first time")
+  }
+
+  // One that isn't expires, releasing its paths and notifying observers.
+  lease, err := fileScheduler.LockWithLease([]string{"b", "c"}, ttl)
+  if err != nil {
+    t.Fatal(err)
+  }
+  select {
+  case expiredLease := <- expired:
+    if expiredLease.Id != lease.Id || !reflect.DeepEqual(expiredLease.Paths, []string{"b", "c"}) {
+      t.Errorf("observer got %+v, want %+v", expiredLease, lease)
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("the lease never expired")
+  }
+  select {
+  case <- lease.Done():
+  case <- time.After(5 * time.Second):
+    t.Fatal("Done() wasn't closed")
+  }
+  if err := lease.Renew(); !errors.Is(err, ErrLeaseExpired) {
+    t.Errorf("Renew of an expired lease: %v, want ErrLeaseExpired", err)
+  }
+  if lease.Release() {
+    t.Error("Release of an expired lease reported true")
+  }
+  if id, err := fileScheduler.TryLock([]string{"b", "c"}); err != nil {
+    t.Errorf("TryLock after the lease expired: %v", err)
+  } else {
+    fileScheduler.Unlock(id)
+  }
+}
+
+func TestSnapshotHandler(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  writer := fileScheduler.Lock("a")
+  reader := fileScheduler.RLock("b/c")
+  waiter := lockAsync(fileScheduler, context.Background(), []string{"a/d"})
+  waitForWaiting(t, fileScheduler, 1)
+
+  recorder := httptest.NewRecorder()
+  fileScheduler.SnapshotHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/locks", nil))
+  if recorder.Code != 200 || recorder.Header().Get("Content-Type") != "application/json" {
+    t.Fatalf("%d (%s) %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body)
+  }
+  var raw struct {
+    TakenAt string `json:"takenAt"`
+    Held []map[string]interface{} `json:"held"`
+    Waiting []map[string]interface{} `json:"waiting"`
+  }
+  if err := json.Unmarshal(recorder.Body.Bytes(), &raw); err != nil {
+    t.Fatal(err)
+  }
+  if len(raw.TakenAt) == 0 || len(raw.Held) != 2 || len(raw.Waiting) != 1 {
+    t.Fatalf("unexpected snapshot %s", recorder.Body)
+  }
+  for _, key := range []string{"path", "routineId", "mode", "count", "acquiredAt"} {
+    if _, ok := raw.Held[0][key]; !ok {
+      t.Errorf("held lock without %q: %v", key, raw.Held[0])
+    }
+  }
+  for _, key := range []string{"paths", "routineId", "mode", "class", "priority", "enqueuedAt", "waitingNs"} {
+    if _, ok := raw.Waiting[0][key]; !ok {
+      t.Errorf("waiter without %q: %v", key, raw.Waiting[0])
+    }
+  }
+
+  var snapshot Snapshot
+  if err := json.Unmarshal(recorder.Body.Bytes(), &snapshot); err != nil {
+    t.Fatal(err)
+  }
+  wantHeld := []HeldLock{
+    {Path: "/a", RoutineId: strconv.FormatInt(writer, 10), Mode: ModeExclusive, Count: 1},
+    {Path: "/b/c", RoutineId: strconv.FormatInt(reader, 10), Mode: ModeShared, Count: 1},
+  }
+  for i, held := range snapshot.Held {
+    if held.AcquiredAt.IsZero() || held.AcquiredAt.After(snapshot.TakenAt) {
+      t.Errorf("%s acquired at %v, snapshot taken at %v", held.Path, held.AcquiredAt, snapshot.TakenAt)
+    }
+    held.AcquiredAt = time.Time{}
+    if !reflect.DeepEqual(held, wantHeld[i]) {
+      t.Errorf("held %+v, want %+v", held, wantHeld[i])
+    }
+  }
+  waiting := snapshot.Waiting[0]
+  if !reflect.DeepEqual(waiting.Paths, []string{"/a/d"}) || waiting.Mode != ModeExclusive || waiting.Class != "normal" || waiting.Waiting <= 0 {
+    t.Errorf("waiter %+v", waiting)
+  }
+
+  fileScheduler.Unlock(writer)
+  fileScheduler.Unlock(reader)
+  if result := expectResult(t, waiter); result.err != nil {
+    t.Fatal(result.err)
+  } else {
+    fileScheduler.Unlock(result.id)
+  }
+}
+
+/*
+ * Runs `f`, and returns what it panicked with.
+ */
+func recovered(f func()) (rtn interface{}) {
+  defer func() {
+    rtn = recover()
+  }()
+  f()
+  return nil
+}
+
+func TestGuardsReleaseAfterPanic(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  expectFree := func(when string) {
+    if id, err := fileScheduler.TryLock([]string{"a"}); err != nil {
+      t.Errorf("%s: a is still locked: %v", when, err)
+    } else {
+      fileScheduler.Unlock(id)
+    }
+  }
+
+  panicked := recovered(func() {
+    fileScheduler.WithLock([]string{"a"}, func() error {
+      if _, err := fileScheduler.TryRLock([]string{"a"}); !errors.Is(err, ErrWouldBlock) {
+        t.Errorf("a wasn't locked inside WithLock: %v", err)
+      }
+      panic("boom")
+    })
+  })
+  if panicked != "boom" {
+    t.Errorf("WithLock swallowed the panic: %v", panicked)
+  }
+  expectFree("after WithLock panicked")
+
+  panicked = recovered(func() {
+    fileScheduler.WithRLock([]string{"a"}, func() error {
+      panic("boom")
+    })
+  })
+  if panicked != "boom" {
+    t.Errorf("WithRLock swallowed the panic: %v", panicked)
+  }
+  expectFree("after WithRLock panicked")
+
+  recovered(func() {
+    guard, err := fileScheduler.LockGuard([]string{"a"})
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer guard.Unlock()
+    panic("boom")
+  })
+  expectFree("after a guarded function panicked")
+
+  errF := errors.New("f failed")
+  if err := fileScheduler.WithLock([]string{"a"}, func() error { return errF }); err != errF {
+    t.Errorf("WithLock returned %v, want f's error", err)
+  }
+  expectFree("after f failed")
+}
+
+func TestGuard(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  paths := []string{"a", "b"}
+  guard, err := fileScheduler.LockGuard(paths)
+  if err != nil {
+    t.Fatal(err)
+  }
+  paths[0] = "changed"
+  guardPaths := guard.Paths()
+  guardPaths[1] = "changed"
+  if !reflect.DeepEqual(guard.Paths(), []string{"a", "b"}) {
+    t.Errorf("Paths() %v, want [a b]", guard.Paths())
+  }
+  guard.Unlock()
+  guard.Unlock()
+  if id, err := fileScheduler.TryLock([]string{"a", "b"}); err != nil {
+    t.Errorf("TryLock after Unlock: %v", err)
+  } else {
+    fileScheduler.Unlock(id)
+  }
+
+  fileScheduler.Close(context.Background())
+  if guard, err := fileScheduler.LockGuard([]string{"a"}); guard != nil || !errors.Is(err, ErrClosed) {
+    t.Errorf("LockGuard once closed: %v, %v, want nil and ErrClosed", guard, err)
+  }
+}
+
+/*
+ * Starts Close() in a new goroutine and returns the channel its error goes to,
+ * once it has started closing.
+ */
+func closeAsync(t *testing.T, fileScheduler *FileScheduler, ctx context.Context) chan error {
+  rtn := make(chan error, 1)
+  go func() {
+    rtn <- fileScheduler.Close(ctx)
+  }()
+  deadline := time.Now().Add(5 * time.Second)
+  for {
+    id, err := fileScheduler.TryLock([]string{"unrelated"})
+    if errors.Is(err, ErrClosed) {
+      return rtn
+    } else if err == nil {
+      fileScheduler.Unlock(id)
+    }
+    if time.Now().After(deadline) {
+      t.Fatal("Close never started")
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+func TestCloseFailsWaitingRequests(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  holder := fileScheduler.Lock("a")
+  waiter := lockAsync(fileScheduler, context.Background(), []string{"a"})
+  waitForWaiting(t, fileScheduler, 1)
+  closed := closeAsync(t, fileScheduler, context.Background())
+
+  if result := expectResult(t, waiter); !errors.Is(result.err, ErrClosed) {
+    t.Errorf("waiting request: %v, want ErrClosed", result.err)
+  }
+  if id := fileScheduler.Lock("b"); id != 0 {
+    t.Errorf("Lock once closing returned %d, want 0", id)
+  }
+  select {
+  case err := <- closed:
+    t.Fatalf("Close returned %v while a was still held", err)
+  case <- time.After(20 * time.Millisecond):
+  }
+  fileScheduler.Unlock(holder)
+  select {
+  case err := <- closed:
+    if err != nil {
+      t.Errorf("Close: %v", err)
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("Close didn't return once everything was unlocked")
+  }
+}
+
+func TestCloseDrainsWaitingRequests(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  fileScheduler.SetDrainOnClose(true)
+  holder := fileScheduler.Lock("a")
+  waiter := lockAsync(fileScheduler, context.Background(), []string{"a"})
+  waitForWaiting(t, fileScheduler, 1)
+  closed := closeAsync(t, fileScheduler, context.Background())
+
+  if _, err := fileScheduler.LockContext(context.Background(), []string{"b"}); !errors.Is(err, ErrClosed) {
+    t.Errorf("LockContext once closing: %v, want ErrClosed", err)
+  }
+  fileScheduler.Unlock(holder)
+  result := expectResult(t, waiter)
+  if result.err != nil {
+    t.Fatalf("waiting request wasn't drained: %v", result.err)
+  }
+  select {
+  case err := <- closed:
+    t.Fatalf("Close returned %v while the drained request held a", err)
+  case <- time.After(20 * time.Millisecond):
+  }
+  fileScheduler.Unlock(result.id)
+  select {
+  case err := <- closed:
+    if err != nil {
+      t.Errorf("Close: %v", err)
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("Close didn't return once everything was unlocked")
+  }
+}
+
+func TestCloseGivesUpAtDeadline(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  fileScheduler.Lock("a")
+  ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  if err := fileScheduler.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("Close with a held lock: %v, want context.DeadlineExceeded", err)
+  }
+}
+
+func TestUpgradeAndDowngrade(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  first := fileScheduler.RLock("a")
+  second := fileScheduler.RLock("a/b")
+
+  // The first reader waits for the second to stop reading, without letting go
+  // of a in the meantime.
+  upgraded := make(chan error, 1)
+  go func() {
+    upgraded <- fileScheduler.Upgrade(context.Background(), first, []string{"a"})
+  }()
+  waitForWaiting(t, fileScheduler, 1)
+  if _, err := fileScheduler.TryLock([]string{"a"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryLock(a) while upgrading: %v, want ErrWouldBlock", err)
+  }
+  // The second can't upgrade too, or each would wait for the other forever.
+  if err := fileScheduler.Upgrade(context.Background(), second, []string{"a/b"}); !errors.Is(err, ErrUpgradeConflict) {
+    t.Errorf("second Upgrade: %v, want ErrUpgradeConflict", err)
+  }
+  fileScheduler.Unlock(second)
+  select {
+  case err := <- upgraded:
+    if err != nil {
+      t.Fatalf("Upgrade: %v", err)
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("Upgrade never finished")
+  }
+  if _, err := fileScheduler.TryRLock([]string{"a/b"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryRLock(a/b) after the upgrade: %v, want ErrWouldBlock", err)
+  }
+
+  if err := fileScheduler.Downgrade(first, []string{"a"}); err != nil {
+    t.Fatalf("Downgrade: %v", err)
+  }
+  if reader, err := fileScheduler.TryRLock([]string{"a/b"}); err != nil {
+    t.Errorf("TryRLock(a/b) after the downgrade: %v", err)
+  } else {
+    fileScheduler.Unlock(reader)
+  }
+  if _, err := fileScheduler.TryLock([]string{"a"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryLock(a) after the downgrade: %v, want ErrWouldBlock", err)
+  }
+
+  // Each only converts locks held in the mode it converts from.
+  if err := fileScheduler.Downgrade(first, []string{"a"}); !errors.Is(err, ErrNotHeld) {
+    t.Errorf("Downgrade of a read lock: %v, want ErrNotHeld", err)
+  }
+  if err := fileScheduler.Upgrade(context.Background(), first, []string{"c"}); !errors.Is(err, ErrNotHeld) {
+    t.Errorf("Upgrade of an unheld path: %v, want ErrNotHeld", err)
+  }
+  fileScheduler.Unlock(first)
+}
+
+/*
+ * An upgrade whose context is done gives up but keeps its read locks.
+ */
+func TestUpgradeContext(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  guard, err := fileScheduler.RLockGuard([]string{"a"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  other := fileScheduler.RLock("a")
+  ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  if err := guard.Upgrade(ctx); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("Upgrade past its deadline: %v, want context.DeadlineExceeded", err)
+  }
+  fileScheduler.Unlock(other)
+  if _, err := fileScheduler.TryLock([]string{"a"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryLock(a) after the upgrade gave up: %v, want ErrWouldBlock", err)
+  }
+  if err := guard.Upgrade(context.Background()); err != nil {
+    t.Errorf("Upgrade once alone: %v", err)
+  }
+  if err := guard.Downgrade(); err != nil {
+    t.Errorf("Downgrade: %v", err)
+  }
+  guard.Unlock()
+}
+
+func TestLockPattern(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  id := fileScheduler.LockPattern("configs/*.json")
+  if id == 0 {
+    t.Fatal("LockPattern failed")
+  }
+  tests := []struct {
+    paths []string
+    available bool
+  }{
+    {[]string{"configs/a.json"}, false},
+    {[]string{"configs/new.json"}, false}, // even files that don't exist yet
+    {[]string{"configs/a.json/b"}, false},
+    {[]string{"configs"}, false},
+    {[]string{""}, false},
+    {[]string{"configs/a.bin"}, true},
+    {[]string{"configs/json"}, true},
+    {[]string{"other/a.json"}, true},
+  }
+  for _, test := range tests {
+    otherId, err := fileScheduler.TryLock(test.paths)
+    if test.available && err != nil {
+      t.Errorf("TryLock(%q) while configs/*.json is locked: %v", test.paths, err)
+    } else if !test.available && !errors.Is(err, ErrWouldBlock) {
+      t.Errorf("TryLock(%q) while configs/*.json is locked: %v, want ErrWouldBlock", test.paths, err)
+    }
+    if err == nil {
+      fileScheduler.Unlock(otherId)
+    }
+  }
+
+  // Overlapping patterns exclude each other too.
+  ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+  defer cancel()
+  if _, err := fileScheduler.LockPatternsContext(ctx, []string{"configs/a.*"}); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("LockPatternsContext(configs/a.*): %v, want context.DeadlineExceeded", err)
+  }
+  fileScheduler.Unlock(id)
+
+  // And a pattern waits for the concrete paths it matches.
+  concrete := fileScheduler.Lock("configs/b.json")
+  result := make(chan int64, 1)
+  go func() {
+    result <- fileScheduler.LockPattern("configs/*.json")
+  }()
+  waitForWaiting(t, fileScheduler, 1)
+  fileScheduler.Unlock(concrete)
+  select {
+  case patternId := <- result:
+    if patternId == 0 {
+      t.Fatal("LockPattern failed")
+    }
+    fileScheduler.Unlock(patternId)
+  case <- time.After(5 * time.Second):
+    t.Fatal("LockPattern was never granted")
+  }
+
+  if _, err := fileScheduler.LockPatternsContext(context.Background(), []string{"configs/["}); !errors.Is(err, ErrInvalidPattern) {
+    t.Errorf("a malformed pattern: %v, want ErrInvalidPattern", err)
+  }
+}
+
+func TestRLockPatternSharesWithReaders(t *testing.T) {
+  fileScheduler := NewFileScheduler()
+  defer closeNow(fileScheduler)
+  id := fileScheduler.RLockPattern("configs/*.json")
+  if id == 0 {
+    t.Fatal("RLockPattern failed")
+  }
+  if reader, err := fileScheduler.TryRLock([]string{"configs/a.json"}); err != nil {
+    t.Errorf("TryRLock under a shared pattern: %v", err)
+  } else {
+    fileScheduler.Unlock(reader)
+  }
+  if _, err := fileScheduler.TryLock([]string{"configs/a.json"}); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("TryLock under a shared pattern: %v, want ErrWouldBlock", err)
+  }
+  fileScheduler.Unlock(id)
+}
@@ -0,0 +1,105 @@
+package fileScheduler
+
+import (
+  "context"
+)
+
+/*
+ * A set of locked paths that remembers its own ID, so callers can't pass the
+ * wrong one back to Unlock(). Unlike the ID returned by Lock(), a Guard is
+ * only ever returned alongside a nil error.
+ *
+ *   guard, err := fileScheduler.LockGuard([]string{"foo"})
+ *   if err != nil {
+ *     return err
+ *   }
+ *   defer guard.Unlock()
+ *
+ * guard.Unlock()
+ * Releases the paths. It is safe to call more than once.
+ *
+ * guard.Paths() []string
+ * Returns the paths as they were passed to the lock method.
+ *
+ * guard.Upgrade(ctx context.Context) error
+ * Turns the guard's read locks into exclusive locks. See Upgrade().
+ *
+ * guard.Downgrade() error
+ * Turns the guard's exclusive locks into read locks. See Downgrade().
+ */
+type Guard struct {
+  Id int64 // the ID the paths are locked under
+  paths []string
+  fileScheduler *FileScheduler
+}
+
+func (guard *Guard) Unlock() {
+  guard.fileScheduler.Release(guard.Id)
+}
+
+func (guard *Guard) Paths() []string {
+  rtn := make([]string, len(guard.paths))
+  copy(rtn, guard.paths)
+  return rtn
+}
+
+func (guard *Guard) Upgrade(ctx context.Context) error {
+  return guard.fileScheduler.Upgrade(ctx, guard.Id, guard.paths)
+}
+
+func (guard *Guard) Downgrade() error {
+  return guard.fileScheduler.Downgrade(guard.Id, guard.paths)
+}
+
+/*
+ * Like LockAll(), but returns a *Guard instead of an ID, and a *LockError
+ * instead of 0 on failure.
+ */
+func (fileScheduler *FileScheduler) LockGuard(paths []string) (*Guard, error) {
+  return fileScheduler.guard(context.Background(), paths, false)
+}
+
+func (fileScheduler *FileScheduler) RLockGuard(paths []string) (*Guard, error) {
+  return fileScheduler.guard(context.Background(), paths, true)
+}
+
+func (fileScheduler *FileScheduler) LockGuardContext(ctx context.Context, paths []string) (*Guard, error) {
+  return fileScheduler.guard(ctx, paths, false)
+}
+
+func (fileScheduler *FileScheduler) RLockGuardContext(ctx context.Context, paths []string) (*Guard, error) {
+  return fileScheduler.guard(ctx, paths, true)
+}
+
+/*
+ * Exclusively locks the paths, calls `f` and releases the paths, even if `f`
+ * panics (in which case the panic continues once the paths are released).
+ * Returns the error from locking or, failing that, the error from `f`.
+ */
+func (fileScheduler *FileScheduler) WithLock(paths []string, f func() error) error {
+  return fileScheduler.with(paths, false, f)
+}
+
+/*
+ * Like WithLock(), but locks the paths for reading.
+ */
+func (fileScheduler *FileScheduler) WithRLock(paths []string, f func() error) error {
+  return fileScheduler.with(paths, true, f)
+}
+
+func (fileScheduler *FileScheduler)guard(ctx context.Context, paths []string, shared bool) (*Guard, error) {
+  id, err := fileScheduler.lockContext(ctx, paths, shared, PriorityNormal)
+  if err != nil {
+    return nil, err
+  }
+  return &Guard{Id: id, paths: append([]string(nil), paths...), fileScheduler: fileScheduler}, nil
+}
+
+func (fileScheduler *FileScheduler)with(paths []string, shared bool, f func() error) error {
+  guard, err := fileScheduler.guard(context.Background(), paths, shared)
+  if err != nil {
+    return err
+  }
+  defer guard.Unlock()
+  return f()
+}
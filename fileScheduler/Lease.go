@@ -0,0 +1,54 @@
+package fileScheduler
+
+import (
+  "github.com/Thomas-Redding/go_util/lockManager"
+)
+
+// Returned by Lease.Renew() once the lease has expired or been released.
+var ErrLeaseExpired = lockManager.ErrLeaseExpired
+
+/*
+ * A lock that is released automatically unless it is renewed at least once
+ * every `ttl`. This way, paths don't stay locked forever if their holder
+ * crashes or forgets about them.
+ *
+ *   lease, err := fileScheduler.LockWithLease([]string{"foo"}, 10 * time.Second)
+ *   if err != nil {
+ *     return err
+ *   }
+ *   defer lease.Release()
+ *   for chunk := range chunks {
+ *     if err := lease.Renew(); err != nil {
+ *       return err // We lost the lock.
+ *     }
+ *     write(chunk)
+ *   }
+ */
+type Lease struct {
+  Id int64 // the ID the paths are locked under
+  Paths []string
+  lease *lockManager.Lease
+}
+
+/*
+ * Extends the lease so it expires `ttl` from now. Fails with ErrLeaseExpired
+ * if the paths have already been released.
+ */
+func (lease *Lease) Renew() error {
+  return lease.lease.Renew()
+}
+
+/*
+ * Releases the paths. Returns false if the lease had already expired or been
+ * released, so it is safe to call more than once.
+ */
+func (lease *Lease) Release() bool {
+  return lease.lease.Release()
+}
+
+/*
+ * Returns a channel that is closed once the lease expires or is released.
+ */
+func (lease *Lease) Done() <-chan bool {
+  return lease.lease.Done()
+}
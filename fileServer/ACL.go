@@ -0,0 +1,210 @@
+package fileServer
+
+import (
+  "encoding/json"
+  "fmt"
+  "os"
+  "strings"
+  "sync"
+)
+
+/*
+ * An ACL (access control list) grants verbs to principals on paths and
+ * everything under them. Verbs are HTTP methods ("GET", which covers HEAD,
+ * "PUT", "DELETE", "POST") and PATCH commands ("mv", "zip", "mkdir", ...); "*"
+ * is every verb. The rules live in a JSON file, usually next to `rootDir`
+ * (never inside it, or clients could edit it):
+ *
+ *   {
+ *     "rules": [
+ *       {"principal": "*", "path": "", "allow": ["*"]},
+ *       {"principal": "*", "path": "releases", "allow": ["GET", "-d", "ls", "md5", "sha256"]},
+ *       {"principal": "deploy", "path": "releases", "allow": ["*"]}
+ *     ]
+ *   }
+ *
+ * To decide whether a principal may use a verb on a path, the ACL looks for
+ * rules for the principal (or "*") on the path itself, then on its parent and
+ * so on up to the root (""). The first path with any such rules decides: the
+ * verb is allowed iff one of them allows it. So above, everyone may do
+ * anything except under releases/, where only deploy may do more than read.
+ * If no rule applies at all, the verb is denied.
+ *
+ * A command that touches two paths (mv, cp, zip and unzip) must be allowed on
+ * both.
+ *
+ * LoadACL(aclPath string) (*ACL, error)
+ * Reads the rules from the file.
+ *
+ * acl.Reload() error
+ * Reads the file again. If it can't be read or is invalid, the old rules stay
+ * in place.
+ *
+ * acl.Explain(principal *Principal, verb string, path string) ACLDecision
+ * Returns whether the verb is allowed and which rules decided it.
+ */
+
+type ACLRule struct {
+  Principal string `json:"principal"` // a principal's name or "*"
+  Path string `json:"path"` // relative to `rootDir`; "" is the root
+  Allow []string `json:"allow"`
+}
+
+type ACLDecision struct {
+  Allowed bool `json:"allowed"`
+  Rules []ACLRule `json:"rules"` // the rules that decided, if any
+  Reason string `json:"reason"`
+}
+
+type ACL struct {
+  aclPath string
+  mu sync.RWMutex
+  rules map[string][]ACLRule // path -> rules on it
+}
+
+type aclFile struct {
+  Rules []ACLRule `json:"rules"`
+}
+
+// The verbs rules may allow, besides "*".
+var aclVerbs = map[string]bool{
+  "GET": true, "PUT": true, "DELETE": true, "POST": true,
+  "-d": true, "mv": true, "cp": true, "zip": true, "unzip": true, "ls": true, "mkdir": true, "md5": true, "sha256": true,
+}
+
+func LoadACL(aclPath string) (*ACL, error) {
+  acl := &ACL{aclPath: aclPath}
+  if err := acl.Reload(); err != nil {
+    return nil, err
+  }
+  return acl, nil
+}
+
+func (acl *ACL) Reload() error {
+  data, err := os.ReadFile(acl.aclPath)
+  if err != nil {
+    return err
+  }
+  var file aclFile
+  if err := json.Unmarshal(data, &file); err != nil {
+    return fmt.Errorf("ACL.go: Invalid ACL file %s: %w", acl.aclPath, err)
+  }
+  rules := make(map[string][]ACLRule)
+  for i, rule := range file.Rules {
+    if len(rule.Principal) == 0 {
+      return fmt.Errorf("ACL.go: Rule %d has no principal.", i)
+    }
+    for _, verb := range rule.Allow {
+      if verb != "*" && !aclVerbs[verb] {
+        return fmt.Errorf("ACL.go: Rule %d allows unknown verb %q.", i, verb)
+      }
+    }
+    cleanPath, err := cleanRelativePath(rule.Path)
+    if err != nil {
+      return fmt.Errorf("ACL.go: Rule %d has an invalid path: %w", i, err)
+    }
+    rule.Path = cleanPath
+    rules[rule.Path] = append(rules[rule.Path], rule)
+  }
+  acl.mu.Lock()
+  defer acl.mu.Unlock()
+  acl.rules = rules
+  return nil
+}
+
+func (acl *ACL) Explain(principal *Principal, verb string, path string) ACLDecision {
+  if verb == "HEAD" {
+    verb = "GET"
+  }
+  name := "anonymous"
+  if principal != nil {
+    name = principal.Name
+  }
+  path, err := cleanRelativePath(path)
+  if err != nil {
+    return ACLDecision{Allowed: false, Rules: make([]ACLRule, 0), Reason: err.Error()}
+  }
+  acl.mu.RLock()
+  defer acl.mu.RUnlock()
+  for {
+    applicable := make([]ACLRule, 0)
+    for _, rule := range acl.rules[path] {
+      if rule.Principal == "*" || (principal != nil && rule.Principal == principal.Name) {
+        applicable = append(applicable, rule)
+      }
+    }
+    if len(applicable) > 0 {
+      for _, rule := range applicable {
+        for _, allowed := range rule.Allow {
+          if allowed == "*" || allowed == verb {
+            return ACLDecision{Allowed: true, Rules: applicable, Reason: fmt.Sprintf("a rule on /%s allows %s to %s", path, name, verb)}
+          }
+        }
+      }
+      return ACLDecision{Allowed: false, Rules: applicable, Reason: fmt.Sprintf("no rule on /%s allows %s to %s", path, name, verb)}
+    }
+    if len(path) == 0 {
+      return ACLDecision{Allowed: false, Rules: applicable, Reason: fmt.Sprintf("no ACL rule applies to %s", name)}
+    }
+    if i := strings.LastIndex(path, "/"); i >= 0 {
+      path = path[:i]
+    } else {
+      path = ""
+    }
+  }
+}
+
+/********** AccessCheck **********/
+
+/*
+ * Whether a request may use a verb on one of its paths. It needs both the
+ * Authorizer (if any) to grant it `Right` and the ACL (if any) to allow `Verb`.
+ */
+type AccessCheck struct {
+  Verb string `json:"verb"`
+  Path string `json:"path"`
+  Right Right `json:"right"`
+  Allowed bool `json:"allowed"`
+  Reason string `json:"reason"`
+  Rules []ACLRule `json:"aclRules,omitempty"`
+}
+
+/*
+ * What ExplainHandler() returns.
+ */
+type AccessExplanation struct {
+  Principal string `json:"principal,omitempty"`
+  Verb string `json:"verb"`
+  Allowed bool `json:"allowed"`
+  WriteMode string `json:"writeMode"`
+  Reason string `json:"reason,omitempty"` // why the WriteMode refuses the verb, if it does
+  Checks []AccessCheck `json:"checks"`
+}
+
+/*
+ * Decides each of the checks neededAccess() returns for the request.
+ */
+func (pfs *ParentFileServer) evaluateAccess(principal *Principal, verb string, paths []string) []AccessCheck {
+  checks := neededAccess(verb, paths)
+  name := "anonymous"
+  if principal != nil {
+    name = principal.Name
+  }
+  for i := range checks {
+    check := &checks[i]
+    check.Allowed = true
+    check.Reason = "no Authorizer or ACL"
+    if pfs.authorizer != nil {
+      right := pfs.authorizer.Authorize(principal, check.Path)
+      check.Allowed = right >= check.Right
+      check.Reason = fmt.Sprintf("%s has %v rights to /%s and needs %v", name, right, check.Path, check.Right)
+    }
+    if pfs.acl != nil && check.Allowed {
+      decision := pfs.acl.Explain(principal, check.Verb, check.Path)
+      check.Allowed = decision.Allowed
+      check.Rules = decision.Rules
+      check.Reason = decision.Reason
+    }
+  }
+  return checks
+}
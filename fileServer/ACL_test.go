@@ -0,0 +1,123 @@
+package fileServer
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestGrantPathsAreCleaned(t *testing.T) {
+  for _, spelling := range []string{"a/b", "/a/b/", "a//b", "./a/./b", "a/b/."} {
+    authorizer := MakePathAuthorizer()
+    if err := authorizer.Grant("alice", spelling, RightWrite); err != nil {
+      t.Errorf("Grant(%q): %v", spelling, err)
+      continue
+    }
+    if right := authorizer.Authorize(&Principal{Name: "alice"}, "a/b/c"); right != RightWrite {
+      t.Errorf("after Grant(%q), alice has %v rights to a/b/c, want write", spelling, right)
+    }
+    if right := authorizer.Authorize(&Principal{Name: "alice"}, "a"); right != RightNone {
+      t.Errorf("after Grant(%q), alice has %v rights to a, want none", spelling, right)
+    }
+    authorizer.Revoke("alice", spelling)
+    if right := authorizer.Authorize(&Principal{Name: "alice"}, "a/b"); right != RightNone {
+      t.Errorf("after Revoke(%q), alice has %v rights to a/b, want none", spelling, right)
+    }
+  }
+
+  authorizer := MakePathAuthorizer()
+  for _, spelling := range []string{"..", "a/../b", "a/..", "a\x00b"} {
+    if err := authorizer.Grant("alice", spelling, RightAdmin); !errors.Is(err, ErrPathEscapesRoot) {
+      t.Errorf("Grant(%q): expected ErrPathEscapesRoot, got %v", spelling, err)
+    }
+  }
+  if right := authorizer.Authorize(&Principal{Name: "alice"}, ""); right != RightNone {
+    t.Errorf("refused grants gave alice %v rights to the root", right)
+  }
+}
+
+func writeACL(t *testing.T, rules ...ACLRule) string {
+  aclPath := filepath.Join(t.TempDir(), "acl.json")
+  data, err := json.Marshal(aclFile{Rules: rules})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(aclPath, data, 0644); err != nil {
+    t.Fatal(err)
+  }
+  return aclPath
+}
+
+func TestACLPathsAreCleaned(t *testing.T) {
+  acl, err := LoadACL(writeACL(t,
+    ACLRule{Principal: "*", Path: "", Allow: []string{"GET"}},
+    ACLRule{Principal: "*", Path: "/releases//./", Allow: []string{"*"}},
+  ))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if decision := acl.Explain(nil, "PUT", "releases/a"); !decision.Allowed {
+    t.Errorf("PUT releases/a: %+v", decision)
+  }
+  if decision := acl.Explain(nil, "PUT", "other"); decision.Allowed {
+    t.Errorf("PUT other: %+v", decision)
+  }
+
+  for _, path := range []string{"..", "releases/../secret", "a\x00b"} {
+    if _, err := LoadACL(writeACL(t, ACLRule{Principal: "*", Path: path, Allow: []string{"*"}})); !errors.Is(err, ErrPathEscapesRoot) {
+      t.Errorf("a rule on %q: expected ErrPathEscapesRoot, got %v", path, err)
+    }
+  }
+}
+
+func explain(t *testing.T, pfs *ParentFileServer, query url.Values) AccessExplanation {
+  recorder := httptest.NewRecorder()
+  pfs.ExplainHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/explain?" + query.Encode(), nil))
+  if recorder.Code != 200 {
+    t.Fatalf("explain %v: %d %s", query, recorder.Code, recorder.Body)
+  }
+  var explanation AccessExplanation
+  if err := json.Unmarshal(recorder.Body.Bytes(), &explanation); err != nil {
+    t.Fatal(err)
+  }
+  return explanation
+}
+
+/*
+ * The explanation agrees with Handle() about requests the WriteMode refuses.
+ */
+func TestExplainHandlerIncludesWriteMode(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  pfs, err := MakeParentFileServer(rootDir, "/files/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  pfs.SetWriteMode(AppendOnly)
+
+  tests := []struct {
+    query url.Values
+    allowed bool
+  }{
+    {url.Values{"method": {"GET"}, "path": {"/files/a"}}, true},
+    {url.Values{"method": {"PUT"}, "path": {"/files/a"}}, true},
+    {url.Values{"method": {"PATCH"}, "path": {"/files/a"}, "command": {"mkdir"}}, true},
+    {url.Values{"method": {"DELETE"}, "path": {"/files/a"}}, false},
+    {url.Values{"method": {"PATCH"}, "path": {"/files/a"}, "command": {"mv"}, "otherPath": {"/files/b"}}, false},
+  }
+  for _, test := range tests {
+    explanation := explain(t, pfs, test.query)
+    if explanation.Allowed != test.allowed || explanation.WriteMode != "append-only" {
+      t.Errorf("explain %v: %+v, want allowed=%v", test.query, explanation, test.allowed)
+    }
+    if !test.allowed && len(explanation.Reason) == 0 {
+      t.Errorf("explain %v: no reason given", test.query)
+    }
+  }
+}
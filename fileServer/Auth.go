@@ -0,0 +1,465 @@
+package fileServer
+
+import (
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+/*
+ * By default, Handle() serves anyone who can reach it. To restrict that, give
+ * the ParentFileServer an Authenticator (who is making the request?) and,
+ * optionally, an Authorizer (what may they do?):
+ *
+ *   pfs.SetAuthenticator(fileServer.MakeCookieAuthenticator("password", secret, "admin"))
+ *   authorizer := fileServer.MakePathAuthorizer()
+ *   authorizer.Grant("admin", "", fileServer.RightAdmin)
+ *   pfs.SetAuthorizer(authorizer)
+ *
+ * Requests that fail to authenticate get a 401; requests for paths the
+ * principal lacks the right to get a 403. Both are checked before any lock is
+ * taken, so unauthorized requests can't hold up anyone else.
+ *
+ * Handle() requires:
+ * - RightRead for GET, HEAD and the -d, ls, md5 and sha256 commands.
+ * - RightWrite for PUT, POST, DELETE and mkdir, and for both paths of mv.
+ * - RightRead on the path and RightWrite on the other path for cp, zip and unzip.
+ * - RightAdmin to DELETE the root.
+ */
+
+// Returned (wrapped) by Authenticators when a request has no valid credentials.
+var ErrUnauthenticated = errors.New("Auth.go: Not authenticated.")
+
+type Principal struct {
+  Name string
+}
+
+type Authenticator interface {
+  /*
+   * Returns who made the request, or an error wrapping ErrUnauthenticated.
+   */
+  Authenticate(request *http.Request) (*Principal, error)
+  /*
+   * Returns the WWW-Authenticate header to send with a 401, or "" for none.
+   */
+  Challenge() string
+}
+
+/*
+ * Each right includes the ones before it.
+ */
+type Right int
+
+const (
+  RightNone Right = iota
+  RightRead
+  RightWrite
+  RightAdmin
+)
+
+func (right Right) String() string {
+  switch right {
+  case RightNone:
+    return "none"
+  case RightRead:
+    return "read"
+  case RightWrite:
+    return "write"
+  case RightAdmin:
+    return "admin"
+  }
+  return fmt.Sprintf("Right(%d)", int(right))
+}
+
+func (right Right) MarshalText() ([]byte, error) {
+  return []byte(right.String()), nil
+}
+
+func (right *Right) UnmarshalText(text []byte) error {
+  for candidate := RightNone; candidate <= RightAdmin; candidate++ {
+    if candidate.String() == string(text) {
+      *right = candidate
+      return nil
+    }
+  }
+  return fmt.Errorf("Auth.go: Unknown right %q.", string(text))
+}
+
+type Authorizer interface {
+  /*
+   * Returns the principal's rights to the path, which is relative to `rootDir`
+   * and clean ("" is the root). `principal` is nil if there is no Authenticator.
+   */
+  Authorize(principal *Principal, path string) Right
+}
+
+
+
+
+
+/********** CookieAuthenticator **********/
+
+/*
+ * Accepts requests with a cookie that holds a shared secret, like the one
+ * FileUtil.py sends, and treats them all as the same principal.
+ */
+type CookieAuthenticator struct {
+  cookieName string
+  secret []byte
+  principal *Principal
+}
+
+func MakeCookieAuthenticator(cookieName string, secret string, principalName string) *CookieAuthenticator {
+  return &CookieAuthenticator{
+    cookieName: cookieName,
+    secret: []byte(secret),
+    principal: &Principal{Name: principalName},
+  }
+}
+
+func (auth *CookieAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+  cookie, err := request.Cookie(auth.cookieName)
+  if err != nil {
+    return nil, fmt.Errorf("%w: no %q cookie", ErrUnauthenticated, auth.cookieName)
+  }
+  if subtle.ConstantTimeCompare([]byte(cookie.Value), auth.secret) != 1 {
+    return nil, fmt.Errorf("%w: wrong %q cookie", ErrUnauthenticated, auth.cookieName)
+  }
+  return auth.principal, nil
+}
+
+func (auth *CookieAuthenticator) Challenge() string {
+  return ""
+}
+
+
+
+
+
+/********** BasicAuthenticator **********/
+
+/*
+ * Accepts HTTP Basic credentials. Passwords are stored as salted PBKDF2-SHA256
+ * hashes (see HashPassword()), never in the clear.
+ */
+type BasicAuthenticator struct {
+  realm string
+  mu sync.RWMutex
+  hashes map[string]string // user name -> password hash
+}
+
+// The PBKDF2 iterations used by HashPassword().
+const passwordHashIterations = 100000
+
+func MakeBasicAuthenticator(realm string) *BasicAuthenticator {
+  return &BasicAuthenticator{realm: realm, hashes: make(map[string]string)}
+}
+
+/*
+ * Adds (or replaces) a user with the given password.
+ */
+func (auth *BasicAuthenticator) AddUser(name string, password string) error {
+  passwordHash, err := HashPassword(password)
+  if err != nil {
+    return err
+  }
+  return auth.AddUserHash(name, passwordHash)
+}
+
+/*
+ * Like AddUser(), but takes a hash from HashPassword(), so that passwords
+ * needn't appear in config files.
+ */
+func (auth *BasicAuthenticator) AddUserHash(name string, passwordHash string) error {
+  if _, _, _, err := parsePasswordHash(passwordHash); err != nil {
+    return err
+  }
+  auth.mu.Lock()
+  defer auth.mu.Unlock()
+  auth.hashes[name] = passwordHash
+  return nil
+}
+
+func (auth *BasicAuthenticator) RemoveUser(name string) {
+  auth.mu.Lock()
+  defer auth.mu.Unlock()
+  delete(auth.hashes, name)
+}
+
+func (auth *BasicAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+  name, password, ok := request.BasicAuth()
+  if !ok {
+    return nil, fmt.Errorf("%w: no Basic credentials", ErrUnauthenticated)
+  }
+  auth.mu.RLock()
+  passwordHash, ok := auth.hashes[name]
+  auth.mu.RUnlock()
+  if !ok || !CheckPassword(password, passwordHash) {
+    return nil, fmt.Errorf("%w: wrong user name or password", ErrUnauthenticated)
+  }
+  return &Principal{Name: name}, nil
+}
+
+func (auth *BasicAuthenticator) Challenge() string {
+  return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", auth.realm)
+}
+
+
+
+
+
+/********** BearerAuthenticator **********/
+
+/*
+ * Accepts "Authorization: Bearer <token>" headers. Only hashes of the tokens
+ * are kept.
+ */
+type BearerAuthenticator struct {
+  mu sync.RWMutex
+  principals map[[sha256.Size]byte]*Principal // token hash -> principal
+}
+
+func MakeBearerAuthenticator() *BearerAuthenticator {
+  return &BearerAuthenticator{principals: make(map[[sha256.Size]byte]*Principal)}
+}
+
+func (auth *BearerAuthenticator) AddToken(token string, principalName string) {
+  auth.mu.Lock()
+  defer auth.mu.Unlock()
+  auth.principals[sha256.Sum256([]byte(token))] = &Principal{Name: principalName}
+}
+
+func (auth *BearerAuthenticator) RemoveToken(token string) {
+  auth.mu.Lock()
+  defer auth.mu.Unlock()
+  delete(auth.principals, sha256.Sum256([]byte(token)))
+}
+
+func (auth *BearerAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+  header := request.Header.Get("Authorization")
+  if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+    return nil, fmt.Errorf("%w: no bearer token", ErrUnauthenticated)
+  }
+  auth.mu.RLock()
+  principal, ok := auth.principals[sha256.Sum256([]byte(strings.TrimSpace(header[7:])))]
+  auth.mu.RUnlock()
+  if !ok {
+    return nil, fmt.Errorf("%w: unknown bearer token", ErrUnauthenticated)
+  }
+  return principal, nil
+}
+
+func (auth *BearerAuthenticator) Challenge() string {
+  return "Bearer"
+}
+
+
+
+
+
+/********** AnyAuthenticator **********/
+
+/*
+ * Tries each Authenticator in turn and accepts the first principal found, e.g.
+ * to accept both FileUtil.py's cookie and Basic credentials.
+ */
+type AnyAuthenticator struct {
+  authenticators []Authenticator
+}
+
+func MakeAnyAuthenticator(authenticators ...Authenticator) *AnyAuthenticator {
+  return &AnyAuthenticator{authenticators: authenticators}
+}
+
+func (auth *AnyAuthenticator) Authenticate(request *http.Request) (*Principal, error) {
+  for _, authenticator := range auth.authenticators {
+    if principal, err := authenticator.Authenticate(request); err == nil {
+      return principal, nil
+    }
+  }
+  return nil, fmt.Errorf("%w: no accepted credentials", ErrUnauthenticated)
+}
+
+func (auth *AnyAuthenticator) Challenge() string {
+  for _, authenticator := range auth.authenticators {
+    if challenge := authenticator.Challenge(); len(challenge) > 0 {
+      return challenge
+    }
+  }
+  return ""
+}
+
+
+
+
+
+/********** PathAuthorizer **********/
+
+/*
+ * Grants rights to principals on paths (and everything under them). A
+ * principal's right to a path is that of their grant on its nearest ancestor
+ * (or the path itself), or that of the nearest grant to "*" if it is greater,
+ * so grants to "*" are a floor for everyone. Anonymous requests (with no
+ * Authenticator) only get grants to "*".
+ */
+type PathAuthorizer struct {
+  mu sync.RWMutex
+  grants map[string]map[string]Right // principal name -> path -> right
+}
+
+func MakePathAuthorizer() *PathAuthorizer {
+  return &PathAuthorizer{grants: make(map[string]map[string]Right)}
+}
+
+/*
+ * Gives the principal `right` to `path` and everything under it, replacing any
+ * earlier grant to the same principal and path. RightNone can be used to take
+ * away rights below a path with more. `path` is cleaned like a request's path,
+ * so "a//b/" and "a/./b" are both "a/b"; paths with ".." or a NUL byte return
+ * an error wrapping ErrPathEscapesRoot and grant nothing.
+ */
+func (authorizer *PathAuthorizer) Grant(principalName string, path string, right Right) error {
+  cleanPath, err := cleanRelativePath(path)
+  if err != nil {
+    return err
+  }
+  authorizer.mu.Lock()
+  defer authorizer.mu.Unlock()
+  paths, ok := authorizer.grants[principalName]
+  if !ok {
+    paths = make(map[string]Right)
+    authorizer.grants[principalName] = paths
+  }
+  paths[cleanPath] = right
+  return nil
+}
+
+func (authorizer *PathAuthorizer) Revoke(principalName string, path string) {
+  cleanPath, err := cleanRelativePath(path)
+  if err != nil {
+    // Nothing can have been granted to it.
+    return
+  }
+  authorizer.mu.Lock()
+  defer authorizer.mu.Unlock()
+  delete(authorizer.grants[principalName], cleanPath)
+}
+
+func (authorizer *PathAuthorizer) Authorize(principal *Principal, path string) Right {
+  authorizer.mu.RLock()
+  defer authorizer.mu.RUnlock()
+  right := nearestGrant(authorizer.grants["*"], path)
+  if principal != nil {
+    if ownRight := nearestGrant(authorizer.grants[principal.Name], path); ownRight > right {
+      right = ownRight
+    }
+  }
+  return right
+}
+
+/********** Classless Functions **********/
+
+/*
+ * Returns a salted PBKDF2-SHA256 hash of the password, formatted as
+ * "pbkdf2-sha256$<iterations>$<salt>$<hash>".
+ */
+func HashPassword(password string) (string, error) {
+  salt := make([]byte, 16)
+  if _, err := rand.Read(salt); err != nil {
+    return "", err
+  }
+  key := pbkdf2SHA256([]byte(password), salt, passwordHashIterations, sha256.Size)
+  encoding := base64.RawStdEncoding
+  return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordHashIterations, encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+/*
+ * Returns true iff the password matches a hash from HashPassword().
+ */
+func CheckPassword(password string, passwordHash string) bool {
+  iterations, salt, key, err := parsePasswordHash(passwordHash)
+  if err != nil {
+    return false
+  }
+  return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations, len(key)), key) == 1
+}
+
+func parsePasswordHash(passwordHash string) (int, []byte, []byte, error) {
+  parts := strings.Split(passwordHash, "$")
+  if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+    return 0, nil, nil, fmt.Errorf("Auth.go: Unrecognized password hash.")
+  }
+  iterations, err := strconv.Atoi(parts[1])
+  if err != nil || iterations < 1 {
+    return 0, nil, nil, fmt.Errorf("Auth.go: Bad iteration count in password hash.")
+  }
+  salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+  if err != nil {
+    return 0, nil, nil, fmt.Errorf("Auth.go: Bad salt in password hash.")
+  }
+  key, err := base64.RawStdEncoding.DecodeString(parts[3])
+  if err != nil || len(key) == 0 {
+    return 0, nil, nil, fmt.Errorf("Auth.go: Bad key in password hash.")
+  }
+  return iterations, salt, key, nil
+}
+
+/*
+ * PBKDF2 (RFC 8018) with HMAC-SHA256, since the standard library doesn't have it.
+ */
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+  prf := hmac.New(sha256.New, password)
+  key := make([]byte, 0, keyLength + sha256.Size)
+  var blockIndex [4]byte
+  for block := uint32(1); len(key) < keyLength; block++ {
+    binary.BigEndian.PutUint32(blockIndex[:], block)
+    prf.Reset()
+    prf.Write(salt)
+    prf.Write(blockIndex[:])
+    u := prf.Sum(nil)
+    t := append([]byte(nil), u...)
+    for i := 1; i < iterations; i++ {
+      prf.Reset()
+      prf.Write(u)
+      u = prf.Sum(u[:0])
+      for j := range t {
+        t[j] ^= u[j]
+      }
+    }
+    key = append(key, t...)
+  }
+  return key[:keyLength]
+}
+
+/*
+ * Returns the right granted on the nearest ancestor of `path` (or `path`
+ * itself), or RightNone if there is none or `path` can't be cleaned.
+ */
+func nearestGrant(paths map[string]Right, path string) Right {
+  path, err := cleanRelativePath(path)
+  if err != nil {
+    return RightNone
+  }
+  for {
+    if right, ok := paths[path]; ok {
+      return right
+    }
+    if len(path) == 0 {
+      return RightNone
+    }
+    if i := strings.LastIndex(path, "/"); i >= 0 {
+      path = path[:i]
+    } else {
+      path = ""
+    }
+  }
+}
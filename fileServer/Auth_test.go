@@ -0,0 +1,258 @@
+package fileServer
+
+import (
+  "context"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+)
+
+/*
+ * Known answers for PBKDF2-HMAC-SHA256, from RFC 7914 and the RFC 6070 inputs.
+ */
+func TestPBKDF2SHA256(t *testing.T) {
+  tests := []struct {
+    password string
+    salt string
+    iterations int
+    key string
+  }{
+    {"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+    {"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+    {"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+    {"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+    {"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+    {"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+  }
+  for _, test := range tests {
+    key := pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations, len(test.key) / 2)
+    if got := hex.EncodeToString(key); got != test.key {
+      t.Errorf("PBKDF2(%q, %q, %d) = %s, want %s", test.password, test.salt, test.iterations, got, test.key)
+    }
+  }
+}
+
+func TestHashPassword(t *testing.T) {
+  passwordHash, err := HashPassword("correct horse")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !strings.HasPrefix(passwordHash, fmt.Sprintf("pbkdf2-sha256$%d$", passwordHashIterations)) {
+    t.Errorf("unexpected hash format %q", passwordHash)
+  }
+  if !CheckPassword("correct horse", passwordHash) {
+    t.Error("the password doesn't match its own hash")
+  }
+  if CheckPassword("correct horse!", passwordHash) {
+    t.Error("a wrong password matches")
+  }
+  if other, _ := HashPassword("correct horse"); other == passwordHash {
+    t.Error("two hashes of the same password share a salt")
+  }
+  for _, bad := range []string{"", "correct horse", "md5$1$c2FsdA$a2V5", "pbkdf2-sha256$0$c2FsdA$a2V5", "pbkdf2-sha256$1$!!$a2V5", "pbkdf2-sha256$1$c2FsdA$"} {
+    if CheckPassword("correct horse", bad) {
+      t.Errorf("CheckPassword accepted the malformed hash %q", bad)
+    }
+  }
+}
+
+/*
+ * Returns a password hash with a single iteration, so tests stay fast.
+ */
+func cheapPasswordHash(password string) string {
+  salt := []byte("0123456789abcdef")
+  key := pbkdf2SHA256([]byte(password), salt, 1, 32)
+  encoding := base64.RawStdEncoding
+  return fmt.Sprintf("pbkdf2-sha256$1$%s$%s", encoding.EncodeToString(salt), encoding.EncodeToString(key))
+}
+
+func TestAuthenticators(t *testing.T) {
+  cookie := MakeCookieAuthenticator("password", "s3cret", "admin")
+  basic := MakeBasicAuthenticator("files")
+  if err := basic.AddUserHash("alice", cheapPasswordHash("correct horse")); err != nil {
+    t.Fatal(err)
+  }
+  if err := basic.AddUserHash("bob", "not a hash"); err == nil {
+    t.Error("AddUserHash accepted a malformed hash")
+  }
+  bearer := MakeBearerAuthenticator()
+  bearer.AddToken("t0ken", "deploy")
+  bearer.AddToken("revoked", "mallory")
+  bearer.RemoveToken("revoked")
+  anyAuth := MakeAnyAuthenticator(cookie, basic, bearer)
+
+  withCookie := func(value string) func(*http.Request) {
+    return func(request *http.Request) { request.AddCookie(&http.Cookie{Name: "password", Value: value}) }
+  }
+  withBasic := func(name string, password string) func(*http.Request) {
+    return func(request *http.Request) { request.SetBasicAuth(name, password) }
+  }
+  withHeader := func(value string) func(*http.Request) {
+    return func(request *http.Request) { request.Header.Set("Authorization", value) }
+  }
+  tests := []struct {
+    name string
+    authenticator Authenticator
+    credentials func(*http.Request)
+    principal string // "" if the request should be refused
+  }{
+    {"cookie", cookie, withCookie("s3cret"), "admin"},
+    {"wrong cookie", cookie, withCookie("s3cret!"), ""},
+    {"no cookie", cookie, func(*http.Request) {}, ""},
+    {"basic", basic, withBasic("alice", "correct horse"), "alice"},
+    {"wrong password", basic, withBasic("alice", "battery staple"), ""},
+    {"unknown user", basic, withBasic("bob", "correct horse"), ""},
+    {"no basic", basic, func(*http.Request) {}, ""},
+    {"bearer", bearer, withHeader("Bearer t0ken"), "deploy"},
+    {"bearer lowercase", bearer, withHeader("bearer t0ken"), "deploy"},
+    {"unknown token", bearer, withHeader("Bearer t0ken2"), ""},
+    {"removed token", bearer, withHeader("Bearer revoked"), ""},
+    {"basic as bearer", bearer, withBasic("alice", "correct horse"), ""},
+    {"any cookie", anyAuth, withCookie("s3cret"), "admin"},
+    {"any basic", anyAuth, withBasic("alice", "correct horse"), "alice"},
+    {"any bearer", anyAuth, withHeader("Bearer t0ken"), "deploy"},
+    {"any nothing", anyAuth, func(*http.Request) {}, ""},
+  }
+  for _, test := range tests {
+    request := httptest.NewRequest(http.MethodGet, "/files/", nil)
+    test.credentials(request)
+    principal, err := test.authenticator.Authenticate(request)
+    if len(test.principal) == 0 {
+      if principal != nil || !errors.Is(err, ErrUnauthenticated) {
+        t.Errorf("%s: expected ErrUnauthenticated, got %+v, %v", test.name, principal, err)
+      }
+      continue
+    }
+    if err != nil || principal == nil || principal.Name != test.principal {
+      t.Errorf("%s: got %+v, %v, want %s", test.name, principal, err, test.principal)
+    }
+  }
+
+  basic.RemoveUser("alice")
+  request := httptest.NewRequest(http.MethodGet, "/files/", nil)
+  request.SetBasicAuth("alice", "correct horse")
+  if _, err := basic.Authenticate(request); !errors.Is(err, ErrUnauthenticated) {
+    t.Errorf("a removed user was accepted: %v", err)
+  }
+
+  challenges := map[Authenticator]string{cookie: "", basic: `Basic realm="files", charset="UTF-8"`, bearer: "Bearer", anyAuth: `Basic realm="files", charset="UTF-8"`}
+  for authenticator, want := range challenges {
+    if got := authenticator.Challenge(); got != want {
+      t.Errorf("%T.Challenge() = %q, want %q", authenticator, got, want)
+    }
+  }
+}
+
+func TestPathAuthorizer(t *testing.T) {
+  authorizer := MakePathAuthorizer()
+  authorizer.Grant("admin", "", RightAdmin)
+  authorizer.Grant("alice", "alice", RightWrite)
+  authorizer.Grant("alice", "alice/archive", RightNone)
+  authorizer.Grant("*", "public", RightRead)
+  authorizer.Grant("*", "public/drop", RightWrite)
+
+  alice := &Principal{Name: "alice"}
+  tests := []struct {
+    principal *Principal
+    path string
+    right Right
+  }{
+    {&Principal{Name: "admin"}, "", RightAdmin},
+    {&Principal{Name: "admin"}, "alice/x", RightAdmin},
+    {alice, "alice", RightWrite},
+    {alice, "alice/x/y", RightWrite},
+    {alice, "alice/archive/x", RightNone}, // the nearest grant wins
+    {alice, "alicex", RightNone}, // a shared prefix isn't an ancestor
+    {alice, "", RightNone},
+    {alice, "public/x", RightRead}, // "*" is a floor
+    {alice, "public/drop/x", RightWrite},
+    {nil, "public/x", RightRead},
+    {nil, "alice/x", RightNone},
+    {&Principal{Name: "mallory"}, "public", RightRead},
+  }
+  for _, test := range tests {
+    if got := authorizer.Authorize(test.principal, test.path); got != test.right {
+      t.Errorf("Authorize(%+v, %q) = %v, want %v", test.principal, test.path, got, test.right)
+    }
+  }
+}
+
+/*
+ * Handle() answers missing credentials with a 401 and a challenge, and paths
+ * the principal has no right to with a 403, before touching anything.
+ */
+func TestHandleAuthenticatesAndAuthorizes(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  for _, dir := range []string{"alice", "public"} {
+    if err := os.Mkdir(rootDir + dir, 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := os.WriteFile(rootDir + "public/a.txt", []byte("public"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  pfs, err := MakeParentFileServer(rootDir, "/files/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  basic := MakeBasicAuthenticator("files")
+  basic.AddUserHash("alice", cheapPasswordHash("correct horse"))
+  basic.AddUserHash("admin", cheapPasswordHash("hunter2"))
+  pfs.SetAuthenticator(basic)
+  authorizer := MakePathAuthorizer()
+  authorizer.Grant("admin", "", RightAdmin)
+  authorizer.Grant("alice", "alice", RightWrite)
+  authorizer.Grant("alice", "public", RightRead)
+  pfs.SetAuthorizer(authorizer)
+
+  tests := []struct {
+    name string
+    user string
+    password string
+    method string
+    target string
+    body string
+    code int
+  }{
+    {"no credentials", "", "", http.MethodGet, "/files/public/a.txt", "", 401},
+    {"wrong password", "alice", "battery staple", http.MethodGet, "/files/public/a.txt", "", 401},
+    {"read", "alice", "correct horse", http.MethodGet, "/files/public/a.txt", "", 200},
+    {"write without the right", "alice", "correct horse", http.MethodPut, "/files/public/b.txt", "data", 403},
+    {"read without the right", "alice", "correct horse", http.MethodGet, "/files/", "", 403},
+    {"write", "alice", "correct horse", http.MethodPut, "/files/alice/b.txt", "data", 200},
+    {"cp from a readable path", "alice", "correct horse", http.MethodPatch, "/files/public/a.txt", `{"command": "cp", "otherPath": "/files/alice/a.txt"}`, 200},
+    {"mv out of a readable path", "alice", "correct horse", http.MethodPatch, "/files/public/a.txt", `{"command": "mv", "otherPath": "/files/alice/moved.txt"}`, 403},
+    {"delete the root without admin", "alice", "correct horse", http.MethodDelete, "/files/", "", 403},
+    {"delete as admin", "admin", "hunter2", http.MethodDelete, "/files/alice/b.txt", "", 200},
+  }
+  for _, test := range tests {
+    request := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+    if len(test.user) > 0 {
+      request.SetBasicAuth(test.user, test.password)
+    }
+    recorder := httptest.NewRecorder()
+    pfs.NewRoutine().Handle(recorder, request)
+    if recorder.Code != test.code {
+      t.Errorf("%s: got %d %s, want %d", test.name, recorder.Code, recorder.Body, test.code)
+    }
+    if challenge := recorder.Header().Get("WWW-Authenticate"); (recorder.Code == 401) != (challenge == basic.Challenge()) {
+      t.Errorf("%s: %d with WWW-Authenticate %q", test.name, recorder.Code, challenge)
+    }
+  }
+  if _, err := os.Stat(rootDir + "public/b.txt"); !os.IsNotExist(err) {
+    t.Errorf("a refused PUT wrote public/b.txt: %v", err)
+  }
+  if _, err := os.Stat(rootDir + "public/a.txt"); err != nil {
+    t.Errorf("a refused mv moved public/a.txt: %v", err)
+  }
+  if snapshot := pfs.scheduler.Snapshot(); len(snapshot.Held) != 0 {
+    t.Errorf("locks left behind: %+v", snapshot.Held)
+  }
+}
@@ -0,0 +1,101 @@
+package fileServer
+
+import (
+  "container/heap"
+  "sync"
+  "time"
+)
+
+/*
+ * Types that Scheduler and FileTrie used before they were rebuilt on
+ * lockManager. Nothing in this package uses them anymore; they are kept so
+ * that code referring to them still compiles.
+ */
+
+// Deprecated: Scheduler now queues lockManager.Task values internally.
+type Task struct {
+  Paths []string
+  ContinueChannel chan bool
+  EnqueueTime int64
+  IsComplete bool
+  Priority int64
+  RoutineId string
+}
+
+// Deprecated: Scheduler now queues lockManager.Task values internally.
+func MakeTask(routineId string, paths []string, priority int64, isComplete bool) *Task {
+  return &Task{
+    Paths: paths,
+    ContinueChannel: make(chan bool),
+    EnqueueTime: time.Now().UnixNano(),
+    IsComplete: isComplete,
+    Priority: priority,
+    RoutineId: routineId,
+  }
+}
+
+// Deprecated: Use lockManager.TaskPriorityQueue.
+type TaskPriorityQueue struct {
+  tasks []*Task
+  mu *sync.Mutex // a pointer so that the value receivers share it
+}
+
+func (pq TaskPriorityQueue) Length() int {
+  if pq.mu == nil {
+    // Nothing has been pushed yet.
+    return len(pq.tasks)
+  }
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  return pq.Len()
+}
+
+func (pq *TaskPriorityQueue) Push(x interface{}) {
+  if pq.mu == nil {
+    pq.mu = &sync.Mutex{}
+  }
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  n := len(pq.tasks)
+  task := x.(*Task)
+  pq.tasks = append(pq.tasks, task)
+  heap.Fix(pq, n)
+}
+
+func (pq *TaskPriorityQueue) Peek() interface{} {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  return pq.tasks[len(pq.tasks)-1]
+}
+
+func (pq *TaskPriorityQueue) Pop() interface{} {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  old := pq.tasks
+  n := len(old)
+  task := old[n-1]
+  old[n-1] = nil  // avoid memory leak
+  pq.tasks = old[0 : n-1]
+  return task
+}
+
+func (pq TaskPriorityQueue) Len() int {
+  return len(pq.tasks)
+}
+
+func (pq TaskPriorityQueue) Less(i, j int) bool {
+  return pq.tasks[i].Priority > pq.tasks[j].Priority
+}
+
+func (pq TaskPriorityQueue) Swap(i, j int) {
+  pq.tasks[i], pq.tasks[j] = pq.tasks[j], pq.tasks[i]
+}
+
+// Deprecated: FileTrie is now backed by a lockManager.Trie, which has its own nodes.
+type PathNode struct {
+  name string
+  parent *PathNode
+  children map[string]*PathNode
+  count int
+  value string
+}
@@ -1,19 +1,24 @@
 package fileServer
 
 import (
+  "context"
   "crypto/md5"
   "crypto/sha256"
   "encoding/json"
+  "errors"
   "fmt"
   "hash"
+  "io"
   "io/ioutil"
   "log"
   "net/http"
   "os"
   "strings"
+  "time"
 
   "github.com/google/uuid"
   "github.com/Thomas-Redding/go_util/disk"
+  "github.com/Thomas-Redding/go_util/metrics"
   "github.com/Thomas-Redding/go_util/network"
 )
 
@@ -28,121 +33,228 @@ type ChildFileServer struct {
   routineId string
 }
 
+/*
+ * Paths are relative to `rootDir` and are checked and locked like the paths
+ * Handle() gets (see resolvePath()), so locking "link/x" excludes requests for
+ * "a/x" if "link" points to "a". Don't retarget symlinks in locked paths
+ * before unlocking them, or Unlock() will release the wrong paths.
+ */
 func (cfs *ChildFileServer) Lock(paths []string) error {
   if cfs.parent.loggingEnabled > 0 {
     log.Println("FileServer.go", "Lock", paths)
   }
-  paths2 := make([]string, len(paths))
-  for i, path := range paths {
-    if strings.HasPrefix(path, "/") {
-      paths2[i] = path[1:]
-    } else {
-      paths2[i] = path
-    }
+  lockPaths, _, err := cfs.resolvePaths(paths...)
+  if err != nil {
+    return err
   }
-  return cfs.parent.scheduler.WaitUntilAllAvailableUrgent(cfs.routineId, paths2)
+  return cfs.parent.scheduler.WaitUntilAllAvailableUrgent(cfs.routineId, lockPaths)
 }
 
 func (cfs *ChildFileServer) Unlock(paths []string) {
   if cfs.parent.loggingEnabled > 0 {
     log.Println("FileServer.go", "Unlock", paths)
   }
-  paths2 := make([]string, len(paths))
-  for i, path := range paths {
-    if strings.HasPrefix(path, "/") {
-      paths2[i] = path[1:]
-    } else {
-      paths2[i] = path
-    }
+  lockPaths, _, err := cfs.resolvePaths(paths...)
+  if err != nil {
+    // Lock() would have refused the paths too.
+    return
+  }
+  cfs.parent.scheduler.DoneAll(cfs.routineId, lockPaths)
+}
+
+/*
+ * Like Lock(), but other routines may read the entities at the same time.
+ * Every call must be matched by a call to RUnlock().
+ */
+func (cfs *ChildFileServer) RLock(paths []string) error {
+  if cfs.parent.loggingEnabled > 0 {
+    log.Println("FileServer.go", "RLock", paths)
+  }
+  lockPaths, _, err := cfs.resolvePaths(paths...)
+  if err != nil {
+    return err
+  }
+  return cfs.parent.scheduler.WaitUntilAllAvailableSharedUrgent(cfs.routineId, lockPaths)
+}
+
+func (cfs *ChildFileServer) RUnlock(paths []string) {
+  if cfs.parent.loggingEnabled > 0 {
+    log.Println("FileServer.go", "RUnlock", paths)
+  }
+  lockPaths, _, err := cfs.resolvePaths(paths...)
+  if err != nil {
+    return
   }
-  cfs.parent.scheduler.DoneAll(cfs.routineId, paths2)
+  cfs.parent.scheduler.DoneAllShared(cfs.routineId, lockPaths)
+}
+
+/*
+ * Atomically turns one of this routine's RLock()s on each of the entities into
+ * a Lock(), waiting until no other routine reads them. Fails with an error
+ * wrapping ErrUpgradeConflict if another routine is already upgrading one of
+ * them; RUnlock() so that it can proceed. On success, match it with Unlock()
+ * rather than RUnlock().
+ */
+func (cfs *ChildFileServer) Upgrade(paths []string) error {
+  if cfs.parent.loggingEnabled > 0 {
+    log.Println("FileServer.go", "Upgrade", paths)
+  }
+  lockPaths, _, err := cfs.resolvePaths(paths...)
+  if err != nil {
+    return err
+  }
+  return cfs.parent.scheduler.Upgrade(context.Background(), cfs.routineId, lockPaths)
+}
+
+/*
+ * Atomically turns one of this routine's Lock()s on each of the entities into
+ * an RLock(), so other routines may read them. Match it with RUnlock().
+ */
+func (cfs *ChildFileServer) Downgrade(paths []string) error {
+  if cfs.parent.loggingEnabled > 0 {
+    log.Println("FileServer.go", "Downgrade", paths)
+  }
+  lockPaths, _, err := cfs.resolvePaths(paths...)
+  if err != nil {
+    return err
+  }
+  return cfs.parent.scheduler.Downgrade(cfs.routineId, lockPaths)
 }
 
 /*
  * The below methods simply wrap the `disk` methods with Lock() and Unlock()
+ * (and record the ones that modify files in the journal, if there is one).
+ * Paths are relative to `rootDir`, and are locked and journaled the way
+ * Handle() locks and journals them.
  */
 
 func (cfs *ChildFileServer) Copy(fromPath string, toPath string) error {
-  fromPath = cfs.parent.rootDir + fromPath
-  toPath = cfs.parent.rootDir + toPath
-  cfs.Lock([]string{fromPath, toPath})
-  defer cfs.Unlock([]string{fromPath, toPath})
-  return disk.Copy(fromPath, toPath)
+  lockPaths, filePaths, unlock, err := cfs.lockResolved([]string{fromPath, toPath}, false)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  end, err := cfs.beginOperation("Copy", lockPaths, lockPaths[1:])
+  if err != nil {
+    return err
+  }
+  defer end()
+  return disk.Copy(filePaths[0], filePaths[1])
 }
 
 func (cfs *ChildFileServer) CopyFile(fromPath string, toPath string) error {
-  fromPath = cfs.parent.rootDir + fromPath
-  toPath = cfs.parent.rootDir + toPath
-  cfs.Lock([]string{fromPath, toPath})
-  defer cfs.Unlock([]string{fromPath, toPath})
-  return disk.CopyFile(fromPath, toPath)
+  lockPaths, filePaths, unlock, err := cfs.lockResolved([]string{fromPath, toPath}, false)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  end, err := cfs.beginOperation("CopyFile", lockPaths, lockPaths[1:])
+  if err != nil {
+    return err
+  }
+  defer end()
+  return disk.CopyFile(filePaths[0], filePaths[1])
 }
 
 func (cfs *ChildFileServer) CopyDir(fromPath string, toPath string) error {
-  fromPath = cfs.parent.rootDir + fromPath
-  toPath = cfs.parent.rootDir + toPath
-  cfs.Lock([]string{fromPath, toPath})
-  defer cfs.Unlock([]string{fromPath, toPath})
-  return disk.CopyDir(fromPath, toPath)
+  lockPaths, filePaths, unlock, err := cfs.lockResolved([]string{fromPath, toPath}, false)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  end, err := cfs.beginOperation("CopyDir", lockPaths, lockPaths[1:])
+  if err != nil {
+    return err
+  }
+  defer end()
+  return disk.CopyDir(filePaths[0], filePaths[1])
 }
 
 func (cfs *ChildFileServer) Exists(path string) (bool, error) {
-  path = cfs.parent.rootDir + path
-  cfs.Lock([]string{path})
-  defer cfs.Unlock([]string{path})
-  return disk.Exists(path)
+  _, filePaths, unlock, err := cfs.lockResolved([]string{path}, true)
+  if err != nil {
+    return false, err
+  }
+  defer unlock()
+  return disk.Exists(filePaths[0])
 }
 
 func (cfs *ChildFileServer) FileContentType(filePath string) (string, error) {
-  filePath = cfs.parent.rootDir + filePath
-  cfs.Lock([]string{filePath})
-  defer cfs.Unlock([]string{filePath})
-  return disk.FileContentType(filePath)
+  _, filePaths, unlock, err := cfs.lockResolved([]string{filePath}, true)
+  if err != nil {
+    return "", err
+  }
+  defer unlock()
+  return disk.FileContentType(filePaths[0])
 }
 
 func (cfs *ChildFileServer) FileHash(filePath string, hasher hash.Hash) (string, error) {
-  filePath = cfs.parent.rootDir + filePath
-  cfs.Lock([]string{filePath})
-  defer cfs.Unlock([]string{filePath})
-  return disk.FileHash(filePath, hasher)
+  _, filePaths, unlock, err := cfs.lockResolved([]string{filePath}, true)
+  if err != nil {
+    return "", err
+  }
+  defer unlock()
+  return disk.FileHash(filePaths[0], hasher)
 }
 
 func (cfs *ChildFileServer) IsDirFile(path string) (bool, bool, error) {
-  path = cfs.parent.rootDir + path
-  cfs.Lock([]string{path})
-  defer cfs.Unlock([]string{path})
-  return disk.IsDirFile(path)
+  _, filePaths, unlock, err := cfs.lockResolved([]string{path}, true)
+  if err != nil {
+    return false, false, err
+  }
+  defer unlock()
+  return disk.IsDirFile(filePaths[0])
 }
 
 func (cfs *ChildFileServer) Ls(dirPath string) ([]string, error) {
-  dirPath = cfs.parent.rootDir + dirPath
-  cfs.Lock([]string{dirPath})
-  defer cfs.Unlock([]string{dirPath})
-  return disk.Ls(dirPath)
+  _, filePaths, unlock, err := cfs.lockResolved([]string{dirPath}, true)
+  if err != nil {
+    return nil, err
+  }
+  defer unlock()
+  return disk.Ls(filePaths[0])
 }
 
 func (cfs *ChildFileServer) Unzip(zipFilePath string, destinationPath string) error {
-  zipFilePath = cfs.parent.rootDir + zipFilePath
-  destinationPath = cfs.parent.rootDir + destinationPath
-  cfs.Lock([]string{zipFilePath, destinationPath})
-  defer cfs.Unlock([]string{zipFilePath, destinationPath})
-  return disk.Unzip(zipFilePath, destinationPath)
+  lockPaths, filePaths, unlock, err := cfs.lockResolved([]string{zipFilePath, destinationPath}, false)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  end, err := cfs.beginOperation("Unzip", lockPaths, lockPaths[1:])
+  if err != nil {
+    return err
+  }
+  defer end()
+  return disk.Unzip(filePaths[0], filePaths[1])
 }
 
 func (cfs *ChildFileServer) ZipFile(filePath string, zipFilePath string) error {
-  filePath = cfs.parent.rootDir + filePath
-  zipFilePath = cfs.parent.rootDir + zipFilePath
-  cfs.Lock([]string{filePath, zipFilePath})
-  cfs.Unlock([]string{filePath, zipFilePath})
-  return disk.ZipFile(filePath, zipFilePath)
+  lockPaths, filePaths, unlock, err := cfs.lockResolved([]string{filePath, zipFilePath}, false)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  end, err := cfs.beginOperation("ZipFile", lockPaths, lockPaths[1:])
+  if err != nil {
+    return err
+  }
+  defer end()
+  return disk.ZipFile(filePaths[0], filePaths[1])
 }
 
 func (cfs *ChildFileServer) ZipDir(dirPath string, zipFilePath string) error {
-  dirPath = cfs.parent.rootDir + dirPath
-  zipFilePath = cfs.parent.rootDir + zipFilePath
-  cfs.Lock([]string{dirPath, zipFilePath})
-  cfs.Unlock([]string{dirPath, zipFilePath})
-  return disk.ZipDir(dirPath, zipFilePath)
+  lockPaths, filePaths, unlock, err := cfs.lockResolved([]string{dirPath, zipFilePath}, false)
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  end, err := cfs.beginOperation("ZipDir", lockPaths, lockPaths[1:])
+  if err != nil {
+    return err
+  }
+  defer end()
+  return disk.ZipDir(filePaths[0], filePaths[1])
 }
 
 
@@ -154,25 +266,40 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
   if cfs.parent.loggingEnabled > 0 {
     log.Println("FileServer.go", "Handle", request.Method, request.URL.Path)
   }
+  if cfs.parent.scheduler.Closing() {
+    cfs.sendError(writer, 503, "Service Unavailable: Shutting down")
+    return
+  }
   if !strings.HasPrefix(request.URL.Path, cfs.parent.urlPrefix) {
     cfs.sendError(writer, 500, "Internal Server Error: Wrong Prefix")
     return
   }
+  principal, ok := cfs.authenticate(writer, request)
+  if !ok {
+    return
+  }
 
   path, err := cfs.filePathFromURLPath(request.URL.Path)
   if err != nil {
-    cfs.sendError(writer, 400, "Bad Request")
+    cfs.sendPathError(writer, err)
     return
   }
 
   if request.Method == http.MethodGet || request.Method == http.MethodHead {
     neededPath, err := cfs.uniquePathFromURLPath(request.URL.Path)
     if err != nil {
-      cfs.sendError(writer, 400, "Bad Request: %v", err)
+      cfs.sendPathError(writer, err)
+      return
+    }
+    if !cfs.checkAccess(writer, principal, request.Method, neededPath) {
+      return
+    }
+    unlock, err := cfs.waitForPaths(request.Context(), []string{neededPath}, true)
+    if err != nil {
+      cfs.sendLockError(writer, err)
       return
     }
-    cfs.parent.scheduler.WaitUntilAvailable(cfs.routineId, neededPath)
-    defer cfs.parent.scheduler.Done(cfs.routineId, neededPath)
+    defer unlock()
     // Send the requested file.
     file, err := os.Open(path)
     if err != nil {
@@ -195,34 +322,51 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
     // The path is a directory.
     // http.ServeFile() adds links to directories, but we want only plain text.
     if !strings.HasSuffix(path, "/") {
-      http.Redirect(writer, request, request.URL.Path + "/", http.StatusSeeOther)
+      target := request.URL.Path + "/"
+      if len(request.URL.RawQuery) > 0 {
+        // Keep the listing options.
+        target += "?" + request.URL.RawQuery
+      }
+      http.Redirect(writer, request, target, http.StatusSeeOther)
       return
     }
 
-    response, err := childrenOfDirText(path)
+    cfs.sendListing(writer, request, path)
+    return
+  } else if request.Method == http.MethodPut {
+    neededPath, err := cfs.uniquePathFromURLPath(request.URL.Path)
     if err != nil {
-      cfs.sendError(writer, 500, "Internal Server Error: %v", err)
+      cfs.sendPathError(writer, err)
       return
     }
-    data := []byte(response)
-    writer.Header().Set("Content-Type", "text/plain")
-    writer.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
-    writer.WriteHeader(200)
-    if request.Method == http.MethodGet {
-      writer.Write(data)
-    } else {
-      writer.Write([]byte(""))
+    if !cfs.checkWriteMode(writer, request.Method, neededPath) {
+      return
     }
-    return
-  } else if request.Method == http.MethodPut {
-    neededPath, err := cfs.uniquePathFromURLPath(request.URL.Path)
+    if !cfs.checkAccess(writer, principal, request.Method, neededPath) {
+      return
+    }
+    lease, err := cfs.parent.scheduler.WaitUntilAllAvailableWithLease(request.Context(), cfs.routineId, []string{neededPath}, cfs.parent.uploadLeaseTTL)
     if err != nil {
-      cfs.sendError(writer, 400, "Bad Request: %v", err)
+      cfs.sendLockError(writer, err)
+      return
+    }
+    defer lease.Release()
+    if cfs.parent.writeMode == AppendOnly {
+      if doesExist, err := disk.Exists(path); err != nil || doesExist {
+        cfs.sendError(writer, 409, "Conflict: %s exists and the server is append-only", neededPath)
+        return
+      }
+    }
+    // Uploads can take arbitrarily long, so hold the path only for as long as
+    // the client keeps sending data.
+    request.Body = &leaseRenewingReader{body: request.Body, lease: lease}
+    end, err := cfs.beginOperation("PUT", []string{neededPath}, []string{neededPath})
+    if err != nil {
+      cfs.sendError(writer, 500, "Internal Server Error: %v", err)
       return
     }
-    cfs.parent.scheduler.WaitUntilAvailable(cfs.routineId, neededPath)
-    defer cfs.parent.scheduler.Done(cfs.routineId, neededPath)
     err = network.SaveRequestBodyAsFile(request, path, false)
+    end()
     if err != nil {
       cfs.sendError(writer, 500, "Internal Server Error: %v", err)
       return
@@ -232,11 +376,27 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
   } else if request.Method == http.MethodDelete {
     neededPath, err := cfs.uniquePathFromURLPath(request.URL.Path)
     if err != nil {
-      cfs.sendError(writer, 400, "Bad Request: %v", err)
+      cfs.sendPathError(writer, err)
       return
     }
-    cfs.parent.scheduler.WaitUntilAvailable(cfs.routineId, neededPath)
-    defer cfs.parent.scheduler.Done(cfs.routineId, neededPath)
+    if !cfs.checkWriteMode(writer, request.Method, neededPath) {
+      return
+    }
+    if !cfs.checkAccess(writer, principal, request.Method, neededPath) {
+      return
+    }
+    unlock, err := cfs.waitForPaths(request.Context(), []string{neededPath}, false)
+    if err != nil {
+      cfs.sendLockError(writer, err)
+      return
+    }
+    defer unlock()
+    end, err := cfs.beginOperation("DELETE", []string{neededPath}, nil)
+    if err != nil {
+      cfs.sendError(writer, 500, "Internal Server Error: %v", err)
+      return
+    }
+    defer end()
     err = os.RemoveAll(path)
     if err != nil {
       cfs.sendError(writer, 500, "Internal Server Error: %v", err)
@@ -255,12 +415,70 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
   } else if request.Method == http.MethodPost {
     neededPath, err := cfs.uniquePathFromURLPath(request.URL.Path)
     if err != nil {
+      cfs.sendPathError(writer, err)
+      return
+    }
+    if !cfs.checkWriteMode(writer, request.Method, neededPath) {
+      return
+    }
+    if !cfs.checkAccess(writer, principal, request.Method, neededPath) {
+      return
+    }
+    lease, err := cfs.parent.scheduler.WaitUntilAllAvailableWithLease(request.Context(), cfs.routineId, []string{neededPath}, cfs.parent.uploadLeaseTTL)
+    if err != nil {
+      cfs.sendLockError(writer, err)
+      return
+    }
+    defer lease.Release()
+    // Uploads can take arbitrarily long, so hold the path only for as long as
+    // the client keeps sending data.
+    request.Body = &leaseRenewingReader{body: request.Body, lease: lease}
+    // The form's field names become file names, so check them like any other
+    // path before anything is written. (SaveFormPostAsFiles() won't parse the
+    // form again.)
+    err = request.ParseMultipartForm(postSizeLimit)
+    if errors.Is(err, ErrLeaseExpired) {
+      cfs.sendLockError(writer, err)
+      return
+    } else if err != nil {
       cfs.sendError(writer, 400, "Bad Request: %v", err)
       return
     }
-    cfs.parent.scheduler.WaitUntilAvailable(cfs.routineId, neededPath)
-    defer cfs.parent.scheduler.Done(cfs.routineId, neededPath)
-    _, err = network.SaveFormPostAsFiles(request, path, 10 << 30) // Size limit of 10 GB
+    // Everything the upload may create, for the journal.
+    mayCreate := []string{neededPath}
+    for fileName := range request.MultipartForm.File {
+      cleanPath, filePath, err := resolvePath(cfs.parent.rootDir, neededPath + "/" + fileName, cfs.parent.followSymlinks)
+      if err != nil {
+        cfs.sendPathError(writer, err)
+        return
+      }
+      if cfs.parent.writeMode == AppendOnly {
+        if doesExist, err := disk.Exists(filePath); err != nil || doesExist {
+          cfs.sendError(writer, 409, "Conflict: %s exists and the server is append-only", fileName)
+          return
+        }
+      }
+      mayCreate = append(mayCreate, cleanPath)
+    }
+    // The whole body has been read, so nothing renews the lease anymore, but
+    // saving the files may still take a while.
+    stopRenewing, err := keepRenewing(lease, cfs.parent.uploadLeaseTTL)
+    if err != nil {
+      cfs.sendLockError(writer, err)
+      return
+    }
+    end, err := cfs.beginOperation("POST", []string{neededPath}, mayCreate)
+    if err != nil {
+      stopRenewing()
+      cfs.sendError(writer, 500, "Internal Server Error: %v", err)
+      return
+    }
+    _, err = network.SaveFormPostAsFiles(request, path, postSizeLimit)
+    end()
+    if renewErr := stopRenewing(); err == nil && renewErr != nil {
+      cfs.sendLockError(writer, renewErr)
+      return
+    }
     if err != nil {
       cfs.sendError(writer, 500, "Internal Server Error: %v", err)
       return
@@ -281,14 +499,14 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
     }
     path1, err := cfs.uniquePathFromURLPath(request.URL.Path)
     if err != nil {
-      cfs.sendError(writer, 400, "Bad Request: %v", err)
+      cfs.sendPathError(writer, err)
       return
     }
     var path2 string
     if len(patchRequestBody.OtherPath) > 0 {
       path2, err = cfs.uniquePathFromURLPath(patchRequestBody.OtherPath)
       if err != nil {
-        cfs.sendError(writer, 400, "Bad Request: %v", err)
+        cfs.sendPathError(writer, err)
         return
       }
     }
@@ -298,10 +516,35 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
     } else {
       neededPaths = []string{path1}
     }
-    cfs.parent.scheduler.WaitUntilAllAvailable(cfs.routineId, neededPaths)
-    defer cfs.parent.scheduler.DoneAll(cfs.routineId, neededPaths)
+    if !cfs.checkWriteMode(writer, patchRequestBody.Command, path1) {
+      return
+    }
+    if !cfs.checkAccess(writer, principal, patchRequestBody.Command, neededPaths...) {
+      return
+    }
+    unlock, err := cfs.waitForPaths(request.Context(), neededPaths, isReadOnlyCommand(patchRequestBody.Command))
+    if err != nil {
+      cfs.sendLockError(writer, err)
+      return
+    }
+    defer unlock()
+    if !isReadOnlyCommand(patchRequestBody.Command) {
+      var mayCreate []string
+      if patchRequestBody.Command == "mkdir" {
+        mayCreate = []string{path1}
+      } else if len(path2) > 0 && patchRequestBody.Command != "mv" {
+        // cp, zip and unzip create their destination; mv only renames.
+        mayCreate = []string{path2}
+      }
+      end, err := cfs.beginOperation(patchRequestBody.Command, neededPaths, mayCreate)
+      if err != nil {
+        cfs.sendError(writer, 500, "Internal Server Error: %v", err)
+        return
+      }
+      defer end()
+    }
     if patchRequestBody.Command == "-d" {
-      dir, _, err := cfs.IsDirFile(path)
+      dir, _, err := disk.IsDirFile(path)
       if err != nil {
         cfs.sendError(writer, 500, "Internal Server Error: %v", err)
         return
@@ -316,7 +559,7 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
     } else if patchRequestBody.Command == "mv" {
       otherPath, err := cfs.filePathFromURLPath(patchRequestBody.OtherPath)
       if err != nil {
-        cfs.sendError(writer, 400, "Bad Request: %v", err)
+        cfs.sendPathError(writer, err)
         return
       }
       err = os.Rename(path, otherPath)
@@ -329,10 +572,10 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
     } else if (patchRequestBody.Command == "cp") {
       otherPath, err := cfs.filePathFromURLPath(patchRequestBody.OtherPath)
       if err != nil {
-        cfs.sendError(writer, 400, "Bad Request: %v", err)
+        cfs.sendPathError(writer, err)
         return
       }
-      err = cfs.Copy(path, otherPath)
+      err = disk.Copy(path, otherPath)
       if err != nil {
         cfs.sendError(writer, 500, "Internal Server Error: %v", err)
         return
@@ -342,14 +585,14 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
     } else if (patchRequestBody.Command == "zip") {
       otherPath, err := cfs.filePathFromURLPath(patchRequestBody.OtherPath)
       if err != nil {
-        cfs.sendError(writer, 400, "Bad Request: %v", err)
+        cfs.sendPathError(writer, err)
         return
       }
       if !strings.HasSuffix(otherPath, ".zip") {
         cfs.sendError(writer, 400, "Bad Request: second path must end in \".zip\"")
         return
       }
-      doesExist, err := cfs.Exists(otherPath)
+      doesExist, err := disk.Exists(otherPath)
       if err != nil {
         cfs.sendError(writer, 500, "Internal Server Error: %v", err)
         return
@@ -358,7 +601,7 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
         cfs.sendError(writer, 400, "Bad Request: Item exists at path.")
         return
       }
-      dir, _, err := cfs.IsDirFile(path)
+      dir, _, err := disk.IsDirFile(path)
       if err != nil {
         cfs.sendError(writer, 500, "Internal Server Error: %v", err)
         return
@@ -387,10 +630,10 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
       }
       otherPath, err := cfs.filePathFromURLPath(patchRequestBody.OtherPath)
       if err != nil {
-        cfs.sendError(writer, 400, "Bad Request: %v", err)
+        cfs.sendPathError(writer, err)
         return
       }
-      doesExist, err := cfs.Exists(otherPath)
+      doesExist, err := disk.Exists(otherPath)
       if err != nil {
         cfs.sendError(writer, 500, "Internal Server Error: %v", err)
         return
@@ -407,16 +650,7 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
       cfs.sendError(writer, 200, "")
       return
     } else if (patchRequestBody.Command == "ls") {
-      response, err := childrenOfDirText(path)
-      if err != nil {
-        cfs.sendError(writer, 500, "Internal Server Error: %v", err)
-        return
-      }
-      data := []byte(response)
-      writer.Header().Set("Content-Type", "text/plain")
-      writer.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
-      writer.WriteHeader(200)
-      writer.Write(data)
+      cfs.sendListing(writer, request, path)
       return
     } else if patchRequestBody.Command == "mkdir" {
       err := os.Mkdir(path, 0755)
@@ -448,8 +682,118 @@ func (cfs *ChildFileServer) Handle(writer http.ResponseWriter, request *http.Req
     cfs.sendError(writer, 400, "Bad Request: Unsupported Method")
     return
   }
-  cfs.sendError(writer, 500, "Internal Server Error: Could not handle.")
-  return
+}
+
+/*
+ * Waits until the (relative) paths are available or the context is done.
+ * On success, returns a function that releases the paths.
+ */
+func (cfs *ChildFileServer) waitForPaths(ctx context.Context, paths []string, shared bool) (func(), error) {
+  if shared {
+    err := cfs.parent.scheduler.WaitUntilAllAvailableSharedContext(ctx, cfs.routineId, paths)
+    if err != nil {
+      return nil, err
+    }
+    return func() { cfs.parent.scheduler.DoneAllShared(cfs.routineId, paths) }, nil
+  }
+  err := cfs.parent.scheduler.WaitUntilAllAvailableContext(ctx, cfs.routineId, paths)
+  if err != nil {
+    return nil, err
+  }
+  return func() { cfs.parent.scheduler.DoneAll(cfs.routineId, paths) }, nil
+}
+
+/*
+ * Renews the lease every time data is read from the body and fails reads once
+ * the lease has expired, so a stalled upload can't write to a path it no
+ * longer holds.
+ */
+type leaseRenewingReader struct {
+  body io.ReadCloser
+  lease *Lease
+}
+
+func (reader *leaseRenewingReader) Read(p []byte) (int, error) {
+  if err := reader.lease.Renew(); err != nil {
+    return 0, err
+  }
+  n, err := reader.body.Read(p)
+  if renewErr := reader.lease.Renew(); renewErr != nil {
+    return 0, renewErr
+  }
+  return n, err
+}
+
+func (reader *leaseRenewingReader) Close() error {
+  return reader.body.Close()
+}
+
+/*
+ * Renews the lease now and then every third of `ttl` until the returned
+ * function is called, for work the server does on its own (which can't stall
+ * the way a client can). The returned function fails with ErrLeaseExpired if
+ * the lease was lost in the meantime.
+ */
+func keepRenewing(lease *Lease, ttl time.Duration) (func() error, error) {
+  if err := lease.Renew(); err != nil {
+    return nil, err
+  }
+  stop := make(chan bool)
+  stopped := make(chan bool)
+  go func() {
+    defer close(stopped)
+    ticker := time.NewTicker(ttl / 3)
+    defer ticker.Stop()
+    for {
+      select {
+      case <- stop:
+        return
+      case <- ticker.C:
+        if lease.Renew() != nil {
+          return
+        }
+      }
+    }
+  }()
+  return func() error {
+    close(stop)
+    <- stopped
+    return lease.Renew()
+  }, nil
+}
+
+/*
+ * Records in the journal (if there is one) that an operation is about to
+ * modify the (relative) paths, and returns a function to call once it is
+ * over. `mayCreate` are paths it may create, which recovery can remove.
+ */
+func (cfs *ChildFileServer) beginOperation(command string, paths []string, mayCreate []string) (func(), error) {
+  journal := cfs.parent.journal
+  if journal == nil {
+    return func() {}, nil
+  }
+  id, err := journal.begin(cfs.parent.rootDir, cfs.routineId, command, paths, mayCreate)
+  if err != nil {
+    return nil, err
+  }
+  return func() {
+    if err := journal.end(id); err != nil && cfs.parent.loggingEnabled > 0 {
+      log.Println("ParentFileServer.go", "Journal error", err)
+    }
+  }, nil
+}
+
+/*
+ * Reports why paths couldn't be locked: 400 if a path climbs above the root,
+ * otherwise 503 (the request was cancelled, refused to break a deadlock or
+ * refused because the server is closing).
+ */
+func (cfs *ChildFileServer) sendLockError(writer http.ResponseWriter, err error) {
+  if errors.Is(err, ErrInvalidPath) {
+    cfs.sendError(writer, 400, "Bad Request: %v", err)
+    return
+  }
+  cfs.sendError(writer, 503, "Service Unavailable: %v", err)
 }
 
 func (cfs *ChildFileServer) sendError(writer http.ResponseWriter, errorCode int, format string, args ...interface{}) {
@@ -459,19 +803,123 @@ func (cfs *ChildFileServer) sendError(writer http.ResponseWriter, errorCode int,
   http.Error(writer, fmt.Sprintf(format, args...), errorCode)
 }
 
-func (cfs *ChildFileServer) filePathFromURLPath(urlPath string) (string, error) {
-  uniquePath, err := cfs.uniquePathFromURLPath(urlPath)
+/*
+ * Returns who made the request (nil if there is no Authenticator). Otherwise
+ * sends a 401 and returns false.
+ */
+func (cfs *ChildFileServer) authenticate(writer http.ResponseWriter, request *http.Request) (*Principal, bool) {
+  authenticator := cfs.parent.authenticator
+  if authenticator == nil {
+    return nil, true
+  }
+  principal, err := authenticator.Authenticate(request)
   if err != nil {
-    return "", err
+    if challenge := authenticator.Challenge(); len(challenge) > 0 {
+      writer.Header().Set("WWW-Authenticate", challenge)
+    }
+    cfs.sendError(writer, 401, "Unauthorized: %v", err)
+    return nil, false
+  }
+  return principal, true
+}
+
+/*
+ * Returns true iff the server's WriteMode allows the verb (the request's
+ * method, or its command for PATCH) on the (relative) path. Otherwise sends a
+ * 405 and returns false.
+ */
+func (cfs *ChildFileServer) checkWriteMode(writer http.ResponseWriter, verb string, path string) bool {
+  reason, allow := cfs.parent.writeModeRefusal(verb, path)
+  if len(reason) == 0 {
+    return true
+  }
+  writer.Header().Set("Allow", allow)
+  cfs.sendError(writer, 405, "Method Not Allowed: %s", reason)
+  return false
+}
+
+/*
+ * Returns true iff the principal may use the verb (the request's method, or
+ * its command for PATCH) on each of the (relative) paths; see neededAccess().
+ * Otherwise sends a 403 and returns false.
+ */
+func (cfs *ChildFileServer) checkAccess(writer http.ResponseWriter, principal *Principal, verb string, paths ...string) bool {
+  for _, check := range cfs.parent.evaluateAccess(principal, verb, paths) {
+    if !check.Allowed {
+      cfs.sendError(writer, 403, "Forbidden: %s", check.Reason)
+      return false
+    }
   }
-  return cfs.parent.rootDir + uniquePath, nil
+  return true
+}
+
+/*
+ * Reports why a path was refused: 403 if it would escape `rootDir` (see
+ * resolvePath()), otherwise 400.
+ */
+func (cfs *ChildFileServer) sendPathError(writer http.ResponseWriter, err error) {
+  if errors.Is(err, ErrPathEscapesRoot) || errors.Is(err, ErrSymlinkForbidden) {
+    cfs.sendError(writer, 403, "Forbidden: %v", err)
+    return
+  }
+  cfs.sendError(writer, 400, "Bad Request: %v", err)
+}
+
+func (cfs *ChildFileServer) filePathFromURLPath(urlPath string) (string, error) {
+  _, filePath, err := cfs.resolveURLPath(urlPath)
+  return filePath, err
 }
 
 func (cfs *ChildFileServer) uniquePathFromURLPath(urlPath string) (string, error) {
+  uniquePath, _, err := cfs.resolveURLPath(urlPath)
+  return uniquePath, err
+}
+
+func (cfs *ChildFileServer) resolveURLPath(urlPath string) (string, string, error) {
   if !strings.HasPrefix(urlPath, cfs.parent.urlPrefix) {
-    return "", fmt.Errorf("Path did not start with url prefix: %s", urlPath)
+    return "", "", fmt.Errorf("%w: %q doesn't start with the URL prefix", ErrPathEscapesRoot, urlPath)
   }
-  return urlPath[len(cfs.parent.urlPrefix):], nil
+  return resolvePath(cfs.parent.rootDir, urlPath[len(cfs.parent.urlPrefix):], cfs.parent.followSymlinks)
+}
+
+/*
+ * Returns the paths to lock for the (relative) paths and their file paths;
+ * see resolvePath().
+ */
+func (cfs *ChildFileServer) resolvePaths(paths ...string) ([]string, []string, error) {
+  lockPaths := make([]string, len(paths))
+  filePaths := make([]string, len(paths))
+  for i, path := range paths {
+    lockPath, filePath, err := resolvePath(cfs.parent.rootDir, path, cfs.parent.followSymlinks)
+    if err != nil {
+      return nil, nil, err
+    }
+    lockPaths[i] = lockPath
+    filePaths[i] = filePath
+  }
+  return lockPaths, filePaths, nil
+}
+
+/*
+ * Resolves the (relative) paths and locks them like Lock() (or RLock(), if
+ * `shared` is true). Returns the locked paths, the file paths and a function
+ * that unlocks them, resolving nothing again.
+ */
+func (cfs *ChildFileServer) lockResolved(paths []string, shared bool) ([]string, []string, func(), error) {
+  lockPaths, filePaths, err := cfs.resolvePaths(paths...)
+  if err != nil {
+    return nil, nil, nil, err
+  }
+  if shared {
+    if err := cfs.parent.scheduler.WaitUntilAllAvailableSharedUrgent(cfs.routineId, lockPaths); err != nil {
+      return nil, nil, nil, err
+    }
+    return lockPaths, filePaths, func() { cfs.parent.scheduler.DoneAllShared(cfs.routineId, lockPaths) }, nil
+  }
+  if err := cfs.parent.scheduler.WaitUntilAllAvailableUrgent(cfs.routineId, lockPaths); err != nil {
+    return nil, nil, nil, err
+  }
+  return lockPaths, filePaths, func() { cfs.parent.scheduler.DoneAll(cfs.routineId, lockPaths) }, nil
 }
 
 
@@ -485,13 +933,50 @@ type PatchRequestBody struct {
   OtherPath string `json:"otherPath"`
 }
 
+/*
+ * What Handle() lets clients change. (The ChildFileServer methods ignore it.)
+ */
+type WriteMode int
+
+const (
+  ReadWrite WriteMode = iota // anything
+  ReadOnly // only GET, HEAD and the -d, ls, md5 and sha256 commands
+  AppendOnly // also PUT, POST and mkdir, but never overwriting, deleting or moving
+)
+
+func (writeMode WriteMode) String() string {
+  switch writeMode {
+  case ReadWrite:
+    return "read-write"
+  case ReadOnly:
+    return "read-only"
+  case AppendOnly:
+    return "append-only"
+  }
+  return fmt.Sprintf("WriteMode(%d)", int(writeMode))
+}
+
 type ParentFileServer struct {
-  scheduler Scheduler
+  scheduler *Scheduler
+  journal *Journal // nil unless made by MakeParentFileServerWithJournal()
   rootDir string
+  followSymlinks bool
+  rootDeletable bool
+  authenticator Authenticator // nil to serve everyone
+  authorizer Authorizer // nil to let every principal do anything
+  acl *ACL // nil to allow every verb
+  writeMode WriteMode
   urlPrefix string
+  uploadLeaseTTL time.Duration
   loggingEnabled uint
 }
 
+// How long an upload may go without receiving data before its lock expires.
+const defaultUploadLeaseTTL = 30 * time.Second
+
+// The most a POST may upload.
+const postSizeLimit = 10 << 30 // 10 GB
+
 func MakeParentFileServer(rootDir string, urlPrefix string) (*ParentFileServer, error) {
   if ! strings.HasPrefix(urlPrefix, "/") {
     return nil, fmt.Errorf("URL prefix doesn't start in a slash.")
@@ -502,21 +987,285 @@ func MakeParentFileServer(rootDir string, urlPrefix string) (*ParentFileServer,
   if ! strings.HasSuffix(rootDir, "/") {
     return nil, fmt.Errorf("Root path doesn't end in a slash.")
   }
-  return &ParentFileServer{
-    scheduler: MakeScheduler(),
+  pfs := &ParentFileServer{
+    scheduler: NewScheduler(),
     rootDir: rootDir,
     urlPrefix: urlPrefix,
-  }, nil
+    followSymlinks: true,
+    rootDeletable: true,
+    uploadLeaseTTL: defaultUploadLeaseTTL,
+  }
+  pfs.scheduler.OnLeaseExpired(func(lease *Lease) {
+    if pfs.loggingEnabled > 0 {
+      log.Println("ParentFileServer.go", "Upload lease expired", lease.Paths)
+    }
+  })
+  return pfs, nil
+}
+
+/*
+ * Like MakeParentFileServer(), but every operation that modifies files is
+ * recorded in a write-ahead journal at `journalPath` (which should be outside
+ * `rootDir`) before it runs, and marked complete after.
+ *
+ * If the server crashed, the journal still lists the operations that were in
+ * progress. They are returned (and logged) here, before any new requests are
+ * handled. If `rollBack` is true, the files and directories they were creating
+ * (e.g. the destination of an unzip or cp, or a PUT's file) are removed first;
+ * RolledBack is set on every operation cleaned up that way. Moves and deletes
+ * can't be undone, so they are only reported.
+ */
+func MakeParentFileServerWithJournal(rootDir string, urlPrefix string, journalPath string, rollBack bool) (*ParentFileServer, []Operation, error) {
+  pfs, err := MakeParentFileServer(rootDir, urlPrefix)
+  if err != nil {
+    return nil, nil, err
+  }
+  journal, incomplete, err := openJournal(journalPath, rootDir, rollBack)
+  if err != nil {
+    pfs.scheduler.Close(context.Background())
+    return nil, nil, err
+  }
+  for _, operation := range incomplete {
+    log.Println("ParentFileServer.go", "Incomplete operation", operation.Command, operation.Paths, "rolled back:", operation.RolledBack)
+  }
+  pfs.journal = journal
+  return pfs, incomplete, nil
 }
 
 func (pfs *ParentFileServer) NewRoutine() *ChildFileServer {
   return &ChildFileServer{parent: pfs, routineId: uuid.NewString()}
 }
 
-// 0 = none
-// 1 = API calls
-// 2 = info logs
-// 3 = debug logs
+/*
+ * Returns a handler that responds with a JSON snapshot of the held locks and
+ * the requests waiting for them. Mount it somewhere private: it reveals every
+ * locked path.
+ */
+func (pfs *ParentFileServer) DebugHandler() http.Handler {
+  return pfs.scheduler.SnapshotHandler()
+}
+
+/*
+ * Reports lock wait times, hold times, queue depth and grant/deny counts to
+ * the recorder. A metrics.Registry can serve them to Prometheus:
+ *
+ *   registry := metrics.MakeRegistry("fileserver")
+ *   gFileServer.SetMetrics(registry)
+ *   http.Handle("/metrics", registry)
+ */
+func (pfs *ParentFileServer) SetMetrics(recorder metrics.Recorder) {
+  pfs.scheduler.SetMetrics(recorder)
+}
+
+/*
+ * Shuts the server down gracefully: new requests to Handle() get a 503 (as do
+ * requests still waiting for locks, unless SetDrainOnClose(true) was called),
+ * and Close() waits for requests in progress to release their locks before
+ * stopping the scheduling routine. If the context is done first, the routine
+ * is stopped anyway and the context's error is returned.
+ */
+func (pfs *ParentFileServer) Close(ctx context.Context) error {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "Close")
+  }
+  err := pfs.scheduler.Close(ctx)
+  if pfs.journal != nil && err == nil {
+    // Leave the journal open if requests may still be running.
+    err = pfs.journal.Close()
+  }
+  return err
+}
+
+/*
+ * Makes every lock also exclude other processes (e.g. a batch job using
+ * fileScheduler.FileScheduler) that enabled process locks with the same
+ * directory. Call it before handling any requests, and keep `lockDir` outside
+ * `rootDir` so it isn't served.
+ */
+func (pfs *ParentFileServer) EnableProcessLocks(lockDir string) error {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "EnableProcessLocks", lockDir)
+  }
+  return pfs.scheduler.EnableProcessLocks(lockDir)
+}
+
+/*
+ * Sets whether Close() lets requests that are waiting for locks finish rather
+ * than failing them with a 503. Defaults to false.
+ */
+func (pfs *ParentFileServer) SetDrainOnClose(drainOnClose bool) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetDrainOnClose", drainOnClose)
+  }
+  pfs.scheduler.SetDrainOnClose(drainOnClose)
+}
+
+/*
+ * Sets how long a PUT or POST may go without receiving data before its lock
+ * expires and the upload fails. Defaults to 30 seconds.
+ */
+func (pfs *ParentFileServer) SetUploadLeaseTTL(ttl time.Duration) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetUploadLeaseTTL", ttl)
+  }
+  pfs.uploadLeaseTTL = ttl
+}
+
+/*
+ * By default, a symlink inside `rootDir` is followed as long as its target is
+ * inside `rootDir` too. If `followSymlinks` is false, any path that goes
+ * through a symlink is refused with a 403.
+ */
+func (pfs *ParentFileServer) SetFollowSymlinks(followSymlinks bool) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetFollowSymlinks", followSymlinks)
+  }
+  pfs.followSymlinks = followSymlinks
+}
+
+/*
+ * By default, a DELETE of the root (i.e. the URL prefix) deletes everything
+ * in it and re-creates it empty. If `rootDeletable` is false, it gets a 405
+ * instead, and so does an mv of the root. (Servers that aren't ReadWrite
+ * always refuse both.)
+ */
+func (pfs *ParentFileServer) SetRootDeletable(rootDeletable bool) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetRootDeletable", rootDeletable)
+  }
+  pfs.rootDeletable = rootDeletable
+}
+
+/*
+ * Makes Handle() refuse requests the Authenticator doesn't accept with a 401.
+ * See Auth.go.
+ */
+func (pfs *ParentFileServer) SetAuthenticator(authenticator Authenticator) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetAuthenticator")
+  }
+  pfs.authenticator = authenticator
+}
+
+/*
+ * Makes Handle() refuse requests for paths the Authorizer doesn't grant the
+ * needed right to with a 403. See Auth.go.
+ */
+func (pfs *ParentFileServer) SetAuthorizer(authorizer Authorizer) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetAuthorizer")
+  }
+  pfs.authorizer = authorizer
+}
+
+/*
+ * Makes Handle() refuse requests the ACL doesn't allow with a 403, in addition
+ * to any Authorizer. See ACL.go.
+ */
+func (pfs *ParentFileServer) SetACL(acl *ACL) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetACL")
+  }
+  pfs.acl = acl
+}
+
+/*
+ * Returns a handler that explains whether Handle() would allow a request, and
+ * why, as JSON. It takes the query parameters `principal` (omit it for an
+ * anonymous request), `method`, `path` (the URL path), and for PATCH
+ * `command` and `otherPath`. Requests the WriteMode refuses aren't allowed,
+ * whatever the checks say. Like DebugHandler(), mount it somewhere private.
+ */
+func (pfs *ParentFileServer) ExplainHandler() http.Handler {
+  return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    query := request.URL.Query()
+    var principal *Principal
+    if len(query.Get("principal")) > 0 {
+      principal = &Principal{Name: query.Get("principal")}
+    }
+    verb := query.Get("method")
+    if verb == http.MethodPatch {
+      verb = query.Get("command")
+    }
+    urlPaths := []string{query.Get("path")}
+    if len(query.Get("otherPath")) > 0 {
+      urlPaths = append(urlPaths, query.Get("otherPath"))
+    }
+    paths := make([]string, 0, len(urlPaths))
+    for _, urlPath := range urlPaths {
+      if !strings.HasPrefix(urlPath, pfs.urlPrefix) {
+        http.Error(writer, fmt.Sprintf("Bad Request: Path did not start with url prefix: %s", urlPath), 400)
+        return
+      }
+      path, _, err := resolvePath(pfs.rootDir, urlPath[len(pfs.urlPrefix):], pfs.followSymlinks)
+      if err != nil {
+        http.Error(writer, fmt.Sprintf("Bad Request: %v", err), 400)
+        return
+      }
+      paths = append(paths, path)
+    }
+    checks := pfs.evaluateAccess(principal, verb, paths)
+    explanation := AccessExplanation{Verb: verb, Allowed: true, WriteMode: pfs.writeMode.String(), Checks: checks}
+    if principal != nil {
+      explanation.Principal = principal.Name
+    }
+    // Handle() checks the WriteMode first.
+    if reason, _ := pfs.writeModeRefusal(verb, paths[0]); len(reason) > 0 {
+      explanation.Allowed = false
+      explanation.Reason = reason
+    }
+    for _, check := range checks {
+      explanation.Allowed = explanation.Allowed && check.Allowed
+    }
+    data, err := json.MarshalIndent(explanation, "", "  ")
+    if err != nil {
+      http.Error(writer, "Internal Server Error: " + err.Error(), 500)
+      return
+    }
+    writer.Header().Set("Content-Type", "application/json")
+    writer.Write(data)
+  })
+}
+
+/*
+ * Returns "" if the server's WriteMode allows the verb (the request's method,
+ * or its command for PATCH) on the (relative) path. Otherwise returns why not
+ * and the methods it does allow, for the Allow header.
+ */
+func (pfs *ParentFileServer) writeModeRefusal(verb string, path string) (string, string) {
+  switch pfs.writeMode {
+  case ReadOnly:
+    if verb == http.MethodGet || verb == http.MethodHead || isReadOnlyCommand(verb) {
+      return "", ""
+    }
+    return fmt.Sprintf("%s on a read-only server", verb), "GET, HEAD, PATCH"
+  case AppendOnly:
+    if verb == http.MethodGet || verb == http.MethodHead || isReadOnlyCommand(verb) || verb == http.MethodPut || verb == http.MethodPost || verb == "mkdir" {
+      return "", ""
+    }
+    return fmt.Sprintf("%s on an append-only server", verb), "GET, HEAD, PUT, POST, PATCH"
+  }
+  if verb == http.MethodDelete && len(path) == 0 && !pfs.rootDeletable {
+    return "DELETE of the root", "GET, HEAD, PUT, POST, PATCH"
+  }
+  if verb == "mv" && len(path) == 0 && !pfs.rootDeletable {
+    // Moving the root away deletes it just the same.
+    return "mv of the root", "GET, HEAD, PUT, POST, PATCH"
+  }
+  return "", ""
+}
+
+/*
+ * Restricts what Handle() lets clients change; see WriteMode. Requests the
+ * mode doesn't allow (including deleting the root) get a 405.
+ */
+func (pfs *ParentFileServer) SetWriteMode(writeMode WriteMode) {
+  if pfs.loggingEnabled > 0 {
+    log.Println("ParentFileServer.go", "SetWriteMode", writeMode)
+  }
+  pfs.writeMode = writeMode
+}
+
 func (pfs *ParentFileServer) GetLoggingEnabled() uint {
   if pfs.loggingEnabled > 0 {
     log.Println("ParentFileServer.go", "GetLoggingEnabled")
@@ -524,26 +1273,59 @@ func (pfs *ParentFileServer) GetLoggingEnabled() uint {
   return pfs.loggingEnabled
 }
 
+// 0 = none
+// 1 = API calls
+// 2 = info logs
+// 3 = debug logs
 func (pfs *ParentFileServer) SetLoggingEnabled(loggingEnabled uint) {
   log.Println("ParentFileServer.go", "SetLoggingEnabled", loggingEnabled)
   pfs.loggingEnabled = loggingEnabled
-  pfs.scheduler.loggingEnabled = loggingEnabled
+  pfs.scheduler.SetLoggingEnabled(loggingEnabled)
 }
 
+/********** Classless Functions **********/
 
+/*
+ * Returns what a request needs of each of its (relative) paths: its verb (the
+ * request's method, or its command for PATCH) and a right. The second path,
+ * if any, is OtherPath.
+ */
+func neededAccess(verb string, paths []string) []AccessCheck {
+  if verb == http.MethodHead {
+    verb = http.MethodGet
+  }
+  rtn := make([]AccessCheck, len(paths))
+  for i, path := range paths {
+    right := RightWrite
+    if verb == http.MethodGet || isReadOnlyCommand(verb) {
+      right = RightRead
+    } else if i == 0 && (verb == "cp" || verb == "zip" || verb == "unzip") {
+      // These only read their source.
+      right = RightRead
+    } else if verb == http.MethodDelete && len(path) == 0 {
+      right = RightAdmin
+    }
+    rtn[i] = AccessCheck{Verb: verb, Path: strings.TrimSuffix(path, "/"), Right: right}
+  }
+  return rtn
+}
 
+/*
+ * Returns true iff the PATCH command only reads from its paths, so it can
+ * share them with other readers.
+ */
+func isReadOnlyCommand(command string) bool {
+  return command == "-d" || command == "ls" || command == "md5" || command == "sha256"
+}
 
-
-/********** Classless Functions **********/
-
-func childrenOfDirText(path string) (string, error) {
+func childrenOfDirText(path string, includeHidden bool) (string, error) {
   children, err := disk.Ls(path)
   if err != nil {
     return "", err
   }
   response := ""
   for _, childName := range children {
-    if strings.HasPrefix(childName, ".") { continue }
+    if !includeHidden && strings.HasPrefix(childName, ".") { continue }
     if response != "" {
       response = response + "\n"
     }
@@ -0,0 +1,106 @@
+package fileServer
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "testing"
+  "time"
+)
+
+func TestPostMalformedForm(t *testing.T) {
+  pfs, rootDir := makeWriteModeServer(t, ReadWrite)
+  request := multipartRequest(t, "/files/up", "a.txt")
+  request.Header.Set("Content-Type", "multipart/form-data; boundary=wrong")
+  recorder := httptest.NewRecorder()
+  pfs.NewRoutine().Handle(recorder, request)
+  if recorder.Code != 400 {
+    t.Errorf("POST of a malformed form: %d %s, want 400", recorder.Code, recorder.Body)
+  }
+  if _, err := os.Stat(rootDir + "up"); !os.IsNotExist(err) {
+    t.Errorf("a refused POST created up: %v", err)
+  }
+
+  recorder = httptest.NewRecorder()
+  pfs.NewRoutine().Handle(recorder, multipartRequest(t, "/files/up", "a.txt"))
+  if data, err := os.ReadFile(rootDir + "up/a.txt"); recorder.Code != 200 || err != nil || string(data) != "pwned" {
+    t.Errorf("POST: %d %s, a.txt = %q, %v", recorder.Code, recorder.Body, data, err)
+  }
+}
+
+/*
+ * Once a POST's body has been read, the lease is kept alive while the files
+ * are saved.
+ */
+func TestKeepRenewing(t *testing.T) {
+  pfs, _ := makeWriteModeServer(t, ReadWrite)
+  ttl := 100 * time.Millisecond
+  lease, err := pfs.scheduler.WaitUntilAllAvailableWithLease(context.Background(), "A", []string{"a"}, ttl)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer lease.Release()
+  stopRenewing, err := keepRenewing(lease, ttl)
+  if err != nil {
+    t.Fatal(err)
+  }
+  time.Sleep(3 * ttl)
+  if err := stopRenewing(); err != nil {
+    t.Fatalf("the lease expired while being kept alive: %v", err)
+  }
+
+  time.Sleep(3 * ttl)
+  if _, err := keepRenewing(lease, ttl); err == nil {
+    t.Error("kept renewing an expired lease")
+  }
+}
+
+/*
+ * Once the server is closing, new requests and requests waiting for locks get
+ * a 503, and Close() returns once the paths still locked are unlocked.
+ */
+func TestHandleWhileClosing(t *testing.T) {
+  pfs, _ := makeWriteModeServer(t, ReadWrite)
+  cfs := pfs.NewRoutine()
+  if err := cfs.Lock([]string{"a.txt"}); err != nil {
+    t.Fatal(err)
+  }
+  waiting := make(chan *httptest.ResponseRecorder, 1)
+  go func() {
+    waiting <- handle(pfs, http.MethodGet, "/files/a.txt", "")
+  }()
+  waitForWaiting(t, pfs.scheduler, 1)
+  closed := make(chan error, 1)
+  go func() {
+    closed <- pfs.Close(context.Background())
+  }()
+
+  deadline := time.Now().Add(5 * time.Second)
+  for {
+    recorder := handle(pfs, http.MethodGet, "/files/", "")
+    if recorder.Code == 503 {
+      break
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("GET while closing: %d %s, want 503", recorder.Code, recorder.Body)
+    }
+    time.Sleep(time.Millisecond)
+  }
+  if recorder := <- waiting; recorder.Code != 503 {
+    t.Errorf("waiting GET: %d %s, want 503", recorder.Code, recorder.Body)
+  }
+  if recorder := handle(pfs, http.MethodPut, "/files/b.txt", "new"); recorder.Code != 503 {
+    t.Errorf("PUT while closing: %d %s, want 503", recorder.Code, recorder.Body)
+  }
+
+  cfs.Unlock([]string{"a.txt"})
+  select {
+  case err := <- closed:
+    if err != nil {
+      t.Errorf("Close: %v", err)
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("Close didn't return once a.txt was unlocked")
+  }
+}
@@ -2,173 +2,166 @@ package fileServer
 
 import (
   "errors"
-  "strings"
+
+  "github.com/Thomas-Redding/go_util/lockManager"
 )
 
 /*
- * For all operations, if `filePath` doesn't begin with a forward slash, one is
- * added.
- * 
- * ft.Add(filePath)
- * Add a file or directory to the FileTrie.
+ * A reentrant lockManager.Trie keyed by string paths.
+ *
+ * For all operations, paths are canonicalized (see lockManager.Path), so
+ * "foo", "/foo/", "foo//" and "bar/../foo" all refer to the same entity and ""
+ * refers to the root. Paths that climb above the root can't be added.
+ *
+ * ft.Add(filePath, value) error
+ * Lock a file or directory for `value`. Locks are recursive: adding the same
+ * path with the same value again increments a counter, and each Add must be
+ * matched by a Remove. Fails if the path is already held by a different value.
  *
- * ft.ContainsPathOrParent(filePath) bool
+ * ft.AddShared(filePath, value) error
+ * Lock a file or directory for reading by `value`. Any number of values may
+ * share a path. Shared locks are recursive in the same way as Add().
+ *
+ * ft.IsPathLocked(filePath) (bool, string)
  * Returns `true` if and only if either the given file has been added or a
  * directory containing that file has been added.
  *
+ * ft.Conflict(filePath, value) (bool, string)
+ * Returns `true` if and only if the given file, one of its ancestors or one of
+ * its descendants is held (shared or not) by a value other than `value`.
+ *
+ * ft.SharedConflict(filePath, value) (bool, string)
+ * Like Conflict(), but ignores shared locks held by other values.
+ *
+ * ft.ConflictingValues(filePath, value, shared) []string
+ * Returns every value other than `value` that Conflict() (or SharedConflict()
+ * if `shared` is true) could have returned.
+ *
+ * ft.Held() []HeldLock
+ * Returns every held lock, ordered by path.
+ *
  * ft.Length() int
- * Returns the number of files in the FileTrie.
+ * Returns the number of non-root nodes in the FileTrie.
+ *
+ * ft.Remove(filePath) error
+ * Release one lock on the given file.
+ *
+ * ft.RemoveShared(filePath, value) error
+ * Release one shared lock held by `value` on the given file.
  *
- * ft.Remove(filePath) bool
- * Remove the given file from the FileTrie or silently fail.
+ * ft.RemoveWhileExpectingValue(filePath, value) error
+ * Like Remove(), but fails if the file is held by a different value.
  */
 
-type PathNode struct {
-  name string
-  parent *PathNode
-  children map[string]*PathNode
-  count int
-  value string
-}
-
 type FileTrie struct {
-  root *PathNode
-  count int
+  trie lockManager.Trie
 }
 
 func MakeFileTrie() FileTrie {
-  return FileTrie{root: makeImplicitNode("", nil), count: 0}
+  return FileTrie{trie: lockManager.MakeTrie(true)}
 }
 
-func (trie *FileTrie)Add(filePath string, value string) {
-  if !strings.HasPrefix(filePath, "/") {
-    filePath = "/" + filePath
+func (trie *FileTrie)Add(filePath string, value string) error {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return err
   }
-  path := strings.Split(filePath, "/")
-  node := trie.root
-  for i, part := range path {
-  	val, ok := node.children[part]
-    if ok {
-      node = val
-    } else {
-      var newNode *PathNode
-      if i == len(path) - 1 {
-        newNode = makeExplicitNode(part, node, value)
-      } else {
-        newNode = makeImplicitNode(part, node)
-      }
-      trie.count += 1
-      node.children[part] = newNode
-      node = newNode
-    }
+  return trie.trie.Add(path, value, false)
+}
+
+func (trie *FileTrie)AddShared(filePath string, value string) error {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return err
   }
+  return trie.trie.Add(path, value, true)
 }
 
 /*
- * Returns (true, node.value) for the first node in the path with node.count > 0.
+ * Returns (true, value) for the first exclusively locked node in the path.
  * Returns (false, "") otherwise.
  */
-func (trie *FileTrie)IsPathLocked(path string) (bool, string) {
-  if !strings.HasPrefix(path, "/") {
-    path = "/" + path
-  }
-  pathArr := strings.Split(path, "/")
-  node := trie.root
-  for _, part := range pathArr {
-    val, ok := node.children[part]
-    if !ok {
-      break
-    }
-    if val.count > 0 {
-      return true, val.value
-    }
-    node = val
+func (trie *FileTrie)IsPathLocked(filePath string) (bool, string) {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return false, ""
   }
-  return false, ""
+  return trie.trie.LockedBy(path)
 }
 
-func (trie *FileTrie)Length() int {
-  return trie.count
+/*
+ * Returns (true, otherValue) if the path, one of its ancestors or one of its
+ * descendants is held by a value other than `value`.
+ * Returns (false, "") otherwise.
+ */
+func (trie *FileTrie)Conflict(filePath string, value string) (bool, string) {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return false, ""
+  }
+  return trie.trie.Conflict(path, value, false)
 }
 
-func (trie *FileTrie)Remove(filePath string) error {
-  if !strings.HasPrefix(filePath, "/") {
-    filePath = "/" + filePath
-  }
-  path := strings.Split(filePath, "/")
-  node := trie.root
-  for i, part := range path {
-    val, ok := node.children[part]
-    if i == len(path) - 1 {
-      delete(node.children, part)
-      trie.count -= 1
-      for node.parent != nil {
-        if node.count == 0 && len(node.children) == 0 {
-          delete(node.parent.children, node.name)
-          trie.count -= 1
-        }
-        node = node.parent
-      }
-      return nil;
-    }
-    if ok {
-      node = val
-    } else {
-      return errors.New("FileTrie.go: Attempted to remove a file that wasn't here.");
-    }
+/*
+ * Returns (true, otherValue) if the path, one of its ancestors or one of its
+ * descendants is exclusively held by a value other than `value`.
+ * Returns (false, "") otherwise.
+ */
+func (trie *FileTrie)SharedConflict(filePath string, value string) (bool, string) {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return false, ""
   }
-  return errors.New("FileTrie.go: This should never happen");
+  return trie.trie.Conflict(path, value, true)
 }
 
-func (trie *FileTrie)RemoveWhileExpectingValue(filePath string, expectedValue string) error {
-  if !strings.HasPrefix(filePath, "/") {
-    filePath = "/" + filePath
-  }
-  path := strings.Split(filePath, "/")
-  node := trie.root
-  for i, part := range path {
-    val, ok := node.children[part]
-    if i == len(path) - 1 {
-      if val.value != expectedValue {
-        return errors.New("Value was unexpected")
-      }
-      delete(node.children, part)
-      trie.count -= 1
-      for node.parent != nil {
-        if node.count == 0 && len(node.children) == 0 {
-          delete(node.parent.children, node.name)
-          trie.count -= 1
-        }
-        node = node.parent
-      }
-      return nil;
-    }
-    if ok {
-      node = val
-    } else {
-      return errors.New("FileTrie.go: Attempted to remove a file that wasn't here.");
-    }
+func (trie *FileTrie)ConflictingValues(filePath string, value string, shared bool) []string {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return []string{}
   }
-  return errors.New("FileTrie.go: This should never happen");
+  return trie.trie.ConflictingValues(path, value, shared)
+}
+
+func (trie *FileTrie)Held() []HeldLock {
+  return trie.trie.Held()
 }
 
-func fullPathFromNode(node *PathNode) string {
-  rtn := make([]string, 0)
-  for node.parent != nil {
-    rtn = append(rtn, node.name)
-    node = node.parent
+func (trie *FileTrie)Length() int {
+  return trie.trie.Length()
+}
+
+func (trie *FileTrie)Remove(filePath string) error {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return err
   }
-  // Reverse array
-  for i, j := 0, len(rtn)-1; i < j; i, j = i+1, j-1 {
-    rtn[i], rtn[j] = rtn[j], rtn[i]
+  value, ok := trie.trie.Holder(path)
+  if !ok {
+    return errors.New("FileTrie.go: Attempted to remove a lock that wasn't held.")
   }
-  return "/" + strings.Join(rtn, "/")
+  return trie.trie.Remove(path, value, false)
 }
 
-func makeImplicitNode(name string, parent *PathNode) *PathNode {
-  return &PathNode{name: name, parent: parent, children: make(map[string]*PathNode, 0), count: 0, value: ""}
+func (trie *FileTrie)RemoveShared(filePath string, value string) error {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return err
+  }
+  return trie.trie.Remove(path, value, true)
 }
 
-func makeExplicitNode(name string, parent *PathNode, value string) *PathNode {
-  return &PathNode{name: name, parent: parent, children: make(map[string]*PathNode, 0), count: 1, value: value}
+func (trie *FileTrie)RemoveWhileExpectingValue(filePath string, expectedValue string) error {
+  path, err := lockManager.ParsePath(filePath)
+  if err != nil {
+    return err
+  }
+  value, ok := trie.trie.Holder(path)
+  if !ok {
+    return errors.New("FileTrie.go: Attempted to remove a file that wasn't here.")
+  }
+  if value != expectedValue {
+    return errors.New("Value was unexpected")
+  }
+  return trie.trie.Remove(path, value, false)
 }
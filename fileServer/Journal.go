@@ -0,0 +1,200 @@
+package fileServer
+
+import (
+  "bufio"
+  "encoding/json"
+  "os"
+  "sync"
+  "time"
+
+  "github.com/Thomas-Redding/go_util/disk"
+)
+
+/*
+ * A write-ahead journal of the operations that modify files. Before an
+ * operation runs, the journal records (and syncs) what it is about to do; once
+ * it finishes, the journal records that too. So if the server crashes, the
+ * operations that began but never finished are exactly the ones that may have
+ * left a mess behind, e.g. a half-extracted zip.
+ *
+ * The journal is a file of JSON lines:
+ *
+ *   {"begin": {"id": 1, "command": "unzip", "paths": ["a.zip", "a"], "created": ["a"], ...}}
+ *   {"end": 1}
+ *
+ * Whenever no operations are in progress, the journal is truncated, so it
+ * never grows much.
+ */
+
+/*
+ * An operation that modifies files, as recorded in the journal. Paths are
+ * relative to `rootDir`. `Created` are the paths the operation was going to
+ * create (i.e. which didn't exist when it began), so they can be removed to
+ * roll it back. Nothing records what an operation overwrites, moves or
+ * deletes, so those changes are reported but can't be undone.
+ */
+type Operation struct {
+  Id int64 `json:"id"`
+  Command string `json:"command"` // "PUT", "POST", "DELETE" or a PATCH command
+  Paths []string `json:"paths"`
+  Created []string `json:"created,omitempty"`
+  RoutineId string `json:"routineId"`
+  StartedAt time.Time `json:"startedAt"`
+  RolledBack bool `json:"-"` // set by recovery once the created paths are removed
+}
+
+type journalRecord struct {
+  Begin *Operation `json:"begin,omitempty"`
+  End int64 `json:"end,omitempty"`
+}
+
+type Journal struct {
+  file *os.File
+  mu sync.Mutex
+  counter int64
+  inFlight int
+}
+
+/*
+ * Reads the journal at `journalPath` (if there is one) and returns the
+ * operations that began but never ended. If `rollBack` is true, the paths
+ * they created are removed from `rootDir` and RolledBack is set on those that
+ * were cleaned up completely. Then starts a new, empty journal.
+ */
+func openJournal(journalPath string, rootDir string, rollBack bool) (*Journal, []Operation, error) {
+  incomplete, err := readJournal(journalPath)
+  if err != nil {
+    return nil, nil, err
+  }
+  if rollBack {
+    for i := range incomplete {
+      incomplete[i].RolledBack = rollBackOperation(rootDir, incomplete[i])
+    }
+  }
+  file, err := os.OpenFile(journalPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC | os.O_APPEND, 0644)
+  if err != nil {
+    return nil, nil, err
+  }
+  return &Journal{file: file}, incomplete, nil
+}
+
+/*
+ * Records that the operation is about to begin. `mayCreate` are the paths it
+ * may create; those that don't exist yet are recorded in Created.
+ */
+func (journal *Journal) begin(rootDir string, routineId string, command string, paths []string, mayCreate []string) (int64, error) {
+  created := make([]string, 0)
+  for _, path := range mayCreate {
+    if doesExist, err := disk.Exists(rootDir + path); err == nil && !doesExist {
+      created = append(created, path)
+    }
+  }
+  journal.mu.Lock()
+  defer journal.mu.Unlock()
+  journal.counter += 1
+  operation := &Operation{
+    Id: journal.counter,
+    Command: command,
+    Paths: paths,
+    Created: created,
+    RoutineId: routineId,
+    StartedAt: time.Now(),
+  }
+  if err := journal.write(journalRecord{Begin: operation}); err != nil {
+    return 0, err
+  }
+  journal.inFlight += 1
+  return operation.Id, nil
+}
+
+/*
+ * Records that the operation is over, successfully or not.
+ */
+func (journal *Journal) end(id int64) error {
+  journal.mu.Lock()
+  defer journal.mu.Unlock()
+  journal.inFlight -= 1
+  if journal.inFlight == 0 {
+    // Nothing is in progress, so nothing in the journal matters anymore.
+    if err := journal.file.Truncate(0); err != nil {
+      return err
+    }
+    return journal.file.Sync()
+  }
+  return journal.write(journalRecord{End: id})
+}
+
+func (journal *Journal) Close() error {
+  journal.mu.Lock()
+  defer journal.mu.Unlock()
+  return journal.file.Close()
+}
+
+// The caller must hold journal.mu.
+func (journal *Journal) write(record journalRecord) error {
+  data, err := json.Marshal(record)
+  if err != nil {
+    return err
+  }
+  if _, err := journal.file.Write(append(data, '\n')); err != nil {
+    return err
+  }
+  return journal.file.Sync()
+}
+
+/********** Classless Functions **********/
+
+/*
+ * Returns the operations in the journal that began but never ended, in the
+ * order they began. A missing journal has none. Lines that can't be parsed
+ * (e.g. one cut short by the crash) are skipped.
+ */
+func readJournal(journalPath string) ([]Operation, error) {
+  file, err := os.Open(journalPath)
+  if os.IsNotExist(err) {
+    return make([]Operation, 0), nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  begun := make([]*Operation, 0)
+  ended := make(map[int64]bool)
+  scanner := bufio.NewScanner(file)
+  scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+  for scanner.Scan() {
+    var record journalRecord
+    if json.Unmarshal(scanner.Bytes(), &record) != nil {
+      continue
+    }
+    if record.Begin != nil {
+      begun = append(begun, record.Begin)
+    } else if record.End != 0 {
+      ended[record.End] = true
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+  rtn := make([]Operation, 0)
+  for _, operation := range begun {
+    if !ended[operation.Id] {
+      rtn = append(rtn, *operation)
+    }
+  }
+  return rtn, nil
+}
+
+/*
+ * Removes the paths the operation created. Returns false if any of them
+ * couldn't be removed. Files it overwrote keep their new (possibly partial)
+ * contents, and moves aren't reversed.
+ */
+func rollBackOperation(rootDir string, operation Operation) bool {
+  for _, path := range operation.Created {
+    if err := os.RemoveAll(rootDir + path); err != nil {
+      return false
+    }
+  }
+  return true
+}
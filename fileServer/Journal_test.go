@@ -0,0 +1,220 @@
+package fileServer
+
+import (
+  "context"
+  "errors"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+/*
+ * Starts a server with a journal, begins an unzip into "out" and "crashes"
+ * before it ends, leaving a half-extracted directory behind.
+ */
+func crashDuringUnzip(t *testing.T, rootDir string, journalPath string) {
+  pfs, incomplete, err := MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(incomplete) != 0 {
+    t.Fatalf("expected a clean start, got %+v", incomplete)
+  }
+  if _, err := pfs.journal.begin(rootDir, "crashed", "unzip", []string{"a.zip", "out"}, []string{"out"}); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.MkdirAll(rootDir + "out/sub", 0755); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(rootDir + "out/sub/half", []byte("ha"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  // Stop without ending the operation, as a crash would.
+  pfs.Close(context.Background())
+}
+
+func TestJournalRollsBackIncompleteOperations(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  journalPath := filepath.Join(t.TempDir(), "journal")
+  if err := os.WriteFile(rootDir + "a.zip", []byte("zip"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  crashDuringUnzip(t, rootDir, journalPath)
+
+  pfs, incomplete, err := MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  if len(incomplete) != 1 || incomplete[0].Command != "unzip" || !incomplete[0].RolledBack {
+    t.Fatalf("expected the unzip to be rolled back, got %+v", incomplete)
+  }
+  if _, err := os.Stat(rootDir + "out"); !os.IsNotExist(err) {
+    t.Errorf("out should have been removed: %v", err)
+  }
+  if _, err := os.Stat(rootDir + "a.zip"); err != nil {
+    t.Errorf("a.zip existed before the unzip and should still be there: %v", err)
+  }
+}
+
+func TestJournalReportsWithoutRollingBack(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  journalPath := filepath.Join(t.TempDir(), "journal")
+  crashDuringUnzip(t, rootDir, journalPath)
+
+  pfs, incomplete, err := MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  if len(incomplete) != 1 || incomplete[0].RolledBack || len(incomplete[0].Created) != 1 || incomplete[0].Created[0] != "out" {
+    t.Fatalf("expected the unzip to be reported, got %+v", incomplete)
+  }
+  if _, err := os.Stat(rootDir + "out/sub/half"); err != nil {
+    t.Errorf("nothing should have been removed: %v", err)
+  }
+
+  // Opening the journal started a new one, so the operation is only reported once.
+  pfs.Close(context.Background())
+  pfs, incomplete, err = MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  if len(incomplete) != 0 {
+    t.Errorf("expected nothing left to recover, got %+v", incomplete)
+  }
+}
+
+/*
+ * A journal left by an earlier process, whose last line was cut short by the
+ * crash.
+ */
+func TestJournalSkipsTornLines(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  journalPath := filepath.Join(t.TempDir(), "journal")
+  if err := os.WriteFile(rootDir + "new.txt", []byte("partial"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  lines := []string{
+    `{"begin": {"id": 1, "command": "PUT", "paths": ["done.txt"], "created": ["done.txt"]}}`,
+    `{"begin": {"id": 2, "command": "PUT", "paths": ["new.txt"], "created": ["new.txt"]}}`,
+    `{"end": 1}`,
+    `{"begin": {"id": 3, "comm`,
+  }
+  if err := os.WriteFile(journalPath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+    t.Fatal(err)
+  }
+  pfs, incomplete, err := MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  if len(incomplete) != 1 || incomplete[0].Id != 2 || !incomplete[0].RolledBack {
+    t.Fatalf("expected operation 2 to be rolled back, got %+v", incomplete)
+  }
+  if _, err := os.Stat(rootDir + "new.txt"); !os.IsNotExist(err) {
+    t.Errorf("new.txt should have been removed: %v", err)
+  }
+}
+
+/*
+ * Once every operation has ended, the journal is empty again.
+ */
+func TestJournalTruncatesWhenIdle(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  journalPath := filepath.Join(t.TempDir(), "journal")
+  pfs, _, err := MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  request := httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader("data"))
+  recorder := httptest.NewRecorder()
+  pfs.NewRoutine().Handle(recorder, request)
+  if recorder.Code != 200 {
+    t.Fatalf("PUT: %d %s", recorder.Code, recorder.Body)
+  }
+  if info, err := os.Stat(journalPath); err != nil || info.Size() != 0 {
+    t.Errorf("expected an empty journal, got %v, %v", info, err)
+  }
+}
+
+/*
+ * Crashes a server with a journal while a PUT is still receiving its body,
+ * just after a mkdir but before the mkdir's end was recorded, and checks that
+ * recovery rolls both back.
+ */
+func TestJournalRecoversRequests(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  journalPath := filepath.Join(t.TempDir(), "journal")
+  pfs, _, err := MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+
+  body, bodyWriter := io.Pipe()
+  putDone := make(chan int, 1)
+  go func() {
+    recorder := httptest.NewRecorder()
+    pfs.NewRoutine().Handle(recorder, httptest.NewRequest(http.MethodPut, "/files/new.txt", body))
+    putDone <- recorder.Code
+  }()
+  bodyWriter.Write([]byte("partial"))
+  for {
+    data, err := os.ReadFile(journalPath)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if strings.Contains(string(data), `"PUT"`) {
+      break
+    }
+    time.Sleep(time.Millisecond)
+  }
+  if recorder := handle(pfs, http.MethodPatch, "/files/d", `{"command": "mkdir"}`); recorder.Code != 200 {
+    t.Fatalf("mkdir: %d %s", recorder.Code, recorder.Body)
+  }
+
+  // The PUT keeps the journal from being truncated, so it now holds the
+  // PUT's begin and the mkdir's begin and end. Drop the end, as if the server
+  // crashed just before writing it.
+  data, err := os.ReadFile(journalPath)
+  if err != nil {
+    t.Fatal(err)
+  }
+  lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+  if len(lines) != 3 {
+    t.Fatalf("expected 3 journal lines, got %q", lines)
+  }
+  crashed := strings.Join(lines[:2], "\n") + "\n"
+
+  bodyWriter.CloseWithError(errors.New("crash"))
+  <- putDone
+  pfs.Close(context.Background())
+  if err := os.WriteFile(journalPath, []byte(crashed), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  pfs, incomplete, err := MakeParentFileServerWithJournal(rootDir, "/files/", journalPath, true)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  if len(incomplete) != 2 {
+    t.Fatalf("expected the PUT and mkdir to be incomplete, got %+v", incomplete)
+  }
+  for i, want := range []string{"new.txt", "d"} {
+    if operation := incomplete[i]; len(operation.Created) != 1 || operation.Created[0] != want || !operation.RolledBack {
+      t.Errorf("expected %s to be created and rolled back, got %+v", want, operation)
+    }
+  }
+  if _, err := os.Stat(rootDir + "d"); !os.IsNotExist(err) {
+    t.Errorf("d should have been removed: %v", err)
+  }
+}
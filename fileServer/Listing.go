@@ -0,0 +1,263 @@
+package fileServer
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/*
+ * Directory listings, for GET on a directory and the ls command. By default
+ * they are plain text: the names of the children, one per line, without
+ * hidden (dot) files. A request with "Accept: application/json" or
+ * "?format=json" gets a DirListing instead.
+ *
+ * Both take "?hidden=true" to include hidden files. JSON listings also take:
+ * - sort: "name" (the default), "size", "mtime" or "type"
+ * - order: "asc" (the default) or "desc"
+ * - limit: the most entries to return (by default, all of them)
+ * - cursor: the NextCursor of the previous page
+ *
+ * A cursor remembers the last entry of its page rather than an offset, so
+ * entries added or removed between requests don't shift the pages. It is
+ * only valid with the same sort and order.
+ */
+
+type DirEntry struct {
+  Name string `json:"name"`
+  Type string `json:"type"` // "file", "dir", "symlink" or "other"
+  Size int64 `json:"size"`
+  Mode string `json:"mode"` // e.g. "-rw-r--r--"
+  ModTime time.Time `json:"mtime"`
+  ContentType string `json:"contentType,omitempty"` // files only
+}
+
+type DirListing struct {
+  Entries []DirEntry `json:"entries"`
+  NextCursor string `json:"nextCursor,omitempty"` // empty on the last page
+}
+
+type listOptions struct {
+  json bool
+  hidden bool
+  sortBy string
+  descending bool
+  limit int
+  cursor *listCursor
+}
+
+/*
+ * What a cursor encodes: the sort it belongs to and its page's last entry.
+ */
+type listCursor struct {
+  SortBy string `json:"s"`
+  Descending bool `json:"d,omitempty"`
+  Name string `json:"n"`
+  Type string `json:"t,omitempty"`
+  Size int64 `json:"z,omitempty"`
+  ModTime int64 `json:"m,omitempty"`
+}
+
+/*
+ * Sends the listing of the directory at `filePath` in the format and with the
+ * options the request asks for. HEAD requests get only the headers.
+ */
+func (cfs *ChildFileServer) sendListing(writer http.ResponseWriter, request *http.Request, filePath string) {
+  options, err := parseListOptions(request)
+  if err != nil {
+    cfs.sendError(writer, 400, "Bad Request: %v", err)
+    return
+  }
+  var data []byte
+  if options.json {
+    listing, err := listDir(filePath, options)
+    if err != nil {
+      cfs.sendError(writer, 500, "Internal Server Error: %v", err)
+      return
+    }
+    data, err = json.Marshal(listing)
+    if err != nil {
+      cfs.sendError(writer, 500, "Internal Server Error: %v", err)
+      return
+    }
+    writer.Header().Set("Content-Type", "application/json")
+  } else {
+    response, err := childrenOfDirText(filePath, options.hidden)
+    if err != nil {
+      cfs.sendError(writer, 500, "Internal Server Error: %v", err)
+      return
+    }
+    data = []byte(response)
+    writer.Header().Set("Content-Type", "text/plain")
+  }
+  writer.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+  writer.WriteHeader(200)
+  if request.Method != http.MethodHead {
+    writer.Write(data)
+  }
+}
+
+/********** Classless Functions **********/
+
+func parseListOptions(request *http.Request) (listOptions, error) {
+  query := request.URL.Query()
+  options := listOptions{sortBy: "name"}
+  options.json = query.Get("format") == "json" || strings.Contains(request.Header.Get("Accept"), "application/json")
+  if format := query.Get("format"); len(format) > 0 && format != "json" && format != "text" {
+    return options, fmt.Errorf("unknown format %q", format)
+  }
+  if hidden := query.Get("hidden"); len(hidden) > 0 {
+    var err error
+    if options.hidden, err = strconv.ParseBool(hidden); err != nil {
+      return options, fmt.Errorf("bad hidden %q", hidden)
+    }
+  }
+  if sortBy := query.Get("sort"); len(sortBy) > 0 {
+    if sortBy != "name" && sortBy != "size" && sortBy != "mtime" && sortBy != "type" {
+      return options, fmt.Errorf("unknown sort %q", sortBy)
+    }
+    options.sortBy = sortBy
+  }
+  switch query.Get("order") {
+  case "", "asc":
+  case "desc":
+    options.descending = true
+  default:
+    return options, fmt.Errorf("unknown order %q", query.Get("order"))
+  }
+  if limit := query.Get("limit"); len(limit) > 0 {
+    var err error
+    if options.limit, err = strconv.Atoi(limit); err != nil || options.limit < 1 {
+      return options, fmt.Errorf("bad limit %q", limit)
+    }
+  }
+  if cursor := query.Get("cursor"); len(cursor) > 0 {
+    data, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+      return options, fmt.Errorf("bad cursor")
+    }
+    options.cursor = &listCursor{}
+    if err := json.Unmarshal(data, options.cursor); err != nil {
+      return options, fmt.Errorf("bad cursor")
+    }
+    if options.cursor.SortBy != options.sortBy || options.cursor.Descending != options.descending {
+      return options, fmt.Errorf("cursor is for a different sort or order")
+    }
+  }
+  return options, nil
+}
+
+func listDir(dirPath string, options listOptions) (DirListing, error) {
+  infos, err := ioutil.ReadDir(dirPath)
+  if err != nil {
+    return DirListing{}, err
+  }
+  entries := make([]DirEntry, 0, len(infos))
+  for _, info := range infos {
+    if !options.hidden && strings.HasPrefix(info.Name(), ".") {
+      continue
+    }
+    entries = append(entries, DirEntry{
+      Name: info.Name(),
+      Type: entryType(info.Mode()),
+      Size: info.Size(),
+      Mode: info.Mode().String(),
+      ModTime: info.ModTime(),
+    })
+  }
+  less := func(a DirEntry, b DirEntry) bool {
+    if options.descending {
+      a, b = b, a
+    }
+    switch options.sortBy {
+    case "size":
+      if a.Size != b.Size {
+        return a.Size < b.Size
+      }
+    case "mtime":
+      if !a.ModTime.Equal(b.ModTime) {
+        return a.ModTime.Before(b.ModTime)
+      }
+    case "type":
+      if a.Type != b.Type {
+        return a.Type < b.Type
+      }
+    }
+    return a.Name < b.Name
+  }
+  sort.Slice(entries, func(i int, j int) bool { return less(entries[i], entries[j]) })
+
+  if options.cursor != nil {
+    last := DirEntry{
+      Name: options.cursor.Name,
+      Type: options.cursor.Type,
+      Size: options.cursor.Size,
+      ModTime: time.Unix(0, options.cursor.ModTime),
+    }
+    start := sort.Search(len(entries), func(i int) bool { return less(last, entries[i]) })
+    entries = entries[start:]
+  }
+  listing := DirListing{Entries: entries}
+  if options.limit > 0 && len(entries) > options.limit {
+    listing.Entries = entries[:options.limit]
+    last := listing.Entries[options.limit - 1]
+    data, err := json.Marshal(listCursor{
+      SortBy: options.sortBy,
+      Descending: options.descending,
+      Name: last.Name,
+      Type: last.Type,
+      Size: last.Size,
+      ModTime: last.ModTime.UnixNano(),
+    })
+    if err != nil {
+      return DirListing{}, err
+    }
+    listing.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+  }
+  // Only sniff the files that are actually returned.
+  for i := range listing.Entries {
+    if listing.Entries[i].Type == "file" {
+      listing.Entries[i].ContentType = sniffContentType(filepath.Join(dirPath, listing.Entries[i].Name))
+    }
+  }
+  return listing, nil
+}
+
+func entryType(mode os.FileMode) string {
+  switch {
+  case mode.IsRegular():
+    return "file"
+  case mode.IsDir():
+    return "dir"
+  case mode & os.ModeSymlink != 0:
+    return "symlink"
+  }
+  return "other"
+}
+
+/*
+ * Like disk.FileContentType(), but closes the file and handles empty files.
+ * Returns "" if the file can't be read.
+ */
+func sniffContentType(filePath string) string {
+  file, err := os.Open(filePath)
+  if err != nil {
+    return ""
+  }
+  defer file.Close()
+  buffer := make([]byte, 512)
+  n, err := io.ReadFull(file, buffer)
+  if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+    return ""
+  }
+  return http.DetectContentType(buffer[:n])
+}
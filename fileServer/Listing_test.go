@@ -0,0 +1,267 @@
+package fileServer
+
+import (
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "os"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+
+/*
+ * Makes a root with:
+ * - dir/: a.png, b.txt, an empty file, a subdirectory and a hidden file
+ * - sorted/: x (3 bytes), y (1 byte) and z (2 bytes), modified z, x, y
+ */
+func makeListingServer(t *testing.T) (*ParentFileServer, string) {
+  rootDir := t.TempDir() + "/"
+  for _, dir := range []string{"dir/c", "sorted"} {
+    if err := os.MkdirAll(rootDir + dir, 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+  base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+  files := []struct {
+    path string
+    data []byte
+    modTime time.Time
+  }{
+    {"dir/a.png", pngHeader, base},
+    {"dir/b.txt", []byte("hello"), base},
+    {"dir/empty", nil, base},
+    {"dir/.hidden", []byte("secret"), base},
+    {"sorted/x", []byte("xxx"), base.Add(2 * time.Hour)},
+    {"sorted/y", []byte("y"), base.Add(3 * time.Hour)},
+    {"sorted/z", []byte("zz"), base.Add(1 * time.Hour)},
+  }
+  for _, file := range files {
+    if err := os.WriteFile(rootDir + file.path, file.data, 0644); err != nil {
+      t.Fatal(err)
+    }
+    if err := os.Chtimes(rootDir + file.path, file.modTime, file.modTime); err != nil {
+      t.Fatal(err)
+    }
+  }
+  pfs, err := MakeParentFileServer(rootDir, "/files/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { pfs.Close(context.Background()) })
+  return pfs, rootDir
+}
+
+func getListing(t *testing.T, pfs *ParentFileServer, target string) DirListing {
+  recorder := handle(pfs, http.MethodGet, target, "")
+  if recorder.Code != 200 {
+    t.Fatalf("GET %s: %d %s", target, recorder.Code, recorder.Body)
+  }
+  if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+    t.Fatalf("GET %s: Content-Type %q", target, contentType)
+  }
+  var listing DirListing
+  if err := json.Unmarshal(recorder.Body.Bytes(), &listing); err != nil {
+    t.Fatalf("GET %s: %v", target, err)
+  }
+  return listing
+}
+
+func entryNames(listing DirListing) []string {
+  rtn := make([]string, 0)
+  for _, entry := range listing.Entries {
+    rtn = append(rtn, entry.Name)
+  }
+  return rtn
+}
+
+func TestListingJSONEntries(t *testing.T) {
+  pfs, rootDir := makeListingServer(t)
+  listing := getListing(t, pfs, "/files/dir/?format=json")
+  if names := entryNames(listing); !reflect.DeepEqual(names, []string{"a.png", "b.txt", "c", "empty"}) {
+    t.Fatalf("entries %v", names)
+  }
+  if len(listing.NextCursor) != 0 {
+    t.Errorf("a complete listing has a cursor: %q", listing.NextCursor)
+  }
+  info, err := os.Stat(rootDir + "dir/c")
+  if err != nil {
+    t.Fatal(err)
+  }
+  fileMode := "-rw-r--r--"
+  if fileInfo, err := os.Stat(rootDir + "dir/b.txt"); err == nil {
+    fileMode = fileInfo.Mode().String() // in case of an unusual umask
+  }
+  base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+  want := []DirEntry{
+    {Name: "a.png", Type: "file", Size: int64(len(pngHeader)), Mode: fileMode, ModTime: base, ContentType: "image/png"},
+    {Name: "b.txt", Type: "file", Size: 5, Mode: fileMode, ModTime: base, ContentType: "text/plain; charset=utf-8"},
+    {Name: "c", Type: "dir", Size: info.Size(), Mode: info.Mode().String(), ModTime: info.ModTime()},
+    {Name: "empty", Type: "file", Size: 0, Mode: fileMode, ModTime: base, ContentType: "text/plain; charset=utf-8"},
+  }
+  for i, entry := range listing.Entries {
+    if !entry.ModTime.Equal(want[i].ModTime) {
+      t.Errorf("%s: mtime %v, want %v", entry.Name, entry.ModTime, want[i].ModTime)
+    }
+    entry.ModTime, want[i].ModTime = time.Time{}, time.Time{}
+    if entry != want[i] {
+      t.Errorf("entry %+v, want %+v", entry, want[i])
+    }
+  }
+
+  // The Accept header works as well as ?format=json.
+  recorder := httptest.NewRecorder()
+  request := httptest.NewRequest(http.MethodGet, "/files/dir/", nil)
+  request.Header.Set("Accept", "application/json")
+  pfs.NewRoutine().Handle(recorder, request)
+  if recorder.Header().Get("Content-Type") != "application/json" {
+    t.Errorf("Accept: application/json got %q", recorder.Header().Get("Content-Type"))
+  }
+
+  // So does the ls command.
+  recorder = handle(pfs, http.MethodPatch, "/files/dir/?format=json&sort=type", `{"command": "ls"}`)
+  var lsListing DirListing
+  if err := json.Unmarshal(recorder.Body.Bytes(), &lsListing); err != nil || entryNames(lsListing)[0] != "c" {
+    t.Errorf("ls: %d %s", recorder.Code, recorder.Body)
+  }
+}
+
+func TestListingHiddenFiles(t *testing.T) {
+  pfs, _ := makeListingServer(t)
+  tests := []struct {
+    target string
+    body string
+  }{
+    {"/files/dir/", "a.png\nb.txt\nc\nempty"},
+    {"/files/dir/?hidden=false", "a.png\nb.txt\nc\nempty"},
+    {"/files/dir/?hidden=true", ".hidden\na.png\nb.txt\nc\nempty"},
+  }
+  for _, test := range tests {
+    recorder := handle(pfs, http.MethodGet, test.target, "")
+    if recorder.Code != 200 || recorder.Body.String() != test.body || recorder.Header().Get("Content-Type") != "text/plain" {
+      t.Errorf("GET %s: %d %q (%s), want %q", test.target, recorder.Code, recorder.Body, recorder.Header().Get("Content-Type"), test.body)
+    }
+  }
+  if names := entryNames(getListing(t, pfs, "/files/dir/?format=json&hidden=true")); names[0] != ".hidden" {
+    t.Errorf("hidden JSON entries %v", names)
+  }
+  if recorder := handle(pfs, http.MethodGet, "/files/dir/?hidden=maybe", ""); recorder.Code != 400 {
+    t.Errorf("hidden=maybe: %d", recorder.Code)
+  }
+}
+
+func TestListingSortAndOrder(t *testing.T) {
+  pfs, _ := makeListingServer(t)
+  tests := []struct {
+    query string
+    names []string
+  }{
+    {"", []string{"x", "y", "z"}},
+    {"&sort=name&order=asc", []string{"x", "y", "z"}},
+    {"&order=desc", []string{"z", "y", "x"}},
+    {"&sort=size", []string{"y", "z", "x"}},
+    {"&sort=size&order=desc", []string{"x", "z", "y"}},
+    {"&sort=mtime", []string{"z", "x", "y"}},
+    {"&sort=mtime&order=desc", []string{"y", "x", "z"}},
+  }
+  for _, test := range tests {
+    if names := entryNames(getListing(t, pfs, "/files/sorted/?format=json" + test.query)); !reflect.DeepEqual(names, test.names) {
+      t.Errorf("%s: %v, want %v", test.query, names, test.names)
+    }
+  }
+  // Directories sort before files by type, and ties go by name.
+  if names := entryNames(getListing(t, pfs, "/files/dir/?format=json&sort=type")); !reflect.DeepEqual(names, []string{"c", "a.png", "b.txt", "empty"}) {
+    t.Errorf("sort=type: %v", names)
+  }
+  for _, query := range []string{"sort=color", "order=up", "format=xml"} {
+    if recorder := handle(pfs, http.MethodGet, "/files/sorted/?" + query, ""); recorder.Code != 400 {
+      t.Errorf("%s: %d, want 400", query, recorder.Code)
+    }
+  }
+}
+
+func TestListingPages(t *testing.T) {
+  pfs, rootDir := makeListingServer(t)
+  for _, query := range []string{"sort=name", "sort=size&order=desc", "sort=mtime"} {
+    all := entryNames(getListing(t, pfs, "/files/sorted/?format=json&" + query))
+    pages := make([]string, 0)
+    target := "/files/sorted/?format=json&limit=2&" + query
+    for i := 0; ; i++ {
+      listing := getListing(t, pfs, target)
+      pages = append(pages, entryNames(listing)...)
+      if len(listing.NextCursor) == 0 {
+        break
+      }
+      if i > 3 {
+        t.Fatalf("%s: too many pages", query)
+      }
+      target = "/files/sorted/?format=json&limit=2&" + query + "&cursor=" + url.QueryEscape(listing.NextCursor)
+    }
+    if !reflect.DeepEqual(pages, all) {
+      t.Errorf("%s: pages %v, want %v", query, pages, all)
+    }
+  }
+
+  // A file added before the cursor doesn't shift the next page.
+  first := getListing(t, pfs, "/files/sorted/?format=json&limit=2")
+  if err := os.WriteFile(rootDir + "sorted/a", []byte("a"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  second := getListing(t, pfs, "/files/sorted/?format=json&limit=2&cursor=" + url.QueryEscape(first.NextCursor))
+  if names := entryNames(second); !reflect.DeepEqual(names, []string{"z"}) {
+    t.Errorf("second page after adding a: %v", names)
+  }
+
+  otherSort := getListing(t, pfs, "/files/sorted/?format=json&limit=1&sort=size").NextCursor
+  notJSON := base64.RawURLEncoding.EncodeToString([]byte("not json"))
+  for _, query := range []string{"cursor=!!!", "cursor=" + notJSON, "cursor=" + otherSort, "limit=0", "limit=-1", "limit=two"} {
+    if recorder := handle(pfs, http.MethodGet, "/files/sorted/?format=json&" + query, ""); recorder.Code != 400 {
+      t.Errorf("%s: %d, want 400", query, recorder.Code)
+    }
+  }
+}
+
+func TestListingHead(t *testing.T) {
+  pfs, _ := makeListingServer(t)
+  for _, target := range []string{"/files/dir/", "/files/dir/?format=json"} {
+    get := handle(pfs, http.MethodGet, target, "")
+    head := handle(pfs, http.MethodHead, target, "")
+    if head.Code != 200 || head.Body.Len() != 0 {
+      t.Errorf("HEAD %s: %d with %d bytes", target, head.Code, head.Body.Len())
+    }
+    for _, header := range []string{"Content-Type", "Content-Length"} {
+      if head.Header().Get(header) != get.Header().Get(header) {
+        t.Errorf("HEAD %s: %s %q, GET has %q", target, header, head.Header().Get(header), get.Header().Get(header))
+      }
+    }
+  }
+}
+
+/*
+ * A directory without a trailing slash redirects to one with it, keeping the
+ * listing options.
+ */
+func TestListingRedirectKeepsQuery(t *testing.T) {
+  pfs, _ := makeListingServer(t)
+  tests := map[string]string{
+    "/files/dir": "/files/dir/",
+    "/files/dir?format=json&sort=size&order=desc": "/files/dir/?format=json&sort=size&order=desc",
+  }
+  for target, location := range tests {
+    recorder := handle(pfs, http.MethodGet, target, "")
+    if recorder.Code != http.StatusSeeOther || recorder.Header().Get("Location") != location {
+      t.Errorf("GET %s: %d to %q, want %d to %q", target, recorder.Code, recorder.Header().Get("Location"), http.StatusSeeOther, location)
+    }
+  }
+  // Files aren't listings.
+  recorder := handle(pfs, http.MethodGet, "/files/dir/b.txt", "")
+  if recorder.Code != 200 || !strings.HasPrefix(recorder.Body.String(), "hello") {
+    t.Errorf("GET b.txt: %d %s", recorder.Code, recorder.Body)
+  }
+}
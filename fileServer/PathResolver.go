@@ -0,0 +1,144 @@
+package fileServer
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+)
+
+/*
+ * Every path a client sends (the URL path and a PATCH request's otherPath) is
+ * turned into a file path by resolvePath(), which guarantees the file path is
+ * inside `rootDir`:
+ *
+ * - The path is cleaned, so "a//b/./c" becomes "a/b/c". Since the URL path is
+ *   already decoded, this also covers encoded slashes and dots ("%2F", "%2E").
+ * - Any ".." segment is refused, even one that would stay inside the root, so
+ *   a path has only one spelling (which is what gets locked).
+ * - NUL bytes are refused, since the OS would silently cut the path short.
+ * - Each existing component is checked with Lstat(). A symlink is followed only
+ *   if its target is inside `rootDir`, and not at all if SetFollowSymlinks(false)
+ *   was called. A dangling symlink is refused, since writing through it could
+ *   create a file anywhere.
+ * - Paths are locked (and checked against the Authorizer and ACL) by where
+ *   their symlinks lead, so "link/x" and "a/x" are the same path if "link"
+ *   points to "a". The file path itself still goes through the symlink, so
+ *   deleting or moving "link" affects only the link.
+ *
+ * A symlink created between the check and the use can still escape; this only
+ * protects against what is already on disk, not against a hostile local user.
+ */
+
+// Returned (wrapped) when a path would resolve outside `rootDir`.
+var ErrPathEscapesRoot = errors.New("PathResolver.go: Path escapes the root.")
+
+// Returned (wrapped) when a path goes through a symlink and SetFollowSymlinks(false) was called.
+var ErrSymlinkForbidden = errors.New("PathResolver.go: Path goes through a symlink.")
+
+/*
+ * Returns the path to lock for `relPath` (relative to `rootDir`, with no
+ * leading slash, with its trailing slash, if any, and with symlinks resolved)
+ * and the file path it refers to.
+ */
+func resolvePath(rootDir string, relPath string, followSymlinks bool) (string, string, error) {
+  cleanPath, err := cleanRelativePath(relPath)
+  if err != nil {
+    return "", "", err
+  }
+  if len(cleanPath) > 0 && strings.HasSuffix(relPath, "/") {
+    cleanPath += "/"
+  }
+  lockPath, err := checkSymlinks(rootDir, cleanPath, followSymlinks)
+  if err != nil {
+    return "", "", err
+  }
+  return lockPath, rootDir + cleanPath, nil
+}
+
+/*
+ * Returns `relPath` cleaned, with no leading or trailing slash, or an error
+ * wrapping ErrPathEscapesRoot if it has a ".." segment or a NUL byte. This
+ * doesn't look at the disk.
+ */
+func cleanRelativePath(relPath string) (string, error) {
+  if strings.ContainsRune(relPath, 0) {
+    return "", fmt.Errorf("%w: %q contains a NUL byte", ErrPathEscapesRoot, relPath)
+  }
+  for _, part := range strings.Split(relPath, "/") {
+    if part == ".." {
+      return "", fmt.Errorf("%w: %q", ErrPathEscapesRoot, relPath)
+    }
+  }
+  return strings.TrimPrefix(path.Clean("/" + relPath), "/"), nil
+}
+
+/*
+ * Walks the components of `cleanPath` that exist, refusing symlinks that point
+ * outside `rootDir` (or any symlink, if `followSymlinks` is false). Returns
+ * `cleanPath` with the symlinks resolved.
+ */
+func checkSymlinks(rootDir string, cleanPath string, followSymlinks bool) (string, error) {
+  realRoot, err := filepath.EvalSymlinks(rootDir)
+  if err != nil {
+    return "", err
+  }
+  parts := strings.Split(strings.TrimSuffix(cleanPath, "/"), "/")
+  current := realRoot
+  for i, part := range parts {
+    if len(part) == 0 {
+      continue
+    }
+    next := filepath.Join(current, part)
+    info, err := os.Lstat(next)
+    if os.IsNotExist(err) {
+      // Nothing below here exists, so there are no more symlinks to follow.
+      current = filepath.Join(append([]string{current}, parts[i:]...)...)
+      break
+    }
+    if err != nil {
+      return "", err
+    }
+    if info.Mode() & os.ModeSymlink == 0 {
+      current = next
+      continue
+    }
+    if !followSymlinks {
+      return "", fmt.Errorf("%w: %q", ErrSymlinkForbidden, cleanPath)
+    }
+    target, err := filepath.EvalSymlinks(next)
+    if err != nil {
+      // Most likely dangling.
+      return "", fmt.Errorf("%w: %q goes through a broken symlink", ErrPathEscapesRoot, cleanPath)
+    }
+    if !isWithin(realRoot, target) {
+      return "", fmt.Errorf("%w: %q", ErrPathEscapesRoot, cleanPath)
+    }
+    current = target
+  }
+  rel, err := filepath.Rel(realRoot, current)
+  if err != nil {
+    return "", err
+  }
+  lockPath := filepath.ToSlash(rel)
+  if lockPath == "." {
+    return "", nil
+  }
+  if strings.HasSuffix(cleanPath, "/") {
+    lockPath += "/"
+  }
+  return lockPath, nil
+}
+
+/*
+ * Returns true iff `target` is `root` or inside it. Both must be clean.
+ */
+func isWithin(root string, target string) bool {
+  rel, err := filepath.Rel(root, target)
+  if err != nil {
+    return false
+  }
+  return rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,237 @@
+package fileServer
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "mime/multipart"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+/*
+ * Makes a root with a file, a directory, a symlink to the directory, a symlink
+ * out of the root and a dangling symlink. Returns the root and a directory
+ * outside it.
+ */
+func makeSymlinkTree(t *testing.T) (string, string) {
+  rootDir := t.TempDir() + "/"
+  outside := t.TempDir()
+  for _, dir := range []string{rootDir + "a", outside + "/secret"} {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, file := range []string{rootDir + "a/x", outside + "/secret/passwd"} {
+    if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  links := map[string]string{
+    rootDir + "link": "a",
+    rootDir + "out": outside + "/secret",
+    rootDir + "dangling": rootDir + "missing",
+  }
+  for link, target := range links {
+    if err := os.Symlink(target, link); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return rootDir, outside
+}
+
+func TestResolvePath(t *testing.T) {
+  rootDir, _ := makeSymlinkTree(t)
+  tests := []struct {
+    relPath string
+    lockPath string
+    filePath string // relative to rootDir
+    err error
+  }{
+    {"a/x", "a/x", "a/x", nil},
+    {"a//./x", "a/x", "a/x", nil},
+    {"a/", "a/", "a/", nil},
+    {"", "", "", nil},
+    {"/etc/passwd", "etc/passwd", "etc/passwd", nil}, // absolute paths are relative to the root
+    {"new/file", "new/file", "new/file", nil},
+    {"link/x", "a/x", "link/x", nil}, // locked where it leads
+    {"link", "a", "link", nil},
+    {"link/new", "a/new", "link/new", nil},
+    {"..", "", "", ErrPathEscapesRoot},
+    {"../etc/passwd", "", "", ErrPathEscapesRoot},
+    {"a/../a/x", "", "", ErrPathEscapesRoot}, // even when it stays inside
+    {"a/..", "", "", ErrPathEscapesRoot},
+    {"a\x00/x", "", "", ErrPathEscapesRoot},
+    {"out/passwd", "", "", ErrPathEscapesRoot},
+    {"out", "", "", ErrPathEscapesRoot},
+    {"dangling", "", "", ErrPathEscapesRoot},
+    {"dangling/file", "", "", ErrPathEscapesRoot},
+  }
+  for _, test := range tests {
+    lockPath, filePath, err := resolvePath(rootDir, test.relPath, true)
+    if test.err != nil {
+      if !errors.Is(err, test.err) {
+        t.Errorf("resolvePath(%q): expected %v, got %q, %q, %v", test.relPath, test.err, lockPath, filePath, err)
+      }
+      continue
+    }
+    if err != nil || lockPath != test.lockPath || filePath != rootDir + test.filePath {
+      t.Errorf("resolvePath(%q) = %q, %q, %v, want %q, %q", test.relPath, lockPath, filePath, err, test.lockPath, rootDir + test.filePath)
+    }
+  }
+
+  for _, relPath := range []string{"link", "link/x", "out/passwd"} {
+    if _, _, err := resolvePath(rootDir, relPath, false); !errors.Is(err, ErrSymlinkForbidden) {
+      t.Errorf("resolvePath(%q) without following symlinks: expected ErrSymlinkForbidden, got %v", relPath, err)
+    }
+  }
+  if _, _, err := resolvePath(rootDir, "a/x", false); err != nil {
+    t.Errorf("resolvePath(a/x) without following symlinks: %v", err)
+  }
+}
+
+func multipartRequest(t *testing.T, target string, fieldName string) *http.Request {
+  var body bytes.Buffer
+  form := multipart.NewWriter(&body)
+  part, err := form.CreateFormFile(fieldName, "upload.txt")
+  if err != nil {
+    t.Fatal(err)
+  }
+  part.Write([]byte("pwned"))
+  form.Close()
+  request := httptest.NewRequest(http.MethodPost, target, &body)
+  request.Header.Set("Content-Type", form.FormDataContentType())
+  return request
+}
+
+/*
+ * Every way of naming something outside the root gets a 403 and changes
+ * nothing.
+ */
+func TestHandleRefusesEscapingPaths(t *testing.T) {
+  rootDir, outside := makeSymlinkTree(t)
+  pfs, err := MakeParentFileServer(rootDir, "/files/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+
+  requests := map[string]func() *http.Request{
+    "GET ..": func() *http.Request { return httptest.NewRequest(http.MethodGet, "/files/../etc/passwd", nil) },
+    "GET %2e%2e": func() *http.Request { return httptest.NewRequest(http.MethodGet, "/files/%2e%2e/etc/passwd", nil) },
+    "GET %2f": func() *http.Request { return httptest.NewRequest(http.MethodGet, "/files/a/..%2f..%2fetc/passwd", nil) },
+    "GET NUL": func() *http.Request { return httptest.NewRequest(http.MethodGet, "/files/a/x%00.txt", nil) },
+    "GET symlink out": func() *http.Request { return httptest.NewRequest(http.MethodGet, "/files/out/passwd", nil) },
+    "GET dangling": func() *http.Request { return httptest.NewRequest(http.MethodGet, "/files/dangling", nil) },
+    "PUT symlink out": func() *http.Request { return httptest.NewRequest(http.MethodPut, "/files/out/passwd", strings.NewReader("pwned")) },
+    "PUT dangling": func() *http.Request { return httptest.NewRequest(http.MethodPut, "/files/dangling", strings.NewReader("pwned")) },
+    "PUT %2e%2e": func() *http.Request { return httptest.NewRequest(http.MethodPut, "/files/%2e%2e/pwned", strings.NewReader("pwned")) },
+    "DELETE symlink out": func() *http.Request { return httptest.NewRequest(http.MethodDelete, "/files/out/passwd", nil) },
+    "DELETE ..": func() *http.Request { return httptest.NewRequest(http.MethodDelete, "/files/a/../../" + filepath.Base(outside), nil) },
+    "PATCH absolute otherPath": func() *http.Request {
+      return httptest.NewRequest(http.MethodPatch, "/files/a/x", strings.NewReader(`{"command": "cp", "otherPath": "` + outside + `/copy"}`))
+    },
+    "PATCH .. otherPath": func() *http.Request {
+      return httptest.NewRequest(http.MethodPatch, "/files/a/x", strings.NewReader(`{"command": "mv", "otherPath": "/files/../moved"}`))
+    },
+    "PATCH symlink otherPath": func() *http.Request {
+      return httptest.NewRequest(http.MethodPatch, "/files/a/x", strings.NewReader(`{"command": "cp", "otherPath": "/files/out/copy"}`))
+    },
+    "POST .. field": func() *http.Request { return multipartRequest(t, "/files/a", "../../pwned") },
+    "POST symlink field": func() *http.Request { return multipartRequest(t, "/files/a", "../out/pwned") },
+    "POST into symlink out": func() *http.Request { return multipartRequest(t, "/files/out", "pwned") },
+  }
+  for name, makeRequest := range requests {
+    recorder := httptest.NewRecorder()
+    pfs.NewRoutine().Handle(recorder, makeRequest())
+    if recorder.Code != 403 {
+      t.Errorf("%s: expected 403, got %d %s", name, recorder.Code, recorder.Body)
+    }
+  }
+
+  entries, _ := os.ReadDir(outside + "/secret")
+  if len(entries) != 1 {
+    t.Errorf("something was written outside the root: %v", entries)
+  }
+  if data, _ := os.ReadFile(outside + "/secret/passwd"); string(data) != "data" {
+    t.Errorf("a file outside the root changed: %q", data)
+  }
+  if _, err := os.Stat(outside); err != nil {
+    t.Errorf("a directory outside the root was deleted: %v", err)
+  }
+}
+
+/*
+ * A symlink and its target are the same path to the scheduler, whether they
+ * are locked through Handle() or the ChildFileServer methods.
+ */
+func TestHandleLocksSymlinkTargets(t *testing.T) {
+  tests := []struct {
+    name string
+    held string // locked with Lock() while `operation` runs
+    operation func(pfs *ParentFileServer) error
+    written string // the file `operation` writes, relative to the root
+  }{
+    {"PUT link/new while a is locked", "a", func(pfs *ParentFileServer) error {
+      recorder := httptest.NewRecorder()
+      pfs.NewRoutine().Handle(recorder, httptest.NewRequest(http.MethodPut, "/files/link/new", strings.NewReader("new")))
+      if recorder.Code != 200 {
+        return fmt.Errorf("%d %s", recorder.Code, recorder.Body)
+      }
+      return nil
+    }, "a/new"},
+    {"PUT a/new while link is locked", "link", func(pfs *ParentFileServer) error {
+      recorder := httptest.NewRecorder()
+      pfs.NewRoutine().Handle(recorder, httptest.NewRequest(http.MethodPut, "/files/a/new", strings.NewReader("new")))
+      if recorder.Code != 200 {
+        return fmt.Errorf("%d %s", recorder.Code, recorder.Body)
+      }
+      return nil
+    }, "a/new"},
+    {"CopyFile to link/new while a/new is locked", "a/new", func(pfs *ParentFileServer) error {
+      return pfs.NewRoutine().CopyFile("a/x", "link/new")
+    }, "a/new"},
+    {"CopyFile to a/new while link is locked", "link", func(pfs *ParentFileServer) error {
+      return pfs.NewRoutine().CopyFile("a/x", "a/new")
+    }, "a/new"},
+  }
+  for _, test := range tests {
+    rootDir, _ := makeSymlinkTree(t)
+    pfs, err := MakeParentFileServer(rootDir, "/files/")
+    if err != nil {
+      t.Fatal(err)
+    }
+    holder := pfs.NewRoutine()
+    if err := holder.Lock([]string{test.held}); err != nil {
+      t.Fatal(err)
+    }
+    done := make(chan error, 1)
+    go func() {
+      done <- test.operation(pfs)
+    }()
+    select {
+    case err := <- done:
+      t.Fatalf("%s: finished (%v) while %s was locked", test.name, err, test.held)
+    case <- time.After(100 * time.Millisecond):
+    }
+    holder.Unlock([]string{test.held})
+    select {
+    case err := <- done:
+      if err != nil {
+        t.Fatalf("%s: %v", test.name, err)
+      }
+    case <- time.After(5 * time.Second):
+      t.Fatalf("%s: never finished", test.name)
+    }
+    if _, err := os.Stat(rootDir + test.written); err != nil {
+      t.Errorf("%s: %v", test.name, err)
+    }
+    pfs.Close(context.Background())
+  }
+}
@@ -1,120 +1,123 @@
 package fileServer
 
 import (
-  // "errors"
+  "context"
   "log"
+  "net/http"
+  "sync/atomic"
   "time"
+
+  "github.com/Thomas-Redding/go_util/lockManager"
+  "github.com/Thomas-Redding/go_util/metrics"
 )
 
 /*
- * Scheduler supports recursive locks, but every lock must be matched by an unlock.
+ * Scheduler is a wrapper around a reentrant lockManager.Manager, so it
+ * supports recursive locks, but every lock must be matched by an unlock.
+ *
+ * A path is available to a routine if neither it, nor any of its ancestors,
+ * nor any of its descendants is locked by a different routine. A routine may
+ * lock a path it (or an ancestor of which it) already holds; such locks nest
+ * and each must be released with its own call to Done() or DoneAll(). Nested
+ * locks are granted at once, with any variant, even if other routines are
+ * waiting for the path.
+ *
+ * The "Shared" variants lock paths for reading only. Any number of routines
+ * may share a path, but a routine holding (or waiting for) an exclusive lock
+ * on the path, one of its ancestors or one of its descendants excludes them.
+ *
+ * The "Context" variants give up once their context is done, removing their
+ * task from the queue and returning a *LockError.
+ *
+ * Because routines may hold some paths while waiting for others, routines can
+ * deadlock (e.g. A holds "x" and waits for "y" while B holds "y" and waits for
+ * "x"). Whenever a task is enqueued, the scheduler looks for a cycle in the
+ * graph of which routines wait for which. If it finds one, the most recently
+ * enqueued task in the cycle is refused with a *LockError wrapping ErrDeadlock.
+ *
+ * Tasks are granted in priority order, except that a task may skip ahead of
+ * higher-priority tasks that are waiting as long as it doesn't need any of the
+ * paths they are waiting for.
+ */
+
+/********** Errors **********/
+
+// Wrapped by the *LockError returned to a routine refused to break a deadlock.
+var ErrDeadlock = lockManager.ErrDeadlock
+
+// Wrapped by the *LockError returned for a path that climbs above the root.
+var ErrInvalidPath = lockManager.ErrInvalidPath
+
+// Wrapped by the *LockError returned once the scheduler is closing.
+var ErrClosed = lockManager.ErrClosed
+
+// Wrapped by the *LockError returned by Upgrade() or Downgrade() when the
+// routine doesn't hold the paths in the mode it is converting from.
+var ErrNotHeld = lockManager.ErrNotHeld
+
+// Wrapped by the *LockError returned by Upgrade() when a different routine is
+// already waiting to upgrade an overlapping path.
+var ErrUpgradeConflict = lockManager.ErrUpgradeConflict
+
+// Returned by Lease.Renew() once the lease has expired or been released.
+var ErrLeaseExpired = lockManager.ErrLeaseExpired
+
+/*
+ * Returned when paths could not be locked. `Err` is ErrDeadlock,
+ * ErrInvalidPath, ErrClosed, ErrNotHeld, ErrUpgradeConflict, context.Canceled
+ * or context.DeadlineExceeded. For deadlocks, `Paths` are the contested paths.
  */
+type LockError = lockManager.LockError
+
+/********** Types **********/
+
+type PriorityClass = lockManager.PriorityClass
+
+const (
+  PriorityUrgent = lockManager.PriorityUrgent
+  PriorityNormal = lockManager.PriorityNormal
+  PriorityBackground = lockManager.PriorityBackground
+)
+
+/*
+ * A lock that is released automatically unless it is renewed at least once
+ * every `ttl`. ChildFileServer uses these for uploads so that a client which
+ * stops sending data doesn't keep paths locked forever.
+ */
+type Lease = lockManager.Lease
+
+type Snapshot = lockManager.Snapshot
+type HeldLock = lockManager.HeldLock
+type Waiter = lockManager.Waiter
+type LockMode = lockManager.LockMode
+
+const (
+  ModeExclusive = lockManager.ModeExclusive
+  ModeShared = lockManager.ModeShared
+)
 
 /********** Scheduler **********/
 
+/*
+ * Everything a Scheduler refers to lives behind pointers, so copies of it (e.g.
+ * the value returned by MakeScheduler()) share the same locks and logging level.
+ */
 type Scheduler struct {
-  fileTrie FileTrie
-  startChannel chan *Task
-  endChannel chan *Task
-  priorityQueue TaskPriorityQueue
-  loggingEnabled uint
+  manager *lockManager.Manager
+  loggingEnabled *uint32 // use atomically
 }
 
 func MakeScheduler() Scheduler {
-  rtn := Scheduler{
-    fileTrie: MakeFileTrie(),
-    startChannel: make(chan *Task, 0),
-    endChannel: make(chan *Task, 0),
-    priorityQueue: makeTaskPriorityQueue(),
-  }
+  return Scheduler{manager: lockManager.MakeManager(true), loggingEnabled: new(uint32)}
+}
 
-  // Add tasks to the priority queue
-  go func() {
-    for task := range rtn.startChannel {
-      rtn.priorityQueue.Push(task)
-    }
-  }()
-  // Add task completions to the priority queue
-  go func() {
-    for task := range rtn.endChannel {
-      rtn.priorityQueue.Push(task)
-    }
-  }()
-  go func() {
-    counter := 0
-    for {
-      counter = (counter + 1) % 1000
-      time.Sleep(time.Millisecond)
-      if rtn.loggingEnabled > 3 {
-        log.Println("Scheduler.go loopA", counter, rtn.priorityQueue.Length(), rtn.fileTrie.Length())
-      }
-      for rtn.priorityQueue.Length() != 0 {
-        task := rtn.priorityQueue.Peek().(*Task)
-        if rtn.loggingEnabled > 2 {
-          log.Println("Scheduler.go loopB", task)
-        }
-        if !task.IsComplete {
-          if rtn.loggingEnabled > 2 {
-            log.Println("Scheduler.go task.IsComplete = false", task)
-          }
-          // Task needs to be done. Attempt to acquire locks.
-          blocked := false
-          for _, path := range task.Paths {
-            isLocked, routineId := rtn.fileTrie.IsPathLocked(path)
-            if isLocked {
-              if routineId == task.RoutineId {
-                if rtn.loggingEnabled > 2 {
-                  log.Println("Scheduler.go Share Lock", path)
-                }
-              } else  {
-                // File is locked by a different routine
-                if rtn.loggingEnabled > 2 {
-                  log.Println("Scheduler.go Locked", path)
-                }
-                blocked = true
-                break
-              }
-            }
-          }
-          if blocked {
-            if counter == 0 {
-              if rtn.loggingEnabled > 2 {
-                log.Println("Scheduler.go blocked")
-              }
-            }
-            break
-          }
-          if rtn.loggingEnabled > 2 {
-            log.Println("Scheduler.go not blocked", task)
-          }
-          for _, path := range task.Paths {
-            if rtn.loggingEnabled > 2 {
-              log.Println("Scheduler.go Add", path)
-            }
-            rtn.fileTrie.Add(path, task.RoutineId)
-          }
-          task.ContinueChannel <- true
-          rtn.priorityQueue.Pop()
-        } else {
-          // Task is done. Release all locks.
-          if rtn.loggingEnabled > 2 {
-            log.Println("Scheduler.go task is done", task)
-          }
-          for _, path := range task.Paths {
-            if rtn.loggingEnabled > 2 {
-              log.Println("Scheduler.go Remove", path)
-            }
-            err := rtn.fileTrie.RemoveWhileExpectingValue(path, task.RoutineId)
-            if err != nil && rtn.loggingEnabled > 2 {
-              log.Println("Scheduler.go Unlocking Problem", err)
-            }
-          }
-          rtn.priorityQueue.Pop()
-        }
-      }
-    }
-  }()
-  return rtn
+/*
+ * Like MakeScheduler(), but returns a pointer, for callers that would rather
+ * not copy the Scheduler around.
+ */
+func NewScheduler() *Scheduler {
+  scheduler := MakeScheduler()
+  return &scheduler
 }
 
 func (scheduler *Scheduler) WaitUntilAvailable(routineId string, path string) bool {
@@ -122,30 +125,104 @@ func (scheduler *Scheduler) WaitUntilAvailable(routineId string, path string) bo
 }
 
 func (scheduler *Scheduler) WaitUntilAllAvailable(routineId string, paths []string) bool {
-  return true/*
-  if scheduler.loggingEnabled > 1 {
+  if scheduler.logging() > 1 {
     log.Println("Scheduler.go WaitUntilAllAvailable", paths)
   }
-  task := MakeTask(routineId, paths, time.Now().UnixNano(), false)
-  scheduler.startChannel <- task
-  shouldContinue := <- task.ContinueChannel
-  return shouldContinue*/
+  return scheduler.wait(context.Background(), routineId, paths, PriorityNormal, false) == nil
 }
 
+/*
+ * Like WaitUntilAllAvailable(), but the task is in the PriorityUrgent class, so
+ * it jumps ahead of tasks enqueued normally. Use this for nested locks so that a routine which already holds
+ * paths isn't stuck behind tasks waiting on those same paths.
+ */
 func (scheduler *Scheduler) WaitUntilAllAvailableUrgent(routineId string, paths []string) error {
-  /*
-  if scheduler.loggingEnabled > 1 {
+  if scheduler.logging() > 1 {
     log.Println("Scheduler.go WaitUntilAllAvailableUrgent", paths)
   }
-  task := MakeTask(routineId, paths, time.Now().UnixNano() / 2, false)
-  scheduler.startChannel <- task
-  shouldContinue := <- task.ContinueChannel
-  if shouldContinue {
-    return nil
-  } else {
-    return errors.New("Something went wrong")
-  }*/
-  return nil
+  return scheduler.wait(context.Background(), routineId, paths, PriorityUrgent, false)
+}
+
+func (scheduler *Scheduler) WaitUntilAllAvailableContext(ctx context.Context, routineId string, paths []string) error {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go WaitUntilAllAvailableContext", paths)
+  }
+  return scheduler.wait(ctx, routineId, paths, PriorityNormal, false)
+}
+
+/*
+ * Like WaitUntilAllAvailableContext(), but the paths are released
+ * automatically unless the lease is renewed at least once every `ttl`.
+ * Release them with Lease.Release() rather than DoneAll().
+ */
+func (scheduler *Scheduler) WaitUntilAllAvailableWithLease(ctx context.Context, routineId string, paths []string, ttl time.Duration) (*Lease, error) {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go WaitUntilAllAvailableWithLease", paths, ttl)
+  }
+  return scheduler.manager.AcquireWithLease(ctx, routineId, paths, false, PriorityNormal, ttl)
+}
+
+/*
+ * Registers a function to call (from the scheduling routine) whenever a lease
+ * expires. It must not block.
+ */
+func (scheduler *Scheduler) OnLeaseExpired(observer func(lease *Lease)) {
+  scheduler.manager.OnLeaseExpired(observer)
+}
+
+/*
+ * Reports wait times, hold times, queue depth and grant/deny counts to the
+ * recorder, e.g. a metrics.Registry. Pass metrics.Discard to stop reporting.
+ */
+func (scheduler *Scheduler) SetMetrics(recorder metrics.Recorder) {
+  scheduler.manager.SetMetrics(recorder)
+}
+
+func (scheduler *Scheduler) WaitUntilAvailableShared(routineId string, path string) bool {
+  return scheduler.WaitUntilAllAvailableShared(routineId, []string{path})
+}
+
+func (scheduler *Scheduler) WaitUntilAllAvailableShared(routineId string, paths []string) bool {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go WaitUntilAllAvailableShared", paths)
+  }
+  return scheduler.wait(context.Background(), routineId, paths, PriorityNormal, true) == nil
+}
+
+func (scheduler *Scheduler) WaitUntilAllAvailableSharedUrgent(routineId string, paths []string) error {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go WaitUntilAllAvailableSharedUrgent", paths)
+  }
+  return scheduler.wait(context.Background(), routineId, paths, PriorityUrgent, true)
+}
+
+func (scheduler *Scheduler) WaitUntilAllAvailableSharedContext(ctx context.Context, routineId string, paths []string) error {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go WaitUntilAllAvailableSharedContext", paths)
+  }
+  return scheduler.wait(ctx, routineId, paths, PriorityNormal, true)
+}
+
+/*
+ * Atomically converts one of the routine's shared locks on each of the paths
+ * into an exclusive lock. See lockManager.Manager.Upgrade().
+ */
+func (scheduler *Scheduler) Upgrade(ctx context.Context, routineId string, paths []string) error {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go Upgrade", paths)
+  }
+  return scheduler.manager.Upgrade(ctx, routineId, paths)
+}
+
+/*
+ * Atomically converts one of the routine's exclusive locks on each of the
+ * paths into a shared lock.
+ */
+func (scheduler *Scheduler) Downgrade(routineId string, paths []string) error {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go Downgrade", paths)
+  }
+  return scheduler.manager.Downgrade(routineId, paths)
 }
 
 func (scheduler *Scheduler) Done(routineId string, path string) {
@@ -153,11 +230,92 @@ func (scheduler *Scheduler) Done(routineId string, path string) {
 }
 
 func (scheduler *Scheduler) DoneAll(routineId string, paths []string) {
-  /*
-  if scheduler.loggingEnabled > 1 {
+  if scheduler.logging() > 1 {
     log.Println("Scheduler.go DoneAll", paths)
   }
-  task := MakeTask(routineId, paths, -1, true)
-  task.IsComplete = true
-  scheduler.endChannel <- task*/
+  scheduler.manager.Release(routineId, paths, false)
+}
+
+func (scheduler *Scheduler) DoneShared(routineId string, path string) {
+  scheduler.DoneAllShared(routineId, []string{path})
+}
+
+func (scheduler *Scheduler) DoneAllShared(routineId string, paths []string) {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go DoneAllShared", paths)
+  }
+  scheduler.manager.Release(routineId, paths, true)
+}
+
+/*
+ * Stops accepting tasks, waits for every held path to be released and then
+ * stops the scheduling routine. See lockManager.Manager.Close().
+ */
+func (scheduler *Scheduler) Close(ctx context.Context) error {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go Close")
+  }
+  return scheduler.manager.Close(ctx)
+}
+
+/*
+ * Returns true once Close() has been called.
+ */
+func (scheduler *Scheduler) Closing() bool {
+  return scheduler.manager.Closing()
+}
+
+/*
+ * Makes every lock also exclude other processes using the same lock
+ * directory. See lockManager.ProcessLocks.
+ */
+func (scheduler *Scheduler) EnableProcessLocks(lockDir string) error {
+  if scheduler.logging() > 1 {
+    log.Println("Scheduler.go EnableProcessLocks", lockDir)
+  }
+  processLocks, err := lockManager.OpenProcessLocks(lockDir)
+  if err != nil {
+    return err
+  }
+  scheduler.manager.SetProcessLocks(processLocks)
+  return nil
+}
+
+/*
+ * Sets whether Close() still grants tasks that are already queued. Defaults to
+ * false.
+ */
+func (scheduler *Scheduler) SetDrainOnClose(drainOnClose bool) {
+  scheduler.manager.SetDrainOnClose(drainOnClose)
+}
+
+/*
+ * Returns the locks currently held and the tasks waiting for them.
+ */
+func (scheduler *Scheduler) Snapshot() Snapshot {
+  return scheduler.manager.Snapshot()
+}
+
+/*
+ * Returns a handler that responds to every request with Snapshot() as JSON.
+ */
+func (scheduler *Scheduler) SnapshotHandler() http.Handler {
+  return scheduler.manager.SnapshotHandler()
+}
+
+// 0 = none
+// 1 = API calls
+// 2 = info logs
+// 3 = debug logs
+func (scheduler *Scheduler) SetLoggingEnabled(loggingEnabled uint) {
+  atomic.StoreUint32(scheduler.loggingEnabled, uint32(loggingEnabled))
+  scheduler.manager.SetLoggingEnabled(loggingEnabled)
+}
+
+func (scheduler *Scheduler) logging() uint32 {
+  return atomic.LoadUint32(scheduler.loggingEnabled)
+}
+
+func (scheduler *Scheduler) wait(ctx context.Context, routineId string, paths []string, class PriorityClass, shared bool) error {
+  return scheduler.manager.Acquire(ctx, routineId, paths, shared, class)
 }
@@ -0,0 +1,281 @@
+package fileServer
+
+import (
+  "context"
+  "fmt"
+  "math/rand"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Paths that overlap in every way: the same file, parent/child and siblings.
+var contendedPaths = []string{"a", "a/b", "a/b/c", "a/b/d", "a/e", "f", "f/g"}
+
+/*
+ * Records who holds which paths, and fails the test if two holders ever
+ * overlap. It checks overlap itself rather than trusting lockManager.
+ */
+type holders struct {
+  t *testing.T
+  mu sync.Mutex
+  held map[string][]string // routine ID -> paths
+}
+
+func (h *holders) enter(routineId string, paths []string) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for otherId, otherPaths := range h.held {
+    for _, path := range paths {
+      for _, otherPath := range otherPaths {
+        if overlaps(path, otherPath) {
+          h.t.Errorf("%s holds %q while %s holds %q", routineId, path, otherId, otherPath)
+        }
+      }
+    }
+  }
+  h.held[routineId] = paths
+}
+
+func (h *holders) exit(routineId string) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  delete(h.held, routineId)
+}
+
+func overlaps(a string, b string) bool {
+  return a == b || strings.HasPrefix(a, b + "/") || strings.HasPrefix(b, a + "/")
+}
+
+/*
+ * Pretends to PUT, DELETE and mv contended paths from many goroutines and
+ * checks that no two writers ever hold overlapping paths.
+ */
+func TestSchedulerExcludesOverlappingWriters(t *testing.T) {
+  scheduler := MakeScheduler()
+  defer scheduler.Close(context.Background())
+  h := &holders{t: t, held: make(map[string][]string)}
+  var wg sync.WaitGroup
+  for i := 0; i < 32; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      random := rand.New(rand.NewSource(int64(i)))
+      for j := 0; j < 50; j++ {
+        routineId := fmt.Sprintf("%d-%d", i, j)
+        paths := []string{contendedPaths[random.Intn(len(contendedPaths))]}
+        if random.Intn(3) == 0 {
+          // mv
+          paths = append(paths, contendedPaths[random.Intn(len(contendedPaths))])
+        }
+        if err := scheduler.WaitUntilAllAvailableContext(context.Background(), routineId, paths); err != nil {
+          t.Errorf("%s: %v", routineId, err)
+          return
+        }
+        h.enter(routineId, paths)
+        time.Sleep(time.Duration(random.Intn(100)) * time.Microsecond)
+        h.exit(routineId)
+        scheduler.DoneAll(routineId, paths)
+      }
+    }(i)
+  }
+  waitOrFail(t, &wg, 30 * time.Second)
+  if snapshot := scheduler.Snapshot(); len(snapshot.Held) != 0 || len(snapshot.Waiting) != 0 {
+    t.Errorf("locks left behind: %+v", snapshot)
+  }
+}
+
+/*
+ * Sends PUT, DELETE and mv requests for contended paths to Handle() from many
+ * goroutines and checks that every one of them finishes.
+ */
+func TestHandleFinishesConcurrentWrites(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  pfs, err := MakeParentFileServer(rootDir, "/files/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    pfs.NewRoutine().Handle(writer, request)
+  }))
+  defer server.Close()
+
+  var wg sync.WaitGroup
+  for i := 0; i < 16; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      random := rand.New(rand.NewSource(int64(i)))
+      for j := 0; j < 20; j++ {
+        path := contendedPaths[random.Intn(len(contendedPaths))]
+        var request *http.Request
+        switch random.Intn(3) {
+        case 0:
+          os.MkdirAll(rootDir + path[:strings.LastIndex("/" + path, "/")], 0755)
+          request, _ = http.NewRequest(http.MethodPut, server.URL + "/files/" + path, strings.NewReader("data"))
+        case 1:
+          request, _ = http.NewRequest(http.MethodDelete, server.URL + "/files/" + path, nil)
+        case 2:
+          otherPath := contendedPaths[random.Intn(len(contendedPaths))]
+          body := fmt.Sprintf(`{"command": "mv", "otherPath": "/files/%s"}`, otherPath)
+          request, _ = http.NewRequest(http.MethodPatch, server.URL + "/files/" + path, strings.NewReader(body))
+        }
+        response, err := http.DefaultClient.Do(request)
+        if err != nil {
+          t.Errorf("%s %s: %v", request.Method, path, err)
+          return
+        }
+        response.Body.Close()
+        // Requests may fail (e.g. moving a missing file), but never because
+        // of locking.
+        if response.StatusCode == 503 {
+          t.Errorf("%s %s: %d", request.Method, path, response.StatusCode)
+        }
+      }
+    }(i)
+  }
+  waitOrFail(t, &wg, 60 * time.Second)
+  if snapshot := pfs.scheduler.Snapshot(); len(snapshot.Held) != 0 || len(snapshot.Waiting) != 0 {
+    t.Errorf("locks left behind: %+v", snapshot)
+  }
+}
+
+func waitOrFail(t *testing.T, wg *sync.WaitGroup, timeout time.Duration) {
+  done := make(chan bool)
+  go func() {
+    wg.Wait()
+    close(done)
+  }()
+  select {
+  case <- done:
+  case <- time.After(timeout):
+    t.Fatalf("requests still running after %v", timeout)
+  }
+}
+
+func waitForWaiting(t *testing.T, scheduler *Scheduler, n int) {
+  deadline := time.Now().Add(5 * time.Second)
+  for len(scheduler.Snapshot().Waiting) < n {
+    if time.Now().After(deadline) {
+      t.Fatalf("expected %d waiting tasks, got %+v", n, scheduler.Snapshot())
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+/*
+ * A routine that holds a path may lock it again with any variant while
+ * another routine waits for it.
+ */
+func TestSchedulerNestsNormalLocks(t *testing.T) {
+  scheduler := NewScheduler()
+  defer scheduler.Close(context.Background())
+  scheduler.WaitUntilAllAvailable("A", []string{"a"})
+  resultB := make(chan bool, 1)
+  go func() {
+    resultB <- scheduler.WaitUntilAllAvailable("B", []string{"a"})
+  }()
+  waitForWaiting(t, scheduler, 1)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+  defer cancel()
+  if !scheduler.WaitUntilAllAvailable("A", []string{"a"}) {
+    t.Fatal("nested WaitUntilAllAvailable failed")
+  }
+  if err := scheduler.WaitUntilAllAvailableContext(ctx, "A", []string{"a/b"}); err != nil {
+    t.Fatalf("nested WaitUntilAllAvailableContext: %v", err)
+  }
+  if !scheduler.WaitUntilAllAvailableShared("A", []string{"a/c"}) {
+    t.Fatal("nested WaitUntilAllAvailableShared failed")
+  }
+  scheduler.DoneAllShared("A", []string{"a/c"})
+  scheduler.DoneAll("A", []string{"a/b"})
+  scheduler.DoneAll("A", []string{"a"})
+  select {
+  case ok := <- resultB:
+    t.Fatalf("B got a while A held it: %v", ok)
+  default:
+  }
+  scheduler.DoneAll("A", []string{"a"})
+  select {
+  case ok := <- resultB:
+    if !ok {
+      t.Fatal("B failed to lock a")
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("B never got a")
+  }
+  scheduler.DoneAll("B", []string{"a"})
+}
+
+/*
+ * A routine that Lock()s a path may Handle() a request for it while another
+ * routine waits for the path.
+ */
+func TestHandleNestsInsideLock(t *testing.T) {
+  rootDir := t.TempDir() + "/"
+  if err := os.Mkdir(rootDir + "a", 0755); err != nil {
+    t.Fatal(err)
+  }
+  pfs, err := MakeParentFileServer(rootDir, "/files/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pfs.Close(context.Background())
+  cfs := pfs.NewRoutine()
+  if err := cfs.Lock([]string{"a"}); err != nil {
+    t.Fatal(err)
+  }
+  otherCfs := pfs.NewRoutine()
+  other := make(chan error, 1)
+  go func() {
+    other <- otherCfs.Lock([]string{"a"})
+  }()
+  waitForWaiting(t, pfs.scheduler, 1)
+
+  recorder := httptest.NewRecorder()
+  cfs.Handle(recorder, httptest.NewRequest(http.MethodPut, "/files/a/new", strings.NewReader("data")))
+  if recorder.Code != 200 {
+    t.Fatalf("PUT inside Lock(): %d %s", recorder.Code, recorder.Body)
+  }
+  cfs.Unlock([]string{"a"})
+  select {
+  case err := <- other:
+    if err != nil {
+      t.Fatal(err)
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("the other routine never got a")
+  }
+  otherCfs.Unlock([]string{"a"})
+}
+
+/*
+ * MakeScheduler() returns a value, and copies of it share the same locks.
+ */
+func TestSchedulerCopiesShareLocks(t *testing.T) {
+  var scheduler Scheduler = MakeScheduler()
+  defer scheduler.Close(context.Background())
+  schedulerCopy := scheduler
+  schedulerCopy.WaitUntilAvailable("A", "a")
+  resultB := make(chan bool, 1)
+  go func() {
+    resultB <- scheduler.WaitUntilAvailable("B", "a/b")
+  }()
+  waitForWaiting(t, &scheduler, 1)
+  schedulerCopy.Done("A", "a")
+  select {
+  case ok := <- resultB:
+    if !ok {
+      t.Fatal("B failed")
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("B wasn't granted after the copy released a")
+  }
+  scheduler.Done("B", "a/b")
+}
@@ -0,0 +1,93 @@
+package fileServer
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+)
+
+func makeWriteModeServer(t *testing.T, writeMode WriteMode) (*ParentFileServer, string) {
+  rootDir := t.TempDir() + "/"
+  if err := os.WriteFile(rootDir + "a.txt", []byte("old"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  pfs, err := MakeParentFileServer(rootDir, "/files/")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { pfs.Close(context.Background()) })
+  pfs.SetWriteMode(writeMode)
+  return pfs, rootDir
+}
+
+func handle(pfs *ParentFileServer, method string, target string, body string) *httptest.ResponseRecorder {
+  recorder := httptest.NewRecorder()
+  pfs.NewRoutine().Handle(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+  return recorder
+}
+
+func TestWriteModes(t *testing.T) {
+  tests := []struct {
+    writeMode WriteMode
+    method string
+    target string
+    body string
+    code int
+  }{
+    {ReadOnly, http.MethodGet, "/files/a.txt", "", 200},
+    {ReadOnly, http.MethodPatch, "/files/a.txt", `{"command": "md5"}`, 200},
+    {ReadOnly, http.MethodPut, "/files/b.txt", "new", 405},
+    {ReadOnly, http.MethodDelete, "/files/a.txt", "", 405},
+    {ReadOnly, http.MethodPatch, "/files/dir", `{"command": "mkdir"}`, 405},
+    {AppendOnly, http.MethodPut, "/files/b.txt", "new", 200},
+    {AppendOnly, http.MethodPut, "/files/a.txt", "new", 409},
+    {AppendOnly, http.MethodPatch, "/files/dir", `{"command": "mkdir"}`, 200},
+    {AppendOnly, http.MethodDelete, "/files/a.txt", "", 405},
+    {AppendOnly, http.MethodDelete, "/files/", "", 405},
+    {AppendOnly, http.MethodPatch, "/files/a.txt", `{"command": "mv", "otherPath": "/files/c.txt"}`, 405},
+  }
+  for _, test := range tests {
+    pfs, rootDir := makeWriteModeServer(t, test.writeMode)
+    recorder := handle(pfs, test.method, test.target, test.body)
+    if recorder.Code != test.code {
+      t.Errorf("%v %s %s %s: got %d %s, want %d", test.writeMode, test.method, test.target, test.body, recorder.Code, recorder.Body, test.code)
+    }
+    if recorder.Code == 405 && len(recorder.Header().Get("Allow")) == 0 {
+      t.Errorf("%v %s %s: a 405 without an Allow header", test.writeMode, test.method, test.target)
+    }
+    if data, _ := os.ReadFile(rootDir + "a.txt"); string(data) != "old" {
+      t.Errorf("%v %s %s: a.txt = %q, want it unchanged", test.writeMode, test.method, test.target, data)
+    }
+  }
+}
+
+func TestDeleteRoot(t *testing.T) {
+  pfs, rootDir := makeWriteModeServer(t, ReadWrite)
+  pfs.SetRootDeletable(false)
+  if recorder := handle(pfs, http.MethodDelete, "/files/", ""); recorder.Code != 405 {
+    t.Errorf("DELETE of the root: got %d %s, want 405", recorder.Code, recorder.Body)
+  }
+  if _, err := os.Stat(rootDir + "a.txt"); err != nil {
+    t.Errorf("a refused DELETE of the root deleted a.txt: %v", err)
+  }
+  if recorder := handle(pfs, http.MethodPatch, "/files/", `{"command": "mv", "otherPath": "/files/moved"}`); recorder.Code != 405 {
+    t.Errorf("mv of the root: got %d %s, want 405", recorder.Code, recorder.Body)
+  }
+  if _, err := os.Stat(rootDir + "a.txt"); err != nil {
+    t.Errorf("a refused mv of the root moved a.txt: %v", err)
+  }
+  if recorder := handle(pfs, http.MethodDelete, "/files/a.txt", ""); recorder.Code != 200 {
+    t.Errorf("DELETE a.txt: got %d %s", recorder.Code, recorder.Body)
+  }
+
+  pfs.SetRootDeletable(true)
+  if recorder := handle(pfs, http.MethodDelete, "/files/", ""); recorder.Code != 200 {
+    t.Errorf("DELETE of a deletable root: got %d %s", recorder.Code, recorder.Body)
+  }
+  if entries, err := os.ReadDir(rootDir); err != nil || len(entries) != 0 {
+    t.Errorf("expected an empty root, got %v, %v", entries, err)
+  }
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package lockManager
+
+import (
+  "os"
+  "syscall"
+)
+
+/*
+ * Takes an advisory lock on the file. If `block` is false and another open
+ * file holds a conflicting lock, returns false instead of waiting.
+ */
+func flock(file *os.File, exclusive bool, block bool) (bool, error) {
+  how := syscall.LOCK_SH
+  if exclusive {
+    how = syscall.LOCK_EX
+  }
+  if !block {
+    how |= syscall.LOCK_NB
+  }
+  for {
+    err := syscall.Flock(int(file.Fd()), how)
+    if err == syscall.EINTR {
+      continue
+    }
+    if err == syscall.EWOULDBLOCK {
+      return false, nil
+    }
+    return err == nil, err
+  }
+}
+
+func funlock(file *os.File) error {
+  return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package lockManager
+
+import (
+  "os"
+)
+
+func flock(file *os.File, exclusive bool, block bool) (bool, error) {
+  return false, ErrProcessLocksUnsupported
+}
+
+func funlock(file *os.File) error {
+  return ErrProcessLocksUnsupported
+}
@@ -0,0 +1,85 @@
+package lockManager
+
+import (
+  "errors"
+  "time"
+)
+
+// Returned by Lease.Renew() once the lease has expired or been released.
+var ErrLeaseExpired = errors.New("Lease.go: Lease has expired or been released.")
+
+/*
+ * A lock that is released automatically unless it is renewed at least once
+ * every `ttl`. This way, paths don't stay locked forever if their holder
+ * crashes, forgets about them or (e.g. for an upload) stops making progress.
+ *
+ *   lease, err := manager.AcquireWithLease(ctx, routineId, []string{"foo"}, false, lockManager.PriorityNormal, 10 * time.Second)
+ *   if err != nil {
+ *     return err
+ *   }
+ *   defer lease.Release()
+ *   for chunk := range chunks {
+ *     if err := lease.Renew(); err != nil {
+ *       return err // We lost the lock.
+ *     }
+ *     write(chunk)
+ *   }
+ */
+type Lease struct {
+  RoutineId string
+  Paths []string
+  Shared bool
+  paths []Path
+  manager *Manager
+  ttl time.Duration
+  expiry time.Time // guarded by manager.mu
+  done chan bool // closed once the lease expires or is released
+}
+
+func makeLease(manager *Manager, routineId string, paths []string, parsed []Path, shared bool, ttl time.Duration) *Lease {
+  return &Lease{
+    RoutineId: routineId,
+    Paths: paths,
+    Shared: shared,
+    paths: parsed,
+    manager: manager,
+    ttl: ttl,
+    expiry: time.Now().Add(ttl),
+    done: make(chan bool),
+  }
+}
+
+/*
+ * Extends the lease so it expires `ttl` from now. Fails with ErrLeaseExpired
+ * if the paths have already been released.
+ */
+func (lease *Lease) Renew() error {
+  lease.manager.mu.Lock()
+  defer lease.manager.mu.Unlock()
+  if !lease.manager.leases[lease] {
+    return ErrLeaseExpired
+  }
+  lease.expiry = time.Now().Add(lease.ttl)
+  return nil
+}
+
+/*
+ * Releases the paths. Returns false if the lease had already expired or been
+ * released, so it is safe to call more than once.
+ */
+func (lease *Lease) Release() bool {
+  lease.manager.mu.Lock()
+  defer lease.manager.mu.Unlock()
+  if !lease.manager.releaseLease(lease) {
+    return false
+  }
+  lease.manager.notify()
+  return true
+}
+
+/*
+ * Returns a channel that is closed once the lease expires or is released.
+ */
+func (lease *Lease) Done() <-chan bool {
+  return lease.done
+}
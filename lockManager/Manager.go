@@ -0,0 +1,1087 @@
+package lockManager
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log"
+  "math"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  "github.com/Thomas-Redding/go_util/metrics"
+)
+
+/*
+ * Manager hands out hierarchical locks on slash-separated paths to routines,
+ * which are identified by strings. fileScheduler.FileScheduler and
+ * fileServer.Scheduler are both thin wrappers around it.
+ *
+ * A path is available to a routine if neither it, nor any of its ancestors,
+ * nor any of its descendants is locked by a different routine. Paths are
+ * canonicalized (see Path), so "foo", "/foo/", "./foo" and "bar/../foo" are
+ * all the same path. Paths that climb above the root are refused with a
+ * *LockError wrapping ErrInvalidPath.
+ *
+ * If the manager is reentrant, a routine may lock a path it (or an ancestor of
+ * which it) already holds; such locks nest and each must be released with its
+ * own call to Release(). Otherwise, such a request fails with ErrReentrant.
+ * Since no other routine can hold anything overlapping a path the routine
+ * already holds, a nested lock is granted at once, in any class, even if other
+ * tasks are waiting for the path.
+ *
+ * Shared locks are for reading only. Any number of routines may share a path,
+ * but a routine holding (or waiting for) an exclusive lock on the path, one of
+ * its ancestors or one of its descendants excludes them. A routine may
+ * Upgrade() its shared locks to exclusive ones without releasing them in
+ * between, and Downgrade() them back.
+ *
+ * Because routines may hold some paths while waiting for others, routines can
+ * deadlock (e.g. A holds "x" and waits for "y" while B holds "y" and waits for
+ * "x"). Whenever a task is enqueued, the manager looks for a cycle in the
+ * graph of which routines wait for which. If it finds one, the most recently
+ * enqueued task in the cycle is refused with a *LockError wrapping ErrDeadlock.
+ *
+ * Tasks are granted by class (urgent, then normal, then background) and then
+ * in the order they arrived, except that a task may skip ahead of tasks that
+ * are waiting as long as it doesn't need any of the paths they are waiting for.
+ *
+ * SetProcessLocks() extends the locks to other processes, so that a path is
+ * only granted once no other process holds it either.
+ *
+ * Close() shuts the manager down. From then on, new tasks are refused with a
+ * *LockError wrapping ErrClosed, but paths that are already held can still be
+ * released.
+ */
+
+/********** Errors **********/
+
+// Returned by TryAcquire() when the paths aren't available.
+var ErrWouldBlock = errors.New("Manager.go: Paths are not available.")
+
+// Wrapped by the *LockError returned to a routine refused to break a deadlock.
+var ErrDeadlock = errors.New("Manager.go: Deadlock")
+
+// Wrapped by the *LockError returned when a non-reentrant manager is asked to
+// lock a path overlapping one the routine already holds.
+var ErrReentrant = errors.New("Manager.go: Routine already holds an overlapping lock.")
+
+// Wrapped by the *LockError returned once the manager is closing.
+var ErrClosed = errors.New("Manager.go: Manager is closed.")
+
+// Wrapped by the *LockError returned by Upgrade() or Downgrade() when the
+// routine doesn't hold the paths in the mode it is converting from.
+var ErrNotHeld = errors.New("Manager.go: Routine doesn't hold the paths in that mode.")
+
+// Wrapped by the *LockError returned by Upgrade() when a different routine is
+// already waiting to upgrade an overlapping path. Both can't succeed, since
+// each would wait for the other to stop reading.
+var ErrUpgradeConflict = errors.New("Manager.go: Another routine is waiting to upgrade an overlapping path.")
+
+/*
+ * Returned when paths could not be locked. `Err` is ErrWouldBlock, ErrDeadlock,
+ * ErrReentrant, ErrInvalidPath, ErrInvalidPattern, ErrClosed, ErrNotHeld, ErrUpgradeConflict,
+ * context.Canceled or context.DeadlineExceeded,
+ * so callers can use errors.Is(). For deadlocks, `Paths` are the contested
+ * paths.
+ */
+type LockError struct {
+  Paths []string
+  Err error
+}
+
+func (err *LockError) Error() string {
+  return fmt.Sprintf("Manager.go: Could not lock %v: %v", err.Paths, err.Err)
+}
+
+func (err *LockError) Unwrap() error {
+  return err.Err
+}
+
+/********** Manager **********/
+
+type Manager struct {
+  trie Trie
+  priorityQueue TaskPriorityQueue
+  mu sync.Mutex // guards everything but loggingEnabled, which is atomic
+  wake chan bool // signalled whenever a task is enqueued or paths are released
+  agingInterval time.Duration // how long a task waits before being promoted a class
+  leases map[*Lease]bool
+  leaseObservers []func(*Lease)
+  metrics metrics.Recorder
+  drainOnClose bool // whether Close() lets queued tasks be granted
+  closing bool // set once Close() is called
+  stopping bool // set once the scheduling routine should exit, drained or not
+  stopped chan bool // closed once the scheduling routine has exited
+  processLocks *ProcessLocks // nil unless locks are shared with other processes
+  loggingEnabled uint32 // use atomically
+}
+
+func MakeManager(reentrant bool) *Manager {
+  rtn := &Manager{
+    trie: MakeTrie(reentrant),
+    priorityQueue: MakeTaskPriorityQueue(),
+    wake: make(chan bool, 1),
+    agingInterval: time.Second,
+    leases: make(map[*Lease]bool),
+    leaseObservers: make([]func(*Lease), 0),
+    metrics: metrics.Discard,
+    stopped: make(chan bool),
+  }
+
+  // Only wake up when something may have changed or a lease may have expired.
+  go func() {
+    counter := 0
+    timer := time.NewTimer(0)
+    for {
+      select {
+      case <- rtn.wake:
+      case <- timer.C:
+      }
+      counter = (counter + 1) % 1000
+      rtn.mu.Lock()
+      if rtn.logging() > 3 {
+        log.Println("Manager.go loopA", counter, rtn.priorityQueue.Length(), rtn.trie.Length())
+      }
+      expired := rtn.reapLeases(time.Now())
+      rtn.schedule(counter)
+      timer.Stop()
+      timer = rtn.leaseTimer()
+      observers := rtn.leaseObservers
+      stop := rtn.stopping || (rtn.closing && rtn.priorityQueue.Length() == 0 && rtn.trie.NumLockedPaths() == 0)
+      rtn.mu.Unlock()
+      for _, lease := range expired {
+        for _, observer := range observers {
+          observer(lease)
+        }
+      }
+      if stop {
+        timer.Stop()
+        close(rtn.stopped)
+        return
+      }
+    }
+  }()
+  return rtn
+}
+
+/*
+ * Waits until the routine holds the paths or the context is done. On failure,
+ * nothing is left in the queue and a *LockError is returned.
+ */
+func (manager *Manager) Acquire(ctx context.Context, routineId string, paths []string, shared bool, class PriorityClass) error {
+  if manager.logging() > 1 {
+    log.Println("Manager.go Acquire", routineId, paths, shared, class)
+  }
+  parsed, err := ParsePaths(paths)
+  if err != nil {
+    return &LockError{Paths: paths, Err: err}
+  }
+  return manager.acquire(ctx, routineId, parsed, shared, class)
+}
+
+/*
+ * Like Acquire(), but each pattern's components are path.Match() patterns
+ * (see ParsePattern()), e.g. "configs/*.json". The patterns conflict with
+ * locks on every path they match, those paths' ancestors and descendants, and
+ * with overlapping patterns. Release them with ReleasePatterns().
+ */
+func (manager *Manager) AcquirePatterns(ctx context.Context, routineId string, patterns []string, shared bool, class PriorityClass) error {
+  if manager.logging() > 1 {
+    log.Println("Manager.go AcquirePatterns", routineId, patterns, shared, class)
+  }
+  parsed, err := ParsePatterns(patterns)
+  if err != nil {
+    return &LockError{Paths: patterns, Err: err}
+  }
+  return manager.acquire(ctx, routineId, parsed, shared, class)
+}
+
+/*
+ * Atomically converts one of the routine's shared locks on each of the paths
+ * into an exclusive lock, waiting until no other routine holds them. The
+ * routine keeps reading the paths throughout, and new readers wait behind the
+ * upgrade. Release the paths as exclusive locks afterwards.
+ *
+ * Fails straight away with ErrNotHeld if the routine doesn't share every path
+ * or with ErrUpgradeConflict if a different routine is already waiting to
+ * upgrade an overlapping path (in which case, release your shared locks so it
+ * can proceed). If the context is done first, the routine is left with its
+ * shared locks. Either way, a *LockError is returned.
+ */
+func (manager *Manager) Upgrade(ctx context.Context, routineId string, paths []string) error {
+  if manager.logging() > 1 {
+    log.Println("Manager.go Upgrade", routineId, paths)
+  }
+  parsed, err := ParsePaths(paths)
+  if err != nil {
+    return &LockError{Paths: paths, Err: err}
+  }
+  task := MakeTask(routineId, parsed, time.Now().UnixNano())
+  task.SetClass(PriorityUrgent) // like a nested lock, since the routine already holds the paths
+  task.upgrade = true
+  manager.mu.Lock()
+  if err := manager.admitUpgrade(ctx, task); err != nil {
+    manager.mu.Unlock()
+    return err
+  }
+  return manager.enqueue(ctx, task)
+}
+
+/*
+ * Atomically converts one of the routine's exclusive locks on each of the
+ * paths into a shared lock, letting waiting readers in. Fails with a
+ * *LockError wrapping ErrNotHeld (and changes nothing) if the routine doesn't
+ * exclusively hold every path. With process locks, it also fails (and changes
+ * nothing) if the shared locks can't be recorded for other processes.
+ */
+func (manager *Manager) Downgrade(routineId string, paths []string) error {
+  if manager.logging() > 1 {
+    log.Println("Manager.go Downgrade", routineId, paths)
+  }
+  parsed, err := ParsePaths(paths)
+  if err != nil {
+    return &LockError{Paths: paths, Err: err}
+  }
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  for _, path := range parsed {
+    if holder, ok := manager.trie.Holder(path); !ok || holder != routineId {
+      return &LockError{Paths: paths, Err: ErrNotHeld}
+    }
+  }
+  if manager.processLocks != nil {
+    // Record the shared locks before dropping the exclusive ones, so other
+    // processes are never let in early. No other process can hold the paths
+    // yet, so this can't fail for want of them.
+    ok, err := manager.processLocks.tryAcquire(routineId, parsed, true)
+    if err == nil && !ok {
+      err = ErrWouldBlock
+    }
+    if err == nil {
+      if err = manager.processLocks.release(routineId, parsed, false); err != nil {
+        manager.unlockProcesses(routineId, parsed, true)
+      }
+    }
+    if err != nil {
+      return &LockError{Paths: paths, Err: err}
+    }
+  }
+  for _, path := range parsed {
+    manager.convert(path, routineId, true)
+  }
+  manager.notify()
+  return nil
+}
+
+/*
+ * Locks the paths only if that is possible without waiting, and without
+ * taking paths that tasks which are already waiting need. Otherwise returns a
+ * *LockError wrapping ErrWouldBlock.
+ */
+func (manager *Manager) TryAcquire(routineId string, paths []string, shared bool) error {
+  parsed, err := ParsePaths(paths)
+  if err != nil {
+    return &LockError{Paths: paths, Err: err}
+  }
+  task := MakeTask(routineId, parsed, time.Now().UnixNano())
+  task.Shared = shared
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  if err := manager.admit(context.Background(), task); err != nil {
+    return err
+  }
+  if manager.blocked(task) || (!manager.covered(task) && conflictsWithAny(task, manager.priorityQueue.Sorted())) {
+    manager.deny(task, ErrWouldBlock)
+    return &LockError{Paths: paths, Err: ErrWouldBlock}
+  }
+  manager.grant(task)
+  if manager.processLocks != nil {
+    ok, err := manager.processLocks.tryAcquire(task.RoutineId, task.paths, task.Shared)
+    if !ok || err != nil {
+      manager.release(task)
+      manager.notify()
+      if err == nil {
+        err = ErrWouldBlock
+      }
+      manager.deny(task, err)
+      return &LockError{Paths: paths, Err: err}
+    }
+  }
+  manager.countGranted(task)
+  return nil
+}
+
+/*
+ * Like Acquire(), but the paths are released automatically unless the lease
+ * is renewed at least once every `ttl`. Release them with Lease.Release()
+ * rather than Release().
+ */
+func (manager *Manager) AcquireWithLease(ctx context.Context, routineId string, paths []string, shared bool, class PriorityClass, ttl time.Duration) (*Lease, error) {
+  err := manager.Acquire(ctx, routineId, paths, shared, class)
+  if err != nil {
+    return nil, err
+  }
+  parsed, _ := ParsePaths(paths) // Acquire() already checked them
+  lease := makeLease(manager, routineId, paths, parsed, shared, ttl)
+  manager.mu.Lock()
+  manager.leases[lease] = true
+  manager.mu.Unlock()
+  manager.notify() // so the lease's expiry is scheduled
+  return lease, nil
+}
+
+/*
+ * Releases one of the routine's locks on each of the paths.
+ */
+func (manager *Manager) Release(routineId string, paths []string, shared bool) {
+  if manager.logging() > 1 {
+    log.Println("Manager.go Release", routineId, paths, shared)
+  }
+  parsed, err := ParsePaths(paths)
+  if err != nil {
+    // Nothing can be locked under an invalid path.
+    if manager.logging() > 2 {
+      log.Println("Manager.go Unlocking Problem", err)
+    }
+    return
+  }
+  manager.releasePaths(routineId, parsed, shared)
+}
+
+/*
+ * Releases one of the routine's locks on each of the patterns.
+ */
+func (manager *Manager) ReleasePatterns(routineId string, patterns []string, shared bool) {
+  if manager.logging() > 1 {
+    log.Println("Manager.go ReleasePatterns", routineId, patterns, shared)
+  }
+  parsed, err := ParsePatterns(patterns)
+  if err != nil {
+    if manager.logging() > 2 {
+      log.Println("Manager.go Unlocking Problem", err)
+    }
+    return
+  }
+  manager.releasePaths(routineId, parsed, shared)
+}
+
+/*
+ * Releases every lock the routine holds, including leased ones. Returns false
+ * if it held nothing.
+ */
+func (manager *Manager) ReleaseAll(routineId string) bool {
+  if manager.logging() > 1 {
+    log.Println("Manager.go ReleaseAll", routineId)
+  }
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  for lease := range manager.leases {
+    if lease.RoutineId == routineId {
+      delete(manager.leases, lease)
+      close(lease.done)
+    }
+  }
+  released := manager.trie.RemoveAll(routineId)
+  if manager.processLocks != nil {
+    if err := manager.processLocks.releaseAll(routineId); err != nil && manager.logging() > 2 {
+      log.Println("Manager.go Unlocking Problem", err)
+    }
+  }
+  now := time.Now()
+  for _, lock := range released {
+    path, _ := ParsePath(lock.Path)
+    manager.metrics.ObserveHold(path.Top(), now.Sub(lock.AcquiredAt))
+  }
+  if len(released) == 0 {
+    return false
+  }
+  manager.notify()
+  return true
+}
+
+/*
+ * Stops accepting tasks, waits for every held path to be released and then
+ * stops the scheduling routine. Tasks that are already queued are refused with
+ * ErrClosed, unless SetDrainOnClose(true) was called, in which case they are
+ * still granted (and must be released in turn).
+ *
+ * If the context is done first, every task still queued is refused, the
+ * scheduling routine is stopped anyway (leaving the remaining paths locked and
+ * leases unexpired) and the context's error is returned. Calling Close() again
+ * waits for the same shutdown.
+ */
+func (manager *Manager) Close(ctx context.Context) error {
+  if manager.logging() > 1 {
+    log.Println("Manager.go Close")
+  }
+  manager.mu.Lock()
+  if !manager.closing {
+    manager.closing = true
+    if !manager.drainOnClose {
+      manager.refuseQueued()
+    }
+  }
+  manager.mu.Unlock()
+  manager.notify()
+  select {
+  case <- manager.stopped:
+    manager.closeProcessLocks()
+    return nil
+  case <- ctx.Done():
+  }
+  manager.mu.Lock()
+  manager.stopping = true
+  manager.refuseQueued()
+  manager.mu.Unlock()
+  manager.notify()
+  <- manager.stopped
+  manager.closeProcessLocks()
+  return ctx.Err()
+}
+
+/*
+ * Returns true once Close() has been called.
+ */
+func (manager *Manager) Closing() bool {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  return manager.closing
+}
+
+/*
+ * Makes every lock also exclude other processes using the same lock
+ * directory (see ProcessLocks). Call it before locking anything. The manager
+ * closes them in Close().
+ */
+func (manager *Manager) SetProcessLocks(processLocks *ProcessLocks) {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  manager.processLocks = processLocks
+}
+
+/*
+ * Sets whether Close() lets tasks that are already queued be granted rather
+ * than refusing them. Defaults to false.
+ */
+func (manager *Manager) SetDrainOnClose(drainOnClose bool) {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  manager.drainOnClose = drainOnClose
+}
+
+/*
+ * Registers a function to call (from the scheduling routine) whenever a lease
+ * expires. It must not block.
+ */
+func (manager *Manager) OnLeaseExpired(observer func(lease *Lease)) {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  manager.leaseObservers = append(manager.leaseObservers, observer)
+}
+
+/*
+ * Sets how long a task must wait to be promoted a class (but never past
+ * normal). Zero disables aging. Defaults to a second.
+ */
+func (manager *Manager) SetAgingInterval(agingInterval time.Duration) {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  manager.agingInterval = agingInterval
+}
+
+/*
+ * Reports wait times, hold times, queue depth and grant/deny counts to the
+ * recorder, e.g. a metrics.Registry. Pass metrics.Discard to stop reporting.
+ */
+func (manager *Manager) SetMetrics(recorder metrics.Recorder) {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  manager.metrics = recorder
+}
+
+// 0 = none
+// 1 = API calls
+// 2 = info logs
+// 3 = debug logs
+// 4 = every scheduling pass
+func (manager *Manager) SetLoggingEnabled(loggingEnabled uint) {
+  atomic.StoreUint32(&manager.loggingEnabled, uint32(loggingEnabled))
+}
+
+func (manager *Manager) logging() uint32 {
+  return atomic.LoadUint32(&manager.loggingEnabled)
+}
+
+func (manager *Manager) acquire(ctx context.Context, routineId string, paths []Path, shared bool, class PriorityClass) error {
+  task := MakeTask(routineId, paths, time.Now().UnixNano())
+  task.Shared = shared
+  task.SetClass(class)
+  manager.mu.Lock()
+  if err := manager.admit(ctx, task); err != nil {
+    manager.mu.Unlock()
+    return err
+  }
+  return manager.enqueue(ctx, task)
+}
+
+func (manager *Manager) releasePaths(routineId string, paths []Path, shared bool) {
+  task := MakeTask(routineId, paths, 0)
+  task.Shared = shared
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  manager.release(task)
+  manager.unlockProcesses(routineId, paths, shared)
+  manager.notify()
+}
+
+/*
+ * Returns a *LockError if the task may not even be queued.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) admit(ctx context.Context, task *Task) error {
+  if manager.closing {
+    manager.deny(task, ErrClosed)
+    return &LockError{Paths: task.Paths, Err: ErrClosed}
+  }
+  if ctx.Err() != nil {
+    manager.deny(task, ctx.Err())
+    return &LockError{Paths: task.Paths, Err: ctx.Err()}
+  }
+  if !manager.trie.reentrant {
+    for _, path := range task.paths {
+      if manager.trie.Overlaps(path, task.RoutineId) {
+        manager.deny(task, ErrReentrant)
+        return &LockError{Paths: task.Paths, Err: ErrReentrant}
+      }
+    }
+  }
+  return nil
+}
+
+/*
+ * Like admit(), but for upgrades, which must not be refused for overlapping
+ * the routine's own locks.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) admitUpgrade(ctx context.Context, task *Task) error {
+  if manager.closing {
+    manager.deny(task, ErrClosed)
+    return &LockError{Paths: task.Paths, Err: ErrClosed}
+  }
+  if ctx.Err() != nil {
+    manager.deny(task, ctx.Err())
+    return &LockError{Paths: task.Paths, Err: ctx.Err()}
+  }
+  for _, path := range task.paths {
+    if !manager.trie.Shares(path, task.RoutineId) {
+      manager.deny(task, ErrNotHeld)
+      return &LockError{Paths: task.Paths, Err: ErrNotHeld}
+    }
+  }
+  for _, other := range manager.priorityQueue.Sorted() {
+    if other.upgrade && task.conflictsWith(other) {
+      manager.deny(task, ErrUpgradeConflict)
+      return &LockError{Paths: task.Paths, Err: ErrUpgradeConflict}
+    }
+  }
+  return nil
+}
+
+/*
+ * Queues the task and waits until it is granted, refused or the context is
+ * done. On failure, nothing is left in the queue and a *LockError is returned.
+ * The caller must hold manager.mu, which is released.
+ */
+func (manager *Manager) enqueue(ctx context.Context, task *Task) error {
+  manager.priorityQueue.Push(task)
+  manager.breakDeadlocks()
+  manager.mu.Unlock()
+  manager.notify()
+  select {
+  case shouldContinue := <- task.ContinueChannel:
+    if !shouldContinue {
+      manager.mu.Lock()
+      manager.deny(task, task.Err)
+      manager.mu.Unlock()
+      return task.Err
+    }
+    if err := manager.lockProcesses(ctx, task); err != nil {
+      return err
+    }
+    manager.mu.Lock()
+    manager.countGranted(task)
+    manager.mu.Unlock()
+    return nil
+  case <- ctx.Done():
+    manager.mu.Lock()
+    defer manager.mu.Unlock()
+    if !manager.priorityQueue.Remove(task) {
+      // The task was granted (or refused) before we could remove it.
+      if <- task.ContinueChannel {
+        manager.ungrant(task)
+      } else {
+        manager.deny(task, task.Err)
+        return task.Err
+      }
+    }
+    // Either way, tasks behind this one may now be able to proceed.
+    manager.notify()
+    manager.deny(task, ctx.Err())
+    if manager.logging() > 1 {
+      log.Println("Manager.go gave up", task.Paths, ctx.Err())
+    }
+    return &LockError{Paths: task.Paths, Err: ctx.Err()}
+  }
+}
+
+/*
+ * Once a task has been granted within this process, waits until other
+ * processes don't hold its paths either. If the context is done first, the
+ * task is ungranted and a *LockError is returned.
+ */
+func (manager *Manager) lockProcesses(ctx context.Context, task *Task) error {
+  manager.mu.Lock()
+  processLocks := manager.processLocks
+  manager.mu.Unlock()
+  if processLocks == nil {
+    return nil
+  }
+  err := processLocks.acquire(ctx, task.RoutineId, task.paths, task.Shared)
+  if err == nil && task.upgrade {
+    err = processLocks.release(task.RoutineId, task.paths, true)
+  }
+  if err == nil {
+    return nil
+  }
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  manager.ungrant(task)
+  manager.notify()
+  manager.deny(task, err)
+  if manager.logging() > 1 {
+    log.Println("Manager.go gave up on other processes", task.Paths, err)
+  }
+  return &LockError{Paths: task.Paths, Err: err}
+}
+
+/*
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) unlockProcesses(routineId string, paths []Path, shared bool) {
+  if manager.processLocks == nil {
+    return
+  }
+  if err := manager.processLocks.release(routineId, paths, shared); err != nil && manager.logging() > 2 {
+    log.Println("Manager.go Unlocking Problem", err)
+  }
+}
+
+func (manager *Manager) closeProcessLocks() {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  if manager.processLocks != nil {
+    manager.processLocks.Close()
+  }
+}
+
+/*
+ * Wakes the scheduling routine without waiting for it. Multiple notifications
+ * before it wakes are coalesced into one.
+ */
+func (manager *Manager) notify() {
+  select {
+  case manager.wake <- true:
+  default:
+  }
+}
+
+/*
+ * Grants every queued task that is neither blocked by a held lock nor in
+ * conflict with a higher-priority task that is still waiting. Since nothing
+ * may take paths a waiting task needs, the highest-priority task can't starve.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) schedule(counter int) {
+  manager.priorityQueue.Age(time.Now().UnixNano(), int64(manager.agingInterval))
+  waiting := make([]*Task, 0)
+  for _, task := range manager.priorityQueue.Sorted() {
+    if manager.logging() > 2 {
+      log.Println("Manager.go loopB", task)
+    }
+    // Task needs to be done. Attempt to acquire locks. A nested lock doesn't
+    // take anything from the tasks waiting, so it needn't wait behind them.
+    if manager.blocked(task) || (!manager.covered(task) && conflictsWithAny(task, waiting)) {
+      if counter == 0 && manager.logging() > 2 {
+        log.Println("Manager.go blocked", task)
+      }
+      waiting = append(waiting, task)
+      continue
+    }
+    if manager.logging() > 2 {
+      log.Println("Manager.go not blocked", task)
+    }
+    manager.priorityQueue.Remove(task)
+    manager.grant(task)
+    task.ContinueChannel <- true
+  }
+  manager.metrics.SetQueueDepth(manager.priorityQueue.Length())
+}
+
+func conflictsWithAny(task *Task, others []*Task) bool {
+  for _, other := range others {
+    if task.conflictsWith(other) {
+      return true
+    }
+  }
+  return false
+}
+
+/*
+ * Refuses every queued task with ErrClosed.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) refuseQueued() {
+  for _, task := range manager.priorityQueue.Sorted() {
+    manager.priorityQueue.Remove(task)
+    task.Err = &LockError{Paths: task.Paths, Err: ErrClosed}
+    task.ContinueChannel <- false
+  }
+  manager.metrics.SetQueueDepth(manager.priorityQueue.Length())
+}
+
+/*
+ * Refuses tasks until the wait-for graph has no cycles.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) breakDeadlocks() {
+  for {
+    waiting := manager.priorityQueue.Sorted()
+    graph := manager.waitForGraph(waiting)
+    cycle := findCycle(graph)
+    if cycle == nil {
+      return
+    }
+    // Refuse the youngest task among the routines in the cycle.
+    var victim *Task
+    for _, task := range waiting {
+      if cycle[task.RoutineId] && (victim == nil || task.EnqueueTime > victim.EnqueueTime) {
+        victim = task
+      }
+    }
+    victim.Err = &LockError{Paths: manager.contestedPaths(victim, cycle, waiting), Err: ErrDeadlock}
+    if manager.logging() > 1 {
+      log.Println("Manager.go deadlock", victim.RoutineId, victim.Err)
+    }
+    manager.priorityQueue.Remove(victim)
+    victim.ContinueChannel <- false
+  }
+}
+
+/*
+ * Returns a graph with an edge from each waiting routine to every routine it
+ * waits for: those holding locks that block it and those with conflicting
+ * higher-priority tasks (which it can't skip ahead of). Nested locks (see
+ * covered()) wait for no one.
+ * `waiting` must be in priority order.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) waitForGraph(waiting []*Task) map[string]map[string]bool {
+  graph := make(map[string]map[string]bool)
+  for i, task := range waiting {
+    edges, ok := graph[task.RoutineId]
+    if !ok {
+      edges = make(map[string]bool)
+      graph[task.RoutineId] = edges
+    }
+    if manager.covered(task) {
+      continue
+    }
+    for _, path := range task.paths {
+      for _, holder := range manager.trie.ConflictingValues(path, task.RoutineId, task.Shared) {
+        edges[holder] = true
+      }
+    }
+    for _, other := range waiting[:i] {
+      if task.conflictsWith(other) {
+        edges[other.RoutineId] = true
+      }
+    }
+  }
+  return graph
+}
+
+/*
+ * Returns the paths of `victim` that are held or awaited by other routines in
+ * the cycle.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) contestedPaths(victim *Task, cycle map[string]bool, waiting []*Task) []string {
+  rtn := make([]string, 0)
+  for _, path := range victim.paths {
+    probe := MakeTask(victim.RoutineId, []Path{path}, victim.Priority)
+    probe.Shared = victim.Shared
+    contested := false
+    for _, holder := range manager.trie.ConflictingValues(path, victim.RoutineId, victim.Shared) {
+      contested = contested || cycle[holder]
+    }
+    for _, other := range waiting {
+      contested = contested || (cycle[other.RoutineId] && probe.conflictsWith(other))
+    }
+    if contested {
+      rtn = append(rtn, path.String())
+    }
+  }
+  return rtn
+}
+
+/*
+ * Returns the routines in some cycle of the graph, or nil if it is acyclic.
+ */
+func findCycle(graph map[string]map[string]bool) map[string]bool {
+  const (
+    unvisited = iota
+    visiting
+    visited
+  )
+  state := make(map[string]int)
+  stack := make([]string, 0)
+  var visit func(routineId string) map[string]bool
+  visit = func(routineId string) map[string]bool {
+    state[routineId] = visiting
+    stack = append(stack, routineId)
+    for next := range graph[routineId] {
+      if state[next] == visiting {
+        // Everything on the stack from `next` onwards forms a cycle.
+        cycle := make(map[string]bool)
+        for i := len(stack) - 1; stack[i] != next; i-- {
+          cycle[stack[i]] = true
+        }
+        cycle[next] = true
+        return cycle
+      }
+      if state[next] == unvisited {
+        if cycle := visit(next); cycle != nil {
+          return cycle
+        }
+      }
+    }
+    stack = stack[:len(stack) - 1]
+    state[routineId] = visited
+    return nil
+  }
+  for routineId := range graph {
+    if state[routineId] == unvisited {
+      if cycle := visit(routineId); cycle != nil {
+        return cycle
+      }
+    }
+  }
+  return nil
+}
+
+/*
+ * Returns true iff the task is a nested lock: its routine already holds each
+ * of its paths (or an ancestor) in a mode that excludes every other routine
+ * the task would.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) covered(task *Task) bool {
+  if task.upgrade || !manager.trie.reentrant {
+    return false
+  }
+  for _, path := range task.paths {
+    if !manager.trie.Covers(path, task.RoutineId, task.Shared) {
+      return false
+    }
+  }
+  return true
+}
+
+// The caller must hold manager.mu.
+func (manager *Manager) blocked(task *Task) bool {
+  for _, path := range task.paths {
+    if isLocked, _ := manager.trie.Conflict(path, task.RoutineId, task.Shared); isLocked {
+      // File is locked by a different routine
+      if manager.logging() > 2 {
+        log.Println("Manager.go Locked", path)
+      }
+      return true
+    }
+  }
+  return false
+}
+
+// The caller must hold manager.mu.
+func (manager *Manager) grant(task *Task) {
+  for _, path := range task.paths {
+    if manager.logging() > 2 {
+      log.Println("Manager.go Add", path)
+    }
+    if task.upgrade {
+      manager.convert(path, task.RoutineId, false)
+      continue
+    }
+    err := manager.trie.Add(path, task.RoutineId, task.Shared)
+    if err != nil && manager.logging() > 2 {
+      log.Println("Manager.go Locking Problem", err)
+    }
+  }
+}
+
+/*
+ * Records a task whose routine now holds its paths. This isn't part of grant(),
+ * since the routine may still give up (and be counted by deny() instead).
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) countGranted(task *Task) {
+  wait := time.Since(time.Unix(0, task.EnqueueTime))
+  for _, path := range topLevelPaths(task.paths) {
+    manager.metrics.ObserveWait(path, wait)
+    manager.metrics.IncGranted(path)
+  }
+}
+
+/*
+ * Undoes grant() for a task whose routine gave up on it: an upgrade is
+ * downgraded again, and anything else is released.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) ungrant(task *Task) {
+  if !task.upgrade {
+    manager.release(task)
+    return
+  }
+  for _, path := range task.paths {
+    manager.convert(path, task.RoutineId, true)
+  }
+}
+
+/*
+ * Swaps one of the routine's locks on the path for one of the other mode.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) convert(path Path, routineId string, toShared bool) {
+  if since, ok := manager.trie.lastLockedAt(path, routineId, !toShared); ok {
+    manager.metrics.ObserveHold(path.Top(), time.Since(since))
+  }
+  err := manager.trie.Remove(path, routineId, !toShared)
+  if err == nil {
+    err = manager.trie.Add(path, routineId, toShared)
+  }
+  if err != nil && manager.logging() > 2 {
+    log.Println("Manager.go Converting Problem", err)
+  }
+}
+
+// The caller must hold manager.mu.
+func (manager *Manager) deny(task *Task, err error) {
+  reason := "error"
+  if errors.Is(err, ErrWouldBlock) {
+    reason = "would_block"
+  } else if errors.Is(err, ErrDeadlock) {
+    reason = "deadlock"
+  } else if errors.Is(err, ErrClosed) {
+    reason = "closed"
+  } else if errors.Is(err, ErrNotHeld) {
+    reason = "not_held"
+  } else if errors.Is(err, ErrUpgradeConflict) {
+    reason = "upgrade_conflict"
+  } else if errors.Is(err, context.Canceled) {
+    reason = "canceled"
+  } else if errors.Is(err, context.DeadlineExceeded) {
+    reason = "deadline_exceeded"
+  }
+  for _, path := range topLevelPaths(task.paths) {
+    manager.metrics.IncDenied(path, reason)
+  }
+}
+
+/*
+ * Returns false if the lease had already expired or been released.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) releaseLease(lease *Lease) bool {
+  if !manager.leases[lease] {
+    return false
+  }
+  delete(manager.leases, lease)
+  close(lease.done)
+  task := MakeTask(lease.RoutineId, lease.paths, 0)
+  task.Shared = lease.Shared
+  manager.release(task)
+  manager.unlockProcesses(lease.RoutineId, lease.paths, lease.Shared)
+  return true
+}
+
+/*
+ * Releases every lease that has expired and returns them.
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) reapLeases(now time.Time) []*Lease {
+  expired := make([]*Lease, 0)
+  for lease := range manager.leases {
+    if !now.Before(lease.expiry) {
+      if manager.logging() > 1 {
+        log.Println("Manager.go lease expired", lease.RoutineId, lease.Paths)
+      }
+      manager.releaseLease(lease)
+      expired = append(expired, lease)
+    }
+  }
+  return expired
+}
+
+/*
+ * Returns a timer that fires when the next lease expires (or never, if no
+ * leases are held).
+ * The caller must hold manager.mu.
+ */
+func (manager *Manager) leaseTimer() *time.Timer {
+  if len(manager.leases) == 0 {
+    return time.NewTimer(math.MaxInt64)
+  }
+  var next time.Time
+  for lease := range manager.leases {
+    if next.IsZero() || lease.expiry.Before(next) {
+      next = lease.expiry
+    }
+  }
+  return time.NewTimer(time.Until(next))
+}
+
+// The caller must hold manager.mu.
+func (manager *Manager) release(task *Task) {
+  for _, path := range task.paths {
+    if manager.logging() > 2 {
+      log.Println("Manager.go Remove", path)
+    }
+    if since, ok := manager.trie.lastLockedAt(path, task.RoutineId, task.Shared); ok {
+      manager.metrics.ObserveHold(path.Top(), time.Since(since))
+    }
+    err := manager.trie.Remove(path, task.RoutineId, task.Shared)
+    if err != nil && manager.logging() > 2 {
+      log.Println("Manager.go Unlocking Problem", err)
+    }
+  }
+}
+
+/********** Classless Functions **********/
+
+/*
+ * Returns the distinct top-level components of the paths, which is how
+ * metrics are labelled. The root is "/".
+ */
+func topLevelPaths(paths []Path) []string {
+  seen := make(map[string]bool)
+  rtn := make([]string, 0)
+  for _, path := range paths {
+    name := path.Top()
+    if !seen[name] {
+      seen[name] = true
+      rtn = append(rtn, name)
+    }
+  }
+  return rtn
+}
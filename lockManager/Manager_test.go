@@ -0,0 +1,344 @@
+package lockManager
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "reflect"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/Thomas-Redding/go_util/metrics"
+)
+
+/*
+ * A metrics.Recorder that counts scheduling passes, since schedule() reports
+ * the queue depth once per pass.
+ */
+type passCounter struct {
+  metrics.Recorder
+  passes int64
+}
+
+func (counter *passCounter) SetQueueDepth(depth int) {
+  atomic.AddInt64(&counter.passes, 1)
+}
+
+func (counter *passCounter) Passes() int64 {
+  return atomic.LoadInt64(&counter.passes)
+}
+
+func TestIdleManagerDoesNotSchedule(t *testing.T) {
+  manager := MakeManager(false)
+  defer manager.Close(context.Background())
+  counter := &passCounter{Recorder: metrics.Discard}
+  manager.SetMetrics(counter)
+
+  if err := manager.Acquire(context.Background(), "a", []string{"x"}, false, PriorityNormal); err != nil {
+    t.Fatal(err)
+  }
+  manager.Release("a", []string{"x"}, false)
+  deadline := time.Now().Add(5 * time.Second)
+  for counter.Passes() == 0 && time.Now().Before(deadline) {
+    time.Sleep(time.Millisecond)
+  }
+  if counter.Passes() == 0 {
+    t.Fatal("the scheduling routine never ran")
+  }
+  // Let the pass for the release finish.
+  time.Sleep(20 * time.Millisecond)
+
+  before := counter.Passes()
+  time.Sleep(200 * time.Millisecond)
+  if after := counter.Passes(); after != before {
+    t.Errorf("%d scheduling passes while idle", after - before)
+  }
+}
+
+func BenchmarkLockUnlock(b *testing.B) {
+  manager := MakeManager(false)
+  defer manager.Close(context.Background())
+  paths := []string{"a/b"}
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if err := manager.Acquire(context.Background(), "a", paths, false, PriorityNormal); err != nil {
+      b.Fatal(err)
+    }
+    manager.Release("a", paths, false)
+  }
+}
+
+/*
+ * Every goroutine locks paths that overlap the others' (the same path,
+ * ancestors and descendants).
+ */
+func BenchmarkLockUnlockContended(b *testing.B) {
+  manager := MakeManager(false)
+  defer manager.Close(context.Background())
+  paths := [][]string{{"a"}, {"a/b"}, {"a/b/c"}, {"a/d"}}
+  var routines int64
+  b.ResetTimer()
+  b.RunParallel(func(pb *testing.PB) {
+    n := atomic.AddInt64(&routines, 1)
+    routineId := fmt.Sprintf("routine%d", n)
+    for i := int(n); pb.Next(); i++ {
+      path := paths[i % len(paths)]
+      if err := manager.Acquire(context.Background(), routineId, path, false, PriorityNormal); err != nil {
+        b.Error(err)
+        return
+      }
+      manager.Release(routineId, path, false)
+    }
+  })
+}
+
+/********** Deadlocks **********/
+
+/*
+ * Waits until `n` tasks are queued.
+ */
+func waitForQueued(t *testing.T, manager *Manager, n int) {
+  deadline := time.Now().Add(5 * time.Second)
+  for len(manager.Snapshot().Waiting) != n {
+    if time.Now().After(deadline) {
+      t.Fatalf("expected %d queued tasks, got %+v", n, manager.Snapshot().Waiting)
+    }
+    time.Sleep(time.Millisecond)
+  }
+}
+
+/*
+ * Locks the paths in a new goroutine and returns the channel its error goes to.
+ */
+func acquireAsync(manager *Manager, routineId string, paths []string, class PriorityClass) chan error {
+  rtn := make(chan error, 1)
+  go func() {
+    rtn <- manager.Acquire(context.Background(), routineId, paths, false, class)
+  }()
+  return rtn
+}
+
+/*
+ * Stops the manager without waiting for the locks the test left held.
+ */
+func closeNow(manager *Manager) {
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  manager.Close(ctx)
+}
+
+func mustAcquire(t *testing.T, manager *Manager, routineId string, paths []string) {
+  if err := manager.Acquire(context.Background(), routineId, paths, false, PriorityNormal); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func expectGranted(t *testing.T, result chan error) {
+  select {
+  case err := <- result:
+    if err != nil {
+      t.Fatal(err)
+    }
+  case <- time.After(5 * time.Second):
+    t.Fatal("lock was never granted")
+  }
+}
+
+func TestDeadlockTwoCycle(t *testing.T) {
+  manager := MakeManager(true)
+  defer closeNow(manager)
+  mustAcquire(t, manager, "A", []string{"x"})
+  mustAcquire(t, manager, "B", []string{"y"})
+  resultA := acquireAsync(manager, "A", []string{"y"}, PriorityNormal)
+  waitForQueued(t, manager, 1)
+
+  err := manager.Acquire(context.Background(), "B", []string{"x"}, false, PriorityNormal)
+  if !errors.Is(err, ErrDeadlock) {
+    t.Fatalf("expected ErrDeadlock, got %v", err)
+  }
+  var lockError *LockError
+  if !errors.As(err, &lockError) || !reflect.DeepEqual(lockError.Paths, []string{"/x"}) {
+    t.Errorf("expected the contested path /x, got %v", err)
+  }
+  manager.Release("B", []string{"y"}, false)
+  expectGranted(t, resultA)
+}
+
+func TestDeadlockThreeCycle(t *testing.T) {
+  manager := MakeManager(true)
+  defer closeNow(manager)
+  mustAcquire(t, manager, "A", []string{"x"})
+  mustAcquire(t, manager, "B", []string{"y"})
+  mustAcquire(t, manager, "C", []string{"z"})
+  resultA := acquireAsync(manager, "A", []string{"y"}, PriorityNormal)
+  waitForQueued(t, manager, 1)
+  resultB := acquireAsync(manager, "B", []string{"z"}, PriorityNormal)
+  waitForQueued(t, manager, 2)
+
+  if err := manager.Acquire(context.Background(), "C", []string{"x"}, false, PriorityNormal); !errors.Is(err, ErrDeadlock) {
+    t.Fatalf("expected ErrDeadlock, got %v", err)
+  }
+  manager.Release("C", []string{"z"}, false)
+  expectGranted(t, resultB)
+  manager.Release("B", []string{"y", "z"}, false)
+  expectGranted(t, resultA)
+}
+
+/*
+ * A waits for B, but B isn't waiting for anything, so that's no deadlock.
+ */
+func TestDeadlockNoFalsePositive(t *testing.T) {
+  manager := MakeManager(true)
+  defer closeNow(manager)
+  mustAcquire(t, manager, "A", []string{"x"})
+  mustAcquire(t, manager, "B", []string{"y"})
+  resultA := acquireAsync(manager, "A", []string{"y"}, PriorityNormal)
+  waitForQueued(t, manager, 1)
+
+  // B may lock more paths, including ones nobody waits for.
+  mustAcquire(t, manager, "B", []string{"z"})
+  select {
+  case err := <- resultA:
+    t.Fatalf("A should still be waiting, got %v", err)
+  case <- time.After(50 * time.Millisecond):
+  }
+  manager.Release("B", []string{"y"}, false)
+  expectGranted(t, resultA)
+}
+
+/*
+ * A routine that holds a path may lock it (or a path below it) again in any
+ * class, even while another routine waits for it: no one else can hold
+ * anything the nested lock needs, so it doesn't have to queue.
+ */
+func TestDeadlockNestedLock(t *testing.T) {
+  manager := MakeManager(true)
+  defer closeNow(manager)
+  mustAcquire(t, manager, "A", []string{"x"})
+  resultB := acquireAsync(manager, "B", []string{"x"}, PriorityNormal)
+  waitForQueued(t, manager, 1)
+
+  for _, path := range []string{"x", "x/child"} {
+    for _, class := range []PriorityClass{PriorityUrgent, PriorityNormal, PriorityBackground} {
+      for _, shared := range []bool{false, true} {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        err := manager.Acquire(ctx, "A", []string{path}, shared, class)
+        cancel()
+        if err != nil {
+          t.Fatalf("nested %v lock on %s (shared=%v): %v", class, path, shared, err)
+        }
+        manager.Release("A", []string{path}, shared)
+      }
+    }
+    if err := manager.TryAcquire("A", []string{path}, false); err != nil {
+      t.Fatalf("nested TryAcquire on %s: %v", path, err)
+    }
+    manager.Release("A", []string{path}, false)
+  }
+  select {
+  case err := <- resultB:
+    t.Fatalf("B should still be waiting, got %v", err)
+  default:
+  }
+  manager.Release("A", []string{"x"}, false)
+  expectGranted(t, resultB)
+}
+
+/*
+ * A shared lock only covers shared nested locks; an exclusive one on the same
+ * path still waits (and, with B waiting for A, is a deadlock).
+ */
+func TestDeadlockNestedSharedLock(t *testing.T) {
+  manager := MakeManager(true)
+  defer closeNow(manager)
+  if err := manager.Acquire(context.Background(), "A", []string{"x"}, true, PriorityNormal); err != nil {
+    t.Fatal(err)
+  }
+  resultB := acquireAsync(manager, "B", []string{"x"}, PriorityNormal)
+  waitForQueued(t, manager, 1)
+
+  if err := manager.Acquire(context.Background(), "A", []string{"x/child"}, true, PriorityNormal); err != nil {
+    t.Fatalf("nested shared lock: %v", err)
+  }
+  manager.Release("A", []string{"x/child"}, true)
+  if err := manager.Acquire(context.Background(), "A", []string{"x"}, false, PriorityNormal); !errors.Is(err, ErrDeadlock) {
+    t.Fatalf("exclusive lock under a shared one: expected ErrDeadlock, got %v", err)
+  }
+  manager.Release("A", []string{"x"}, true)
+  expectGranted(t, resultB)
+}
+
+/********** Metrics **********/
+
+type outcomeCounter struct {
+  metrics.Recorder
+  granted int64
+  denied int64
+}
+
+func (counter *outcomeCounter) IncGranted(path string) {
+  atomic.AddInt64(&counter.granted, 1)
+}
+
+func (counter *outcomeCounter) IncDenied(path string, reason string) {
+  atomic.AddInt64(&counter.denied, 1)
+}
+
+/*
+ * Grants a waiting task just after its context is done, so the routine gives
+ * up on a lock it was granted. It must be counted as denied, not as both.
+ */
+func TestMetricsCountGrantedThenCanceledOnce(t *testing.T) {
+  manager := MakeManager(false)
+  defer manager.Close(context.Background())
+  counter := &outcomeCounter{Recorder: metrics.Discard}
+  manager.SetMetrics(counter)
+  mustAcquire(t, manager, "A", []string{"x"})
+  ctx, cancel := context.WithCancel(context.Background())
+  result := make(chan error, 1)
+  go func() {
+    result <- manager.Acquire(ctx, "B", []string{"x"}, false, PriorityNormal)
+  }()
+  waitForQueued(t, manager, 1)
+
+  // Hold the manager's lock so B sees its context is done only after the
+  // grant below.
+  manager.mu.Lock()
+  cancel()
+  time.Sleep(20 * time.Millisecond)
+  x, _ := ParsePath("x")
+  manager.release(MakeTask("A", []Path{x}, 0))
+  manager.schedule(1)
+  manager.mu.Unlock()
+
+  if err := <- result; !errors.Is(err, context.Canceled) {
+    t.Fatalf("expected context.Canceled, got %v", err)
+  }
+  if granted, denied := atomic.LoadInt64(&counter.granted), atomic.LoadInt64(&counter.denied); granted != 1 || denied != 1 {
+    t.Errorf("expected A granted and B denied, got %d granted and %d denied", granted, denied)
+  }
+  if held := manager.Snapshot().Held; len(held) != 0 {
+    t.Errorf("B still holds %+v", held)
+  }
+}
+
+/*
+ * Run with -race: the logging level may change while the manager is busy.
+ */
+func TestSetLoggingEnabledWhileLocking(t *testing.T) {
+  manager := MakeManager(false)
+  defer manager.Close(context.Background())
+  done := make(chan bool)
+  go func() {
+    defer close(done)
+    for i := 0; i < 100; i++ {
+      manager.SetLoggingEnabled(uint(i % 2))
+    }
+  }()
+  for i := 0; i < 100; i++ {
+    mustAcquire(t, manager, "a", []string{"x"})
+    manager.Release("a", []string{"x"}, false)
+  }
+  <- done
+}
@@ -0,0 +1,207 @@
+package lockManager
+
+import (
+  "errors"
+  pathpkg "path"
+  "strings"
+)
+
+// Wrapped by the *LockError returned for a path that climbs above the root.
+var ErrInvalidPath = errors.New("Path.go: Path escapes the root.")
+
+// Wrapped by the *LockError returned for a pattern path.Match() can't parse.
+var ErrInvalidPattern = errors.New("Path.go: Malformed pattern.")
+
+/*
+ * A canonical, slash-separated path relative to the root. Every spelling of
+ * the same path parses to the same Path, so they all conflict with each other:
+ * "foo", "/foo", "foo/", "foo//", "./foo" and "bar/../foo" are all "/foo",
+ * and "", "/" and "." are the root.
+ *
+ * ParsePath(path string) (Path, error)
+ * Cleans the path. Fails with ErrInvalidPath if ".." climbs above the root.
+ *
+ * ParsePattern(pattern string) (Path, error)
+ * Like ParsePath(), but each component is a path.Match() pattern, so
+ * "configs/*.json" covers every JSON file in "configs" (and their
+ * descendants). Fails with ErrInvalidPattern if a component is malformed.
+ *
+ * path.String() string
+ * Returns the path with a leading slash, e.g. "/foo/bar" or "/".
+ *
+ * path.Parts() []string
+ * Returns the components, e.g. ["foo", "bar"]. The root has none.
+ *
+ * path.IsPattern() bool
+ * Returns true iff the path came from ParsePattern().
+ *
+ * path.Contains(other Path) bool
+ * Returns true iff `other` is the path itself or one of its descendants.
+ * Components are compared literally, even for patterns.
+ *
+ * path.Overlaps(other Path) bool
+ * Returns true iff either path contains the other. If either is a pattern,
+ * returns true iff some path they cover could be the same (deciding that
+ * exactly is hard for two patterns, so it errs towards true).
+ *
+ * path.Top() string
+ * Returns the first component, or "/" for the root.
+ */
+type Path struct {
+  parts []string
+  pattern bool
+}
+
+func ParsePath(path string) (Path, error) {
+  parts := make([]string, 0)
+  for _, part := range strings.Split(path, "/") {
+    switch part {
+    case "", ".":
+      continue
+    case "..":
+      if len(parts) == 0 {
+        return Path{}, ErrInvalidPath
+      }
+      parts = parts[:len(parts) - 1]
+    default:
+      parts = append(parts, part)
+    }
+  }
+  return Path{parts: parts}, nil
+}
+
+func ParsePattern(pattern string) (Path, error) {
+  rtn, err := ParsePath(pattern)
+  if err != nil {
+    return Path{}, err
+  }
+  for _, part := range rtn.parts {
+    if _, err := pathpkg.Match(part, ""); err != nil {
+      return Path{}, ErrInvalidPattern
+    }
+  }
+  rtn.pattern = true
+  return rtn, nil
+}
+
+/*
+ * Parses every path, failing on the first invalid one.
+ */
+func ParsePaths(paths []string) ([]Path, error) {
+  return parseAll(paths, ParsePath)
+}
+
+func ParsePatterns(patterns []string) ([]Path, error) {
+  return parseAll(patterns, ParsePattern)
+}
+
+func (path Path) String() string {
+  return "/" + strings.Join(path.parts, "/")
+}
+
+func (path Path) Parts() []string {
+  rtn := make([]string, len(path.parts))
+  copy(rtn, path.parts)
+  return rtn
+}
+
+func (path Path) IsPattern() bool {
+  return path.pattern
+}
+
+func (path Path) Contains(other Path) bool {
+  if len(path.parts) > len(other.parts) {
+    return false
+  }
+  for i, part := range path.parts {
+    if other.parts[i] != part {
+      return false
+    }
+  }
+  return true
+}
+
+func (path Path) Overlaps(other Path) bool {
+  if !path.pattern && !other.pattern {
+    return path.Contains(other) || other.Contains(path)
+  }
+  for i := 0; i < len(path.parts) && i < len(other.parts); i++ {
+    if !partsMayMatch(path.parts[i], path.pattern, other.parts[i], other.pattern) {
+      return false
+    }
+  }
+  return true
+}
+
+func (path Path) Top() string {
+  if len(path.parts) == 0 {
+    return "/"
+  }
+  return path.parts[0]
+}
+
+/*
+ * Returns the component as it is written in a pattern, and whether it is a
+ * glob (as opposed to a literal name).
+ */
+func (path Path) part(i int) (string, bool) {
+  return path.parts[i], path.pattern && isGlob(path.parts[i])
+}
+
+/********** Classless Functions **********/
+
+func parseAll(paths []string, parse func(string) (Path, error)) ([]Path, error) {
+  rtn := make([]Path, len(paths))
+  for i, path := range paths {
+    parsed, err := parse(path)
+    if err != nil {
+      return nil, err
+    }
+    rtn[i] = parsed
+  }
+  return rtn, nil
+}
+
+func isGlob(part string) bool {
+  return strings.ContainsAny(part, "*?[\\")
+}
+
+/*
+ * Returns true iff some name could be matched by both components, each of
+ * which is a pattern if `aPattern` (or `bPattern`) is set.
+ */
+func partsMayMatch(a string, aPattern bool, b string, bPattern bool) bool {
+  aGlob := aPattern && isGlob(a)
+  bGlob := bPattern && isGlob(b)
+  if !aGlob && !bGlob {
+    return a == b
+  }
+  if !bGlob {
+    matched, _ := pathpkg.Match(a, b)
+    return matched
+  }
+  if !aGlob {
+    matched, _ := pathpkg.Match(b, a)
+    return matched
+  }
+  return globsMayIntersect(a, b)
+}
+
+/*
+ * Returns false if no name could be matched by both globs. Only their literal
+ * prefixes and suffixes are compared, so e.g. "*.json" and "*.bin" are told
+ * apart but "a*" and "*b" are assumed to intersect.
+ */
+func globsMayIntersect(a string, b string) bool {
+  aPrefix := a[:strings.IndexAny(a, "*?[\\")]
+  bPrefix := b[:strings.IndexAny(b, "*?[\\")]
+  if !strings.HasPrefix(aPrefix, bPrefix) && !strings.HasPrefix(bPrefix, aPrefix) {
+    return false
+  }
+  if strings.ContainsAny(a + b, "[\\") {
+    return true // Character classes and escapes make the suffix hard to find.
+  }
+  aSuffix := a[strings.LastIndexAny(a, "*?") + 1:]
+  bSuffix := b[strings.LastIndexAny(b, "*?") + 1:]
+  return strings.HasSuffix(aSuffix, bSuffix) || strings.HasSuffix(bSuffix, aSuffix)
+}
@@ -0,0 +1,99 @@
+package lockManager
+
+import (
+  "context"
+  "errors"
+  "testing"
+)
+
+func TestParsePathCanonicalizes(t *testing.T) {
+  for _, spelling := range []string{"foo", "/foo", "/foo/", "foo//", "./foo", "bar/../foo", "./bar/.././foo/."} {
+    path, err := ParsePath(spelling)
+    if err != nil {
+      t.Errorf("ParsePath(%q): %v", spelling, err)
+      continue
+    }
+    if path.String() != "/foo" {
+      t.Errorf("ParsePath(%q) = %s, want /foo", spelling, path)
+    }
+  }
+  for _, spelling := range []string{"", "/", ".", "foo/.."} {
+    path, err := ParsePath(spelling)
+    if err != nil || path.String() != "/" || len(path.Parts()) != 0 {
+      t.Errorf("ParsePath(%q) = %s, %v, want the root", spelling, path, err)
+    }
+  }
+}
+
+func TestParsePathRefusesEscapes(t *testing.T) {
+  for _, spelling := range []string{"..", "../etc", "/../etc", "foo/../../etc", "./.."} {
+    if _, err := ParsePath(spelling); !errors.Is(err, ErrInvalidPath) {
+      t.Errorf("ParsePath(%q): expected ErrInvalidPath, got %v", spelling, err)
+    }
+  }
+  manager := MakeManager(false)
+  defer manager.Close(context.Background())
+  err := manager.Acquire(context.Background(), "A", []string{"../etc"}, false, PriorityNormal)
+  var lockError *LockError
+  if !errors.Is(err, ErrInvalidPath) || !errors.As(err, &lockError) {
+    t.Errorf("Acquire(../etc): expected a *LockError wrapping ErrInvalidPath, got %v", err)
+  }
+}
+
+func TestPathOverlaps(t *testing.T) {
+  tests := []struct {
+    a string
+    b string
+    overlaps bool
+  }{
+    {"foo", "foo", true},
+    {"foo", "/foo/", true}, // different spellings
+    {"foo", "foo/bar", true}, // ancestor
+    {"foo/bar/baz", "foo", true}, // descendant
+    {"", "foo/bar", true}, // the root
+    {"foo/bar", "foo/baz", false}, // siblings
+    {"foo", "foobar", false}, // a shared prefix isn't an ancestor
+    {"foo/bar", "baz/bar", false},
+  }
+  for _, test := range tests {
+    a, _ := ParsePath(test.a)
+    b, _ := ParsePath(test.b)
+    if got := a.Overlaps(b); got != test.overlaps {
+      t.Errorf("%q overlaps %q = %v, want %v", test.a, test.b, got, test.overlaps)
+    }
+    if got := b.Overlaps(a); got != test.overlaps {
+      t.Errorf("%q overlaps %q = %v, want %v", test.b, test.a, got, test.overlaps)
+    }
+  }
+}
+
+/*
+ * Locks the first path and checks whether another routine may lock the
+ * second without waiting.
+ */
+func TestPathConflicts(t *testing.T) {
+  tests := []struct {
+    held string
+    wanted string
+    conflicts bool
+  }{
+    {"foo", "./foo", true},
+    {"foo", "foo/bar", true}, // held ancestor
+    {"foo/bar", "foo", true}, // held descendant
+    {"foo/bar", "foo/baz", false}, // siblings
+    {"foo/bar", "bar/../foo/bar/", true},
+  }
+  for _, test := range tests {
+    manager := MakeManager(false)
+    if err := manager.Acquire(context.Background(), "A", []string{test.held}, false, PriorityNormal); err != nil {
+      t.Fatal(err)
+    }
+    err := manager.TryAcquire("B", []string{test.wanted}, false)
+    if conflicts := errors.Is(err, ErrWouldBlock); conflicts != test.conflicts {
+      t.Errorf("holding %q, locking %q: got %v", test.held, test.wanted, err)
+    }
+    manager.ReleaseAll("A")
+    manager.ReleaseAll("B")
+    manager.Close(context.Background())
+  }
+}
@@ -0,0 +1,298 @@
+package lockManager
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+
+  "github.com/google/uuid"
+)
+
+/*
+ * ProcessLocks extends a Manager's locks to other processes that use the same
+ * lock directory, e.g. a server and a batch job working on the same tree.
+ * Within a process, the Manager decides who gets a path; ProcessLocks only
+ * keeps processes from holding conflicting paths at the same time, with the
+ * same rules (ancestors, descendants and shared locks) as the Manager.
+ *
+ * OpenProcessLocks(dir string) (*ProcessLocks, error)
+ * Creates the directory if needed and registers this process in it. The
+ * directory should not be inside the tree being locked.
+ *
+ * locks.Close() error
+ * Releases every lock this process holds and unregisters it.
+ *
+ * The directory holds a table of every lock held by any process (locks.json),
+ * which is only read or written while holding an flock on locks.lock, and a
+ * file per process in procs/, which the process keeps flocked for as long as
+ * it is alive. Locks held by a process whose file is no longer flocked (since
+ * it exited or crashed) are discarded, so they can't stay locked forever.
+ *
+ * Processes poll the table while they wait, so there is no queue between
+ * processes: whichever process checks first once a path is free gets it.
+ */
+
+// Returned by OpenProcessLocks() on platforms without flock.
+var ErrProcessLocksUnsupported = errors.New("ProcessLocks.go: Cross-process locks are not supported on this platform.")
+
+// Returned by ProcessLocks methods once Close() has been called.
+var ErrProcessLocksClosed = errors.New("ProcessLocks.go: Process locks are closed.")
+
+// How often a waiting process checks the table, at first and at most.
+const (
+  minProcessLockPoll = time.Millisecond
+  maxProcessLockPoll = 50 * time.Millisecond
+)
+
+type ProcessLocks struct {
+  dir string
+  owner string // identifies this process in the table and in procs/
+  mu sync.Mutex // serializes this process's access to the table
+  ownerFile *os.File // flocked for as long as this process is registered
+}
+
+type processLockEntry struct {
+  Owner string `json:"owner"`
+  RoutineId string `json:"routineId"`
+  Path string `json:"path"`
+  Pattern bool `json:"pattern,omitempty"`
+  Shared bool `json:"shared"`
+}
+
+func OpenProcessLocks(dir string) (*ProcessLocks, error) {
+  if err := os.MkdirAll(filepath.Join(dir, "procs"), 0755); err != nil {
+    return nil, err
+  }
+  owner := uuid.NewString()
+  // Lock the file before giving it its real name, so no other process can
+  // mistake it for the file of a dead process.
+  tmpPath := filepath.Join(dir, "procs", "." + owner)
+  ownerFile, err := os.OpenFile(tmpPath, os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+  if err != nil {
+    return nil, err
+  }
+  if _, err := flock(ownerFile, true, true); err != nil {
+    ownerFile.Close()
+    os.Remove(tmpPath)
+    return nil, err
+  }
+  if err := os.Rename(tmpPath, filepath.Join(dir, "procs", owner)); err != nil {
+    ownerFile.Close()
+    os.Remove(tmpPath)
+    return nil, err
+  }
+  return &ProcessLocks{dir: dir, owner: owner, ownerFile: ownerFile}, nil
+}
+
+func (locks *ProcessLocks) Close() error {
+  locks.mu.Lock()
+  defer locks.mu.Unlock()
+  if locks.ownerFile == nil {
+    return nil
+  }
+  err := locks.update(func(entries []processLockEntry) ([]processLockEntry, bool) {
+    return removeEntries(entries, func(entry processLockEntry) bool { return entry.Owner == locks.owner }), true
+  })
+  os.Remove(filepath.Join(locks.dir, "procs", locks.owner))
+  locks.ownerFile.Close()
+  locks.ownerFile = nil
+  return err
+}
+
+/*
+ * Waits until no other process holds a conflicting lock and then records the
+ * routine's locks on the paths. Returns the context's error if it is done
+ * first.
+ */
+func (locks *ProcessLocks) acquire(ctx context.Context, routineId string, paths []Path, shared bool) error {
+  poll := minProcessLockPoll
+  for {
+    ok, err := locks.tryAcquire(routineId, paths, shared)
+    if ok || err != nil {
+      return err
+    }
+    timer := time.NewTimer(poll)
+    select {
+    case <- ctx.Done():
+      timer.Stop()
+      return ctx.Err()
+    case <- timer.C:
+    }
+    if poll *= 2; poll > maxProcessLockPoll {
+      poll = maxProcessLockPoll
+    }
+  }
+}
+
+/*
+ * Records the routine's locks on the paths if no other process holds a
+ * conflicting lock. Otherwise returns false.
+ */
+func (locks *ProcessLocks) tryAcquire(routineId string, paths []Path, shared bool) (bool, error) {
+  locks.mu.Lock()
+  defer locks.mu.Unlock()
+  if locks.ownerFile == nil {
+    return false, ErrProcessLocksClosed
+  }
+  acquired := false
+  err := locks.update(func(entries []processLockEntry) ([]processLockEntry, bool) {
+    for _, entry := range entries {
+      if entry.Owner == locks.owner || (shared && entry.Shared) {
+        continue
+      }
+      held, err := entry.parse()
+      if err != nil {
+        continue
+      }
+      for _, path := range paths {
+        if path.Overlaps(held) {
+          return entries, false
+        }
+      }
+    }
+    for _, path := range paths {
+      entries = append(entries, processLockEntry{Owner: locks.owner, RoutineId: routineId, Path: path.String(), Pattern: path.pattern, Shared: shared})
+    }
+    acquired = true
+    return entries, true
+  })
+  return acquired, err
+}
+
+/*
+ * Removes one of the routine's locks on each of the paths.
+ */
+func (locks *ProcessLocks) release(routineId string, paths []Path, shared bool) error {
+  locks.mu.Lock()
+  defer locks.mu.Unlock()
+  if locks.ownerFile == nil {
+    return ErrProcessLocksClosed
+  }
+  return locks.update(func(entries []processLockEntry) ([]processLockEntry, bool) {
+    for _, path := range paths {
+      for i, entry := range entries {
+        if entry.Owner == locks.owner && entry.RoutineId == routineId && entry.Path == path.String() && entry.Pattern == path.pattern && entry.Shared == shared {
+          entries = append(entries[:i], entries[i + 1:]...)
+          break
+        }
+      }
+    }
+    return entries, true
+  })
+}
+
+/*
+ * Removes every lock the routine holds.
+ */
+func (locks *ProcessLocks) releaseAll(routineId string) error {
+  locks.mu.Lock()
+  defer locks.mu.Unlock()
+  if locks.ownerFile == nil {
+    return ErrProcessLocksClosed
+  }
+  return locks.update(func(entries []processLockEntry) ([]processLockEntry, bool) {
+    return removeEntries(entries, func(entry processLockEntry) bool {
+      return entry.Owner == locks.owner && entry.RoutineId == routineId
+    }), true
+  })
+}
+
+/*
+ * Reads the table while holding locks.lock, discards the locks of dead
+ * processes and, if `f` returns true, writes back the entries it returns.
+ * The caller must hold locks.mu.
+ */
+func (locks *ProcessLocks) update(f func(entries []processLockEntry) ([]processLockEntry, bool)) error {
+  lockFile, err := os.OpenFile(filepath.Join(locks.dir, "locks.lock"), os.O_RDWR | os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+  defer lockFile.Close()
+  if _, err := flock(lockFile, true, true); err != nil {
+    return err
+  }
+  defer funlock(lockFile)
+
+  tablePath := filepath.Join(locks.dir, "locks.json")
+  entries := make([]processLockEntry, 0)
+  data, err := os.ReadFile(tablePath)
+  if err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  if len(data) > 0 {
+    if err := json.Unmarshal(data, &entries); err != nil {
+      return err
+    }
+  }
+  alive := map[string]bool{locks.owner: true}
+  live := removeEntries(entries, func(entry processLockEntry) bool {
+    isAlive, ok := alive[entry.Owner]
+    if !ok {
+      isAlive = locks.isAlive(entry.Owner)
+      alive[entry.Owner] = isAlive
+    }
+    return !isAlive
+  })
+  pruned := len(live) != len(entries)
+
+  entries, changed := f(live)
+  if !changed && !pruned {
+    return nil
+  }
+  data, err = json.Marshal(entries)
+  if err != nil {
+    return err
+  }
+  // Write a new file and rename it, so a crash can't leave half a table.
+  tmpPath := tablePath + ".tmp"
+  if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, tablePath)
+}
+
+/*
+ * Returns false if the process has exited, in which case its file is removed.
+ */
+func (locks *ProcessLocks) isAlive(owner string) bool {
+  ownerPath := filepath.Join(locks.dir, "procs", owner)
+  ownerFile, err := os.OpenFile(ownerPath, os.O_RDWR, 0644)
+  if os.IsNotExist(err) {
+    return false
+  }
+  if err != nil {
+    return true // Be safe.
+  }
+  defer ownerFile.Close()
+  locked, err := flock(ownerFile, true, false)
+  if err != nil || !locked {
+    return true
+  }
+  // Nobody holds the file, so its process is gone.
+  os.Remove(ownerPath)
+  funlock(ownerFile)
+  return false
+}
+
+func (entry processLockEntry) parse() (Path, error) {
+  if entry.Pattern {
+    return ParsePattern(entry.Path)
+  }
+  return ParsePath(entry.Path)
+}
+
+/********** Classless Functions **********/
+
+func removeEntries(entries []processLockEntry, shouldRemove func(entry processLockEntry) bool) []processLockEntry {
+  rtn := make([]processLockEntry, 0, len(entries))
+  for _, entry := range entries {
+    if !shouldRemove(entry) {
+      rtn = append(rtn, entry)
+    }
+  }
+  return rtn
+}
@@ -0,0 +1,241 @@
+package lockManager
+
+import (
+  "bufio"
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "os/exec"
+  "testing"
+  "time"
+)
+
+/*
+ * These tests start copies of the test binary as other processes (see
+ * TestMain()). Each helper locks one path in the lock directory, prints
+ * "locked" and holds it until its stdin is closed.
+ */
+
+const (
+  helperDirEnv = "LOCKMANAGER_HELPER_DIR"
+  helperPathEnv = "LOCKMANAGER_HELPER_PATH"
+  helperSharedEnv = "LOCKMANAGER_HELPER_SHARED"
+)
+
+func TestMain(m *testing.M) {
+  if dir := os.Getenv(helperDirEnv); len(dir) > 0 {
+    if err := runHelper(dir, os.Getenv(helperPathEnv), os.Getenv(helperSharedEnv) == "true"); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    }
+    os.Exit(0)
+  }
+  os.Exit(m.Run())
+}
+
+func runHelper(dir string, path string, shared bool) error {
+  processLocks, err := OpenProcessLocks(dir)
+  if err != nil {
+    return err
+  }
+  manager := MakeManager(false)
+  manager.SetProcessLocks(processLocks)
+  if err := manager.Acquire(context.Background(), "helper", []string{path}, shared, PriorityNormal); err != nil {
+    return err
+  }
+  fmt.Println("locked")
+  io.Copy(io.Discard, os.Stdin)
+  manager.Release("helper", []string{path}, shared)
+  return manager.Close(context.Background())
+}
+
+type helper struct {
+  cmd *exec.Cmd
+  stdin io.WriteCloser
+  locked chan error // receives nil once the helper holds its path
+}
+
+/*
+ * Starts a helper process that locks `path` in `dir`. Call waitLocked() to
+ * wait until it holds it.
+ */
+func startHelper(t *testing.T, dir string, path string, shared bool) *helper {
+  cmd := exec.Command(os.Args[0], "-test.run=^$")
+  cmd.Env = append(os.Environ(), helperDirEnv + "=" + dir, helperPathEnv + "=" + path, fmt.Sprintf("%s=%v", helperSharedEnv, shared))
+  cmd.Stderr = os.Stderr
+  stdin, err := cmd.StdinPipe()
+  if err != nil {
+    t.Fatal(err)
+  }
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := cmd.Start(); err != nil {
+    t.Fatal(err)
+  }
+  h := &helper{cmd: cmd, stdin: stdin, locked: make(chan error, 1)}
+  go func() {
+    line, err := bufio.NewReader(stdout).ReadString('\n')
+    if err == nil && line != "locked\n" {
+      err = fmt.Errorf("unexpected output %q", line)
+    }
+    h.locked <- err
+    io.Copy(io.Discard, stdout)
+  }()
+  t.Cleanup(func() {
+    cmd.Process.Kill()
+    cmd.Wait()
+  })
+  return h
+}
+
+func (h *helper) waitLocked(t *testing.T) {
+  select {
+  case err := <- h.locked:
+    if err != nil {
+      t.Fatalf("helper failed to lock: %v", err)
+    }
+  case <- time.After(10 * time.Second):
+    t.Fatal("helper never locked its path")
+  }
+}
+
+/*
+ * Lets the helper release its path and exit.
+ */
+func (h *helper) stop(t *testing.T) {
+  h.stdin.Close()
+  if err := h.cmd.Wait(); err != nil {
+    t.Fatalf("helper failed: %v", err)
+  }
+}
+
+func openManagerWithProcessLocks(t *testing.T, dir string) *Manager {
+  processLocks, err := OpenProcessLocks(dir)
+  if errors.Is(err, ErrProcessLocksUnsupported) {
+    t.Skip(err)
+  }
+  if err != nil {
+    t.Fatal(err)
+  }
+  manager := MakeManager(false)
+  manager.SetProcessLocks(processLocks)
+  t.Cleanup(func() { closeNow(manager) })
+  return manager
+}
+
+func TestProcessLocksExcludeOtherProcesses(t *testing.T) {
+  dir := t.TempDir()
+  manager := openManagerWithProcessLocks(t, dir)
+  h := startHelper(t, dir, "a", false)
+  h.waitLocked(t)
+
+  for _, path := range []string{"a", "a/b", ""} {
+    if err := manager.TryAcquire("A", []string{path}, false); !errors.Is(err, ErrWouldBlock) {
+      t.Errorf("locking %q while another process holds a: expected ErrWouldBlock, got %v", path, err)
+    }
+  }
+  if err := manager.TryAcquire("A", []string{"c"}, false); err != nil {
+    t.Errorf("locking c: %v", err)
+  }
+  manager.Release("A", []string{"c"}, false)
+
+  result := make(chan error, 1)
+  go func() {
+    result <- manager.Acquire(context.Background(), "A", []string{"a/b"}, false, PriorityNormal)
+  }()
+  select {
+  case err := <- result:
+    t.Fatalf("got a/b while another process holds a: %v", err)
+  case <- time.After(100 * time.Millisecond):
+  }
+  h.stop(t)
+  expectGranted(t, result)
+  manager.Release("A", []string{"a/b"}, false)
+}
+
+func TestProcessLocksShareAcrossProcesses(t *testing.T) {
+  dir := t.TempDir()
+  manager := openManagerWithProcessLocks(t, dir)
+  h := startHelper(t, dir, "a", true)
+  h.waitLocked(t)
+
+  if err := manager.TryAcquire("A", []string{"a/b"}, true); err != nil {
+    t.Errorf("sharing a/b with another process reading a: %v", err)
+  }
+  manager.Release("A", []string{"a/b"}, true)
+  if err := manager.TryAcquire("A", []string{"a/b"}, false); !errors.Is(err, ErrWouldBlock) {
+    t.Errorf("writing a/b while another process reads a: expected ErrWouldBlock, got %v", err)
+  }
+  h.stop(t)
+}
+
+/*
+ * A process waiting to read a path gets it once this one downgrades its
+ * exclusive lock.
+ */
+func TestProcessLocksDowngrade(t *testing.T) {
+  dir := t.TempDir()
+  manager := openManagerWithProcessLocks(t, dir)
+  if err := manager.Acquire(context.Background(), "A", []string{"a"}, false, PriorityNormal); err != nil {
+    t.Fatal(err)
+  }
+  h := startHelper(t, dir, "a", true)
+  select {
+  case err := <- h.locked:
+    t.Fatalf("helper read a while it was held exclusively: %v", err)
+  case <- time.After(200 * time.Millisecond):
+  }
+  if err := manager.Downgrade("A", []string{"a"}); err != nil {
+    t.Fatal(err)
+  }
+  h.waitLocked(t)
+  manager.Release("A", []string{"a"}, true)
+  h.stop(t)
+}
+
+/*
+ * If the shared locks can't be recorded, Downgrade() fails and the routine
+ * keeps its exclusive lock.
+ */
+func TestProcessLocksDowngradeFailureKeepsExclusive(t *testing.T) {
+  manager := openManagerWithProcessLocks(t, t.TempDir())
+  if err := manager.Acquire(context.Background(), "A", []string{"a"}, false, PriorityNormal); err != nil {
+    t.Fatal(err)
+  }
+  manager.processLocks.Close()
+  if err := manager.Downgrade("A", []string{"a"}); !errors.Is(err, ErrProcessLocksClosed) {
+    t.Fatalf("expected ErrProcessLocksClosed, got %v", err)
+  }
+  held := manager.Snapshot().Held
+  if len(held) != 1 || held[0].Mode != ModeExclusive {
+    t.Errorf("expected a to stay exclusive, got %+v", held)
+  }
+}
+
+/*
+ * The locks of a process that is killed are discarded.
+ */
+func TestProcessLocksCrashCleanup(t *testing.T) {
+  dir := t.TempDir()
+  manager := openManagerWithProcessLocks(t, dir)
+  h := startHelper(t, dir, "a", false)
+  h.waitLocked(t)
+  if err := manager.TryAcquire("A", []string{"a"}, false); !errors.Is(err, ErrWouldBlock) {
+    t.Fatalf("expected ErrWouldBlock, got %v", err)
+  }
+
+  if err := h.cmd.Process.Kill(); err != nil {
+    t.Fatal(err)
+  }
+  h.cmd.Wait()
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+  defer cancel()
+  if err := manager.Acquire(ctx, "A", []string{"a"}, false, PriorityNormal); err != nil {
+    t.Fatalf("a is still locked by a dead process: %v", err)
+  }
+  manager.Release("A", []string{"a"}, false)
+}
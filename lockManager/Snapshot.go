@@ -0,0 +1,103 @@
+package lockManager
+
+import (
+  "encoding/json"
+  "net/http"
+  "time"
+)
+
+/*
+ * A point-in-time view of a Manager, for debugging requests that hang.
+ * Manager.SnapshotHandler() serves it as JSON:
+ *
+ *   {
+ *     "takenAt": "2021-06-01T12:00:00Z",
+ *     "held": [
+ *       {"path": "/foo", "routineId": "6f1c...", "mode": "exclusive", "count": 1, "acquiredAt": "2021-06-01T11:59:58Z"}
+ *     ],
+ *     "waiting": [
+ *       {"paths": ["foo/bar"], "routineId": "93ab...", "mode": "shared", "class": "normal", ...}
+ *     ]
+ *   }
+ */
+
+type LockMode string
+
+const (
+  ModeExclusive LockMode = "exclusive"
+  ModeShared LockMode = "shared"
+)
+
+type HeldLock struct {
+  Path string `json:"path"`
+  Pattern bool `json:"pattern,omitempty"` // whether Path is a pattern; see ParsePattern()
+  RoutineId string `json:"routineId"`
+  Mode LockMode `json:"mode"`
+  Count int `json:"count"` // locks are recursive
+  AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+type Waiter struct {
+  Paths []string `json:"paths"`
+  RoutineId string `json:"routineId"`
+  Mode LockMode `json:"mode"`
+  Class string `json:"class"` // after aging
+  Priority int64 `json:"priority"`
+  EnqueuedAt time.Time `json:"enqueuedAt"`
+  Waiting time.Duration `json:"waitingNs"`
+}
+
+type Snapshot struct {
+  TakenAt time.Time `json:"takenAt"`
+  Held []HeldLock `json:"held"` // ordered by path
+  Waiting []Waiter `json:"waiting"` // in the order they will be considered
+}
+
+/*
+ * Returns the locks currently held and the tasks waiting for them.
+ */
+func (manager *Manager) Snapshot() Snapshot {
+  manager.mu.Lock()
+  defer manager.mu.Unlock()
+  now := time.Now()
+  waiting := make([]Waiter, 0)
+  for _, task := range manager.priorityQueue.Sorted() {
+    enqueuedAt := time.Unix(0, task.EnqueueTime)
+    waiting = append(waiting, Waiter{
+      Paths: task.Paths,
+      RoutineId: task.RoutineId,
+      Mode: modeOf(task.Shared),
+      Class: task.agedClass.String(),
+      Priority: task.Priority,
+      EnqueuedAt: enqueuedAt,
+      Waiting: now.Sub(enqueuedAt),
+    })
+  }
+  return Snapshot{TakenAt: now, Held: manager.trie.Held(), Waiting: waiting}
+}
+
+/*
+ * Returns a handler that responds to every request with Snapshot() as JSON.
+ */
+func (manager *Manager) SnapshotHandler() http.Handler {
+  return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+    writeSnapshot(writer, manager.Snapshot())
+  })
+}
+
+func writeSnapshot(writer http.ResponseWriter, snapshot Snapshot) {
+  data, err := json.MarshalIndent(snapshot, "", "  ")
+  if err != nil {
+    http.Error(writer, "Internal Server Error: " + err.Error(), 500)
+    return
+  }
+  writer.Header().Set("Content-Type", "application/json")
+  writer.Write(data)
+}
+
+func modeOf(shared bool) LockMode {
+  if shared {
+    return ModeShared
+  }
+  return ModeExclusive
+}
@@ -0,0 +1,83 @@
+package lockManager
+
+import (
+  "time"
+)
+
+/*
+ * Tasks are ordered by class and then by Priority (their arrival time).
+ * The zero value is PriorityNormal.
+ */
+type PriorityClass int
+
+const (
+  PriorityUrgent PriorityClass = -1
+  PriorityNormal PriorityClass = 0
+  PriorityBackground PriorityClass = 1
+)
+
+func (class PriorityClass) String() string {
+  switch class {
+  case PriorityUrgent:
+    return "urgent"
+  case PriorityBackground:
+    return "background"
+  }
+  return "normal"
+}
+
+type Task struct {
+  Paths []string // canonical; see Path.String()
+  paths []Path
+  ContinueChannel chan bool
+  EnqueueTime int64
+  Shared bool // whether the paths are locked for reading only
+  Priority int64
+  Class PriorityClass
+  agedClass PriorityClass // Class after aging; see TaskPriorityQueue.Age()
+  RoutineId string
+  Err error // why the task was refused, if it was
+  upgrade bool // whether granting converts the routine's shared locks rather than adding locks
+}
+
+/*
+ * Sets the task's class. Call this before adding the task to a queue.
+ */
+func (task *Task) SetClass(class PriorityClass) {
+  task.Class = class
+  task.agedClass = class
+}
+
+func MakeTask(routineId string, paths []Path, priority int64) *Task {
+  pathStrings := make([]string, len(paths))
+  for i, path := range paths {
+    pathStrings[i] = path.String()
+  }
+  return &Task{
+    Paths: pathStrings,
+    paths: paths,
+    ContinueChannel: make(chan bool, 1), // buffered so the scheduler never waits on a cancelled task
+    EnqueueTime: time.Now().UnixNano(),
+    Priority: priority,
+    RoutineId: routineId,
+  }
+}
+
+/*
+ * Returns true iff the two tasks can't hold their locks at the same time, i.e.
+ * they belong to different routines, one of them locks a path equal to, above
+ * or below one of the other's paths and at least one of them isn't shared.
+ */
+func (task *Task) conflictsWith(other *Task) bool {
+  if task.RoutineId == other.RoutineId || (task.Shared && other.Shared) {
+    return false
+  }
+  for _, path := range task.paths {
+    for _, otherPath := range other.paths {
+      if path.Overlaps(otherPath) {
+        return true
+      }
+    }
+  }
+  return false
+}
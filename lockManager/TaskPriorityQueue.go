@@ -0,0 +1,150 @@
+package lockManager
+
+import (
+  "container/heap"
+  "sort"
+  "sync"
+)
+
+// A thread safe priority queue for Tasks objects.
+// It supports eight functions:
+// pq = MakeTaskPriorityQueue() - creates a new priority queue
+// pq.Length() - returns the number of items in the priority queue
+// pq.Push(&newTask) - add an task to the priority queue
+// pq.Peek - Peek at the top task from the priority queue
+// pq.Pop - pop (and return) a task from the priority queue
+// pq.Remove(task) - remove a task from anywhere in the priority queue
+// pq.Sorted() - returns a copy of the tasks in priority order
+// pq.Age(now, interval) - promote tasks that have waited a long time
+
+// Significant code copied from
+// https://pkg.go.dev/container/heap#example-package-PriorityQueue
+/*
+ someTask =
+ pq := MakeTaskPriorityQueue(),
+ pq.Push(someTask)
+ */
+
+type TaskPriorityQueue struct {
+  tasks []*Task
+  mu sync.Mutex
+}
+
+func MakeTaskPriorityQueue() TaskPriorityQueue {
+  return TaskPriorityQueue{tasks: make([]*Task, 0)}
+}
+
+func (pq *TaskPriorityQueue) Length() int {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  return pq.Len()
+}
+
+func (pq *TaskPriorityQueue) Push(x interface{}) {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  n := len(pq.tasks)
+  task := x.(*Task)
+  pq.tasks = append(pq.tasks, task)
+  pq.update(task, n)
+}
+
+func (pq *TaskPriorityQueue) Peek() interface{} {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  return pq.tasks[0]
+}
+
+func (pq *TaskPriorityQueue) Pop() interface{} {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  return pq.removeAt(0)
+}
+
+// Returns false if the task isn't in the priority queue.
+func (pq *TaskPriorityQueue) Remove(task *Task) bool {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  for i, t := range pq.tasks {
+    if t == task {
+      pq.removeAt(i)
+      return true
+    }
+  }
+  return false
+}
+
+func (pq *TaskPriorityQueue) Sorted() []*Task {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  rtn := make([]*Task, len(pq.tasks))
+  copy(rtn, pq.tasks)
+  sort.Slice(rtn, func(i, j int) bool {
+    return taskLess(rtn[i], rtn[j])
+  })
+  return rtn
+}
+
+/*
+ * Promotes each task by one class for every `interval` nanoseconds it has
+ * waited since `EnqueueTime`, but never past PriorityNormal. This way, a
+ * steady stream of normal tasks can't starve background tasks forever, while
+ * urgent tasks still always go first.
+ */
+func (pq *TaskPriorityQueue) Age(now int64, interval int64) {
+  pq.mu.Lock()
+  defer pq.mu.Unlock()
+  if interval <= 0 {
+    return
+  }
+  for _, task := range pq.tasks {
+    if task.Class <= PriorityNormal {
+      continue
+    }
+    task.agedClass = task.Class - PriorityClass((now - task.EnqueueTime) / interval)
+    if task.agedClass < PriorityNormal {
+      task.agedClass = PriorityNormal
+    }
+  }
+  heap.Init(pq)
+}
+
+/********** Private **********/
+
+func (pq *TaskPriorityQueue) Len() int {
+  return len(pq.tasks)
+}
+
+func (pq *TaskPriorityQueue) Less(i, j int) bool {
+  return taskLess(pq.tasks[i], pq.tasks[j])
+}
+
+func (pq *TaskPriorityQueue) Swap(i, j int) {
+  pq.tasks[i], pq.tasks[j] = pq.tasks[j], pq.tasks[i]
+}
+
+func (pq *TaskPriorityQueue) removeAt(index int) *Task {
+  n := len(pq.tasks) - 1
+  pq.Swap(index, n)
+  task := pq.tasks[n]
+  pq.tasks[n] = nil  // avoid memory leak
+  pq.tasks = pq.tasks[0:n]
+  if index < n {
+    pq.update(pq.tasks[index], index)
+  }
+  return task
+}
+
+// Tasks of a more urgent class come first, then those with a smaller Priority
+// (i.e. an earlier timestamp).
+func taskLess(a *Task, b *Task) bool {
+  if a.agedClass != b.agedClass {
+    return a.agedClass < b.agedClass
+  }
+  return a.Priority < b.Priority
+}
+
+// Call after adding a Task or modifying its priority.
+func (pq *TaskPriorityQueue) update(task *Task, index int) {
+  heap.Fix(pq, index)
+}
@@ -0,0 +1,572 @@
+package lockManager
+
+import (
+  "errors"
+  "fmt"
+  pathpkg "path"
+  "sort"
+  "strings"
+  "time"
+)
+
+/*
+ * A trie of hierarchical path locks, keyed by canonical Paths. Locking a path
+ * also covers its descendants. Patterns (see ParsePattern()) may be locked
+ * too; they cover every path they match and conflict with every lock on such
+ * a path, its ancestors or its descendants, and with overlapping patterns.
+ * Locks are held by a "value" (e.g. a routine ID), either exclusively or shared.
+ *
+ * MakeTrie(reentrant bool) Trie
+ * If `reentrant` is true, a value may lock a path it already holds; such locks
+ * nest and each must be matched by a Remove(). Otherwise, doing so fails.
+ *
+ * trie.Add(path, value, shared) error
+ * Locks the path for `value`. Fails if a different value exclusively holds the
+ * path itself; use Conflict() first to check ancestors and descendants.
+ *
+ * trie.Remove(path, value, shared) error
+ * Releases one of `value`'s locks on the path.
+ *
+ * trie.RemoveAll(value) []HeldLock
+ * Releases every lock `value` holds and returns them.
+ *
+ * trie.Conflict(path, value, shared) (bool, string)
+ * Returns (true, otherValue) if `value` can't lock the path because it, an
+ * ancestor or a descendant is held by a different value (exclusively, if
+ * `shared` is true).
+ *
+ * trie.ConflictingValues(path, value, shared) []string
+ * Returns every value Conflict() could have returned.
+ *
+ * trie.Overlaps(path, value) bool
+ * Returns true iff `value` holds the path, an ancestor or a descendant.
+ *
+ * trie.LockedBy(path) (bool, string)
+ * Returns the value exclusively holding the path, its topmost such ancestor or
+ * a pattern matching either.
+ *
+ * trie.Holder(path) (string, bool)
+ * Returns the value exclusively holding exactly this path.
+ *
+ * trie.Shares(path, value) bool
+ * Returns true iff `value` holds a shared lock on exactly this path.
+ *
+ * trie.Covers(path, value, shared) bool
+ * Returns true iff `value` already holds the path or an ancestor, exclusively
+ * or (if `shared` is true) shared, so no other value can hold anything that
+ * overlaps it.
+ *
+ * trie.Held() []HeldLock
+ * Returns every held lock, ordered by path.
+ *
+ * trie.Length() int
+ * Returns the number of non-root nodes.
+ *
+ * trie.NumLockedPaths() int
+ * Returns the number of paths with at least one lock.
+ *
+ * trie.Print()
+ * Prints the trie.
+ *
+ * Every node also counts the locks held strictly below it, per value and per
+ * mode (the classic IS/IX intention locks), so checking whether a different
+ * value holds anything below a path takes O(depth) rather than a walk over
+ * the whole subtree.
+ */
+
+type trieNode struct {
+  name string
+  glob bool // whether `name` is a path.Match() pattern rather than a name
+  parent *trieNode
+  children map[string]*trieNode
+  globs map[string]*trieNode // children whose names are patterns
+  count int // the number of outstanding exclusive locks; zero for implicit nodes
+  holder string // the value holding the exclusive locks, if any
+  lockedAt time.Time // when count last became nonzero
+  readers map[string]int // the number of outstanding shared locks per value
+  sharedAt map[string]time.Time // when each value in `readers` first shared the node
+  exclusiveBelow map[string]int // IX: exclusive locks held on descendants, per value
+  numExclusiveBelow int // the sum of exclusiveBelow
+  sharedBelow map[string]int // IS: shared locks held on descendants, per value
+  numSharedBelow int // the sum of sharedBelow
+}
+
+type Trie struct {
+  root *trieNode
+  reentrant bool
+  length int
+  valueNodes map[string]map[*trieNode]bool // the nodes each value has locked
+}
+
+func MakeTrie(reentrant bool) Trie {
+  return Trie{root: makeTrieNode("", nil), reentrant: reentrant, valueNodes: make(map[string]map[*trieNode]bool)}
+}
+
+func (trie *Trie) Add(path Path, value string, shared bool) error {
+  node := trie.node(path)
+  if node.count > 0 && node.holder != value {
+    trie.prune(node)
+    if shared {
+      return errors.New("Trie.go: Attempted to share an item locked by another routine.")
+    }
+    return errors.New("Trie.go: Attempted to lock from multiple routines.")
+  }
+  if shared {
+    if node.readers[value] > 0 && !trie.reentrant {
+      return errors.New("Trie.go: Attempted to lock item multiple times.")
+    }
+    if node.readers[value] == 0 {
+      node.sharedAt[value] = time.Now()
+    }
+    node.readers[value] += 1
+  } else {
+    if node.count > 0 && !trie.reentrant {
+      return errors.New("Trie.go: Attempted to lock item multiple times.")
+    }
+    if node.count == 0 {
+      node.lockedAt = time.Now()
+    }
+    node.count += 1
+    node.holder = value
+  }
+  addIntention(node, value, shared, 1)
+  nodes, ok := trie.valueNodes[value]
+  if !ok {
+    nodes = make(map[*trieNode]bool)
+    trie.valueNodes[value] = nodes
+  }
+  nodes[node] = true
+  return nil
+}
+
+func (trie *Trie) Remove(path Path, value string, shared bool) error {
+  node := trie.find(path)
+  if node == nil {
+    return errors.New("Trie.go: Attempted to remove an item that wasn't locked.")
+  }
+  if shared {
+    if node.readers[value] == 0 {
+      return errors.New("Trie.go: Attempted to remove a shared lock that wasn't held.")
+    }
+    node.readers[value] -= 1
+    if node.readers[value] == 0 {
+      delete(node.readers, value)
+      delete(node.sharedAt, value)
+    }
+  } else {
+    if node.count == 0 {
+      return errors.New("Trie.go: Attempted to remove an item that wasn't locked.")
+    }
+    if node.holder != value {
+      return errors.New("Trie.go: Attempted to remove an item from the wrong routine.")
+    }
+    node.count -= 1
+    if node.count == 0 {
+      node.holder = ""
+    }
+  }
+  addIntention(node, value, shared, -1)
+  if node.readers[value] == 0 && node.holder != value {
+    trie.unindex(node, value)
+  }
+  trie.prune(node)
+  return nil
+}
+
+func (trie *Trie) RemoveAll(value string) []HeldLock {
+  rtn := make([]HeldLock, 0)
+  for node := range trie.valueNodes[value] {
+    path := pathFromNode(node)
+    if node.holder == value {
+      rtn = append(rtn, HeldLock{Path: path.String(), Pattern: path.pattern, RoutineId: value, Mode: ModeExclusive, Count: node.count, AcquiredAt: node.lockedAt})
+      addIntention(node, value, false, -node.count)
+      node.count = 0
+      node.holder = ""
+    }
+    if count, ok := node.readers[value]; ok {
+      rtn = append(rtn, HeldLock{Path: path.String(), Pattern: path.pattern, RoutineId: value, Mode: ModeShared, Count: count, AcquiredAt: node.sharedAt[value]})
+      addIntention(node, value, true, -count)
+      delete(node.readers, value)
+      delete(node.sharedAt, value)
+    }
+    trie.prune(node)
+  }
+  delete(trie.valueNodes, value)
+  sort.Slice(rtn, func(i, j int) bool { return rtn[i].Path < rtn[j].Path })
+  return rtn
+}
+
+func (trie *Trie) Conflict(path Path, value string, shared bool) (bool, string) {
+  otherValue := ""
+  check := func(conflict func(*trieNode, string, bool) (bool, string)) func(*trieNode) bool {
+    return func(node *trieNode) bool {
+      var isConflict bool
+      isConflict, otherValue = conflict(node, value, !shared)
+      return isConflict
+    }
+  }
+  conflict := visitOverlapping(trie.root, path, 0, check(nodeConflict), check(belowConflict))
+  return conflict, otherValue
+}
+
+func (trie *Trie) ConflictingValues(path Path, value string, shared bool) []string {
+  values := make(map[string]bool)
+  visitOverlapping(trie.root, path, 0, func(node *trieNode) bool {
+    collectNodeConflicts(node, value, !shared, values)
+    return false
+  }, func(node *trieNode) bool {
+    collectBelowConflicts(node, value, !shared, values)
+    return false
+  })
+  return keys(values)
+}
+
+func (trie *Trie) Overlaps(path Path, value string) bool {
+  for node := range trie.valueNodes[value] {
+    if pathFromNode(node).Overlaps(path) {
+      return true
+    }
+  }
+  return false
+}
+
+func (trie *Trie) LockedBy(path Path) (bool, string) {
+  holder := ""
+  locked := visitOverlapping(trie.root, path, 0, func(node *trieNode) bool {
+    holder = node.holder
+    return node.count > 0
+  }, nil)
+  return locked, holder
+}
+
+func (trie *Trie) Holder(path Path) (string, bool) {
+  node := trie.find(path)
+  if node == nil || node.count == 0 {
+    return "", false
+  }
+  return node.holder, true
+}
+
+func (trie *Trie) Shares(path Path, value string) bool {
+  node := trie.find(path)
+  return node != nil && node.readers[value] > 0
+}
+
+func (trie *Trie) Covers(path Path, value string, shared bool) bool {
+  node := trie.root
+  for i := 0; ; i++ {
+    if (node.count > 0 && node.holder == value) || (shared && node.readers[value] > 0) {
+      return true
+    }
+    if i == len(path.parts) {
+      return false
+    }
+    child, ok := node.child(path.part(i))
+    if !ok {
+      return false
+    }
+    node = child
+  }
+}
+
+func (trie *Trie) Held() []HeldLock {
+  return appendHeld(make([]HeldLock, 0), trie.root)
+}
+
+func (trie *Trie) Length() int {
+  return trie.length
+}
+
+func (trie *Trie) NumLockedPaths() int {
+  return numLockedPaths(trie.root)
+}
+
+func (trie *Trie) Print() {
+  printNode(trie.root, 0)
+}
+
+/*
+ * If removing one of `value`'s locks on the path would release it entirely,
+ * returns when it was acquired. Otherwise returns false.
+ */
+func (trie *Trie) lastLockedAt(path Path, value string, shared bool) (time.Time, bool) {
+  node := trie.find(path)
+  if node == nil {
+    return time.Time{}, false
+  }
+  if shared {
+    return node.sharedAt[value], node.readers[value] == 1
+  }
+  return node.lockedAt, node.count == 1 && node.holder == value
+}
+
+/*
+ * Fetches the node for the path if it is locked; otherwise returns nil.
+ */
+func (trie *Trie) find(path Path) *trieNode {
+  node := trie.root
+  for i := range path.parts {
+    child, ok := node.child(path.part(i))
+    if !ok {
+      return nil
+    }
+    node = child
+  }
+  if node.count == 0 && len(node.readers) == 0 {
+    return nil
+  }
+  return node
+}
+
+/*
+ * Fetches the node for the path, creating implicit nodes as needed.
+ */
+func (trie *Trie) node(path Path) *trieNode {
+  node := trie.root
+  for i := range path.parts {
+    part, glob := path.part(i)
+    child, ok := node.child(part, glob)
+    if !ok {
+      child = makeTrieNode(part, node)
+      child.glob = glob
+      trie.length += 1
+      if glob {
+        node.globs[part] = child
+      } else {
+        node.children[part] = child
+      }
+    }
+    node = child
+  }
+  return node
+}
+
+func (trie *Trie) unindex(node *trieNode, value string) {
+  delete(trie.valueNodes[value], node)
+  if len(trie.valueNodes[value]) == 0 {
+    delete(trie.valueNodes, value)
+  }
+}
+
+/*
+ * Removes the node and its ancestors for as long as they are unlocked leaves.
+ */
+func (trie *Trie) prune(node *trieNode) {
+  for node.parent != nil && node.count == 0 && len(node.readers) == 0 && len(node.children) == 0 && len(node.globs) == 0 {
+    if node.glob {
+      delete(node.parent.globs, node.name)
+    } else {
+      delete(node.parent.children, node.name)
+    }
+    trie.length -= 1
+    node = node.parent
+  }
+}
+
+func nodeConflict(node *trieNode, value string, includeReaders bool) (bool, string) {
+  if node.count > 0 && node.holder != value {
+    return true, node.holder
+  }
+  if includeReaders {
+    for reader := range node.readers {
+      if reader != value {
+        return true, reader
+      }
+    }
+  }
+  return false, ""
+}
+
+func collectNodeConflicts(node *trieNode, value string, includeReaders bool, values map[string]bool) {
+  if node.count > 0 && node.holder != value {
+    values[node.holder] = true
+  }
+  if includeReaders {
+    for reader := range node.readers {
+      if reader != value {
+        values[reader] = true
+      }
+    }
+  }
+}
+
+/*
+ * Calls `visit` on every node on the way to anything `path` covers (see
+ * Path.Overlaps()) and `visitBelow` (unless it is nil) on the nodes the path
+ * ends at, until either returns true. `depth` is the number of components of
+ * `path` that lead to `node`.
+ */
+func visitOverlapping(node *trieNode, path Path, depth int, visit func(node *trieNode) bool, visitBelow func(node *trieNode) bool) bool {
+  if visit(node) {
+    return true
+  }
+  if depth == len(path.parts) {
+    return visitBelow != nil && visitBelow(node)
+  }
+  part, glob := path.part(depth)
+  if glob {
+    for name, child := range node.children {
+      if matched, _ := pathpkg.Match(part, name); matched && visitOverlapping(child, path, depth + 1, visit, visitBelow) {
+        return true
+      }
+    }
+  } else if child, ok := node.children[part]; ok && visitOverlapping(child, path, depth + 1, visit, visitBelow) {
+    return true
+  }
+  for name, child := range node.globs {
+    if partsMayMatch(name, true, part, glob) && visitOverlapping(child, path, depth + 1, visit, visitBelow) {
+      return true
+    }
+  }
+  return false
+}
+
+/*
+ * Returns (true, otherValue) if a value other than `value` holds a lock below
+ * the node (exclusively, unless `includeReaders` is true).
+ */
+func belowConflict(node *trieNode, value string, includeReaders bool) (bool, string) {
+  if node.numExclusiveBelow > node.exclusiveBelow[value] {
+    return true, otherKey(node.exclusiveBelow, value)
+  }
+  if includeReaders && node.numSharedBelow > node.sharedBelow[value] {
+    return true, otherKey(node.sharedBelow, value)
+  }
+  return false, ""
+}
+
+func collectBelowConflicts(node *trieNode, value string, includeReaders bool, values map[string]bool) {
+  for other := range node.exclusiveBelow {
+    if other != value {
+      values[other] = true
+    }
+  }
+  if includeReaders {
+    for other := range node.sharedBelow {
+      if other != value {
+        values[other] = true
+      }
+    }
+  }
+}
+
+/*
+ * Adds `delta` of `value`'s locks on the node to the intention counts of its
+ * ancestors.
+ */
+func addIntention(node *trieNode, value string, shared bool, delta int) {
+  for ancestor := node.parent; ancestor != nil; ancestor = ancestor.parent {
+    counts, total := ancestor.exclusiveBelow, &ancestor.numExclusiveBelow
+    if shared {
+      counts, total = ancestor.sharedBelow, &ancestor.numSharedBelow
+    }
+    counts[value] += delta
+    if counts[value] == 0 {
+      delete(counts, value)
+    }
+    *total += delta
+  }
+}
+
+/*
+ * Appends the locks held on the node and its descendants, visiting children in
+ * alphabetical order.
+ */
+func appendHeld(rtn []HeldLock, node *trieNode) []HeldLock {
+  path := pathFromNode(node)
+  if node.count > 0 {
+    rtn = append(rtn, HeldLock{Path: path.String(), Pattern: path.pattern, RoutineId: node.holder, Mode: ModeExclusive, Count: node.count, AcquiredAt: node.lockedAt})
+  }
+  readers := make([]string, 0, len(node.readers))
+  for reader := range node.readers {
+    readers = append(readers, reader)
+  }
+  sort.Strings(readers)
+  for _, reader := range readers {
+    rtn = append(rtn, HeldLock{Path: path.String(), Pattern: path.pattern, RoutineId: reader, Mode: ModeShared, Count: node.readers[reader], AcquiredAt: node.sharedAt[reader]})
+  }
+  for _, children := range []map[string]*trieNode{node.children, node.globs} {
+    names := make([]string, 0, len(children))
+    for name := range children {
+      names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+      rtn = appendHeld(rtn, children[name])
+    }
+  }
+  return rtn
+}
+
+func numLockedPaths(node *trieNode) int {
+  rtn := 0
+  if node.count > 0 || len(node.readers) > 0 {
+    rtn += 1
+  }
+  for _, child := range node.children {
+    rtn += numLockedPaths(child)
+  }
+  for _, child := range node.globs {
+    rtn += numLockedPaths(child)
+  }
+  return rtn
+}
+
+func printNode(node *trieNode, indents int) {
+  fmt.Println(strings.Repeat(" ", 2*indents), node.name, node.count, node.holder, node.readers)
+  for _, child := range node.children {
+    printNode(child, indents + 1)
+  }
+  for _, child := range node.globs {
+    printNode(child, indents + 1)
+  }
+}
+
+// Returns a key other than `key` from the counts.
+func otherKey(counts map[string]int, key string) string {
+  for other := range counts {
+    if other != key {
+      return other
+    }
+  }
+  return ""
+}
+
+func keys(set map[string]bool) []string {
+  rtn := make([]string, 0, len(set))
+  for key := range set {
+    rtn = append(rtn, key)
+  }
+  return rtn
+}
+
+func pathFromNode(node *trieNode) Path {
+  rtn := make([]string, 0)
+  pattern := false
+  for node.parent != nil {
+    rtn = append(rtn, node.name)
+    pattern = pattern || node.glob
+    node = node.parent
+  }
+  // Reverse array
+  for i, j := 0, len(rtn)-1; i < j; i, j = i+1, j-1 {
+    rtn[i], rtn[j] = rtn[j], rtn[i]
+  }
+  return Path{parts: rtn, pattern: pattern}
+}
+
+func makeTrieNode(name string, parent *trieNode) *trieNode {
+  return &trieNode{name: name, parent: parent, children: make(map[string]*trieNode, 0), globs: make(map[string]*trieNode), readers: make(map[string]int), sharedAt: make(map[string]time.Time), exclusiveBelow: make(map[string]int), sharedBelow: make(map[string]int)}
+}
+
+/*
+ * Returns the child with the name, looking among the patterns if `glob` is set.
+ */
+func (node *trieNode) child(name string, glob bool) (*trieNode, bool) {
+  if glob {
+    child, ok := node.globs[name]
+    return child, ok
+  }
+  child, ok := node.children[name]
+  return child, ok
+}
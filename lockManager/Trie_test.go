@@ -0,0 +1,184 @@
+package lockManager
+
+import (
+  "fmt"
+  "math/rand"
+  "reflect"
+  "sort"
+  "testing"
+)
+
+/*
+ * Checks the Trie against a plain list of held locks, which answers every
+ * question with a linear scan.
+ */
+
+type referenceLock struct {
+  path string
+  pattern bool
+  value string
+  shared bool
+}
+
+func (lock referenceLock) parse() Path {
+  if lock.pattern {
+    rtn, _ := ParsePattern(lock.path)
+    return rtn
+  }
+  rtn, _ := ParsePath(lock.path)
+  return rtn
+}
+
+type referenceTrie struct {
+  counts map[referenceLock]int
+}
+
+func (ref *referenceTrie) conflictingValues(path Path, value string, shared bool) []string {
+  values := make(map[string]bool)
+  for lock := range ref.counts {
+    if lock.value != value && !(shared && lock.shared) && lock.parse().Overlaps(path) {
+      values[lock.value] = true
+    }
+  }
+  return sortedKeys(values)
+}
+
+func (ref *referenceTrie) overlaps(path Path, value string) bool {
+  for lock := range ref.counts {
+    if lock.value == value && lock.parse().Overlaps(path) {
+      return true
+    }
+  }
+  return false
+}
+
+func (ref *referenceTrie) held() []string {
+  rtn := make([]string, 0)
+  for lock, count := range ref.counts {
+    rtn = append(rtn, heldKey(lock.path, lock.pattern, lock.value, lock.shared, count))
+  }
+  sort.Strings(rtn)
+  return rtn
+}
+
+func heldKey(path string, pattern bool, value string, shared bool, count int) string {
+  return fmt.Sprintf("%s pattern=%v %s shared=%v x%d", path, pattern, value, shared, count)
+}
+
+func trieHeld(trie *Trie) []string {
+  rtn := make([]string, 0)
+  for _, lock := range trie.Held() {
+    rtn = append(rtn, heldKey(lock.Path, lock.Pattern, lock.RoutineId, lock.Mode == ModeShared, lock.Count))
+  }
+  sort.Strings(rtn)
+  return rtn
+}
+
+func TestTrieMatchesLinearScan(t *testing.T) {
+  spellings := []string{"", "a", "a/b", "a/b/c", "a/b/d", "a/e", "f", "f/g", "f/g/h"}
+  patterns := []string{"a/*", "a/b/*", "*/g", "f/*/h"}
+  paths := make([]Path, 0)
+  for _, spelling := range spellings {
+    path, _ := ParsePath(spelling)
+    paths = append(paths, path)
+  }
+  for _, spelling := range patterns {
+    pattern, _ := ParsePattern(spelling)
+    paths = append(paths, pattern)
+  }
+  values := []string{"A", "B", "C", "D"}
+
+  for _, reentrant := range []bool{true, false} {
+    for seed := int64(0); seed < 20; seed++ {
+      random := rand.New(rand.NewSource(seed))
+      trie := MakeTrie(reentrant)
+      ref := &referenceTrie{counts: make(map[referenceLock]int)}
+      for step := 0; step < 500; step++ {
+        path := paths[random.Intn(len(paths))]
+        value := values[random.Intn(len(values))]
+        shared := random.Intn(2) == 0
+        lock := referenceLock{path: path.String(), pattern: path.pattern, value: value, shared: shared}
+        where := fmt.Sprintf("reentrant=%v seed=%d step=%d", reentrant, seed, step)
+
+        switch op := random.Intn(10); {
+        case op < 5:
+          // Add, but only what the Manager would grant.
+          if len(ref.conflictingValues(path, value, shared)) > 0 || (!reentrant && ref.overlaps(path, value)) {
+            continue
+          }
+          if err := trie.Add(path, value, shared); err != nil {
+            t.Fatalf("%s: Add(%s, %s, %v): %v", where, path, value, shared, err)
+          }
+          ref.counts[lock] += 1
+        case op < 9:
+          // Remove one of the held locks.
+          if len(ref.counts) == 0 {
+            continue
+          }
+          held := make([]referenceLock, 0, len(ref.counts))
+          for lock := range ref.counts {
+            held = append(held, lock)
+          }
+          sort.Slice(held, func(i, j int) bool { return fmt.Sprint(held[i]) < fmt.Sprint(held[j]) })
+          lock = held[random.Intn(len(held))]
+          if err := trie.Remove(lock.parse(), lock.value, lock.shared); err != nil {
+            t.Fatalf("%s: Remove(%s, %s, %v): %v", where, lock.path, lock.value, lock.shared, err)
+          }
+          if ref.counts[lock] -= 1; ref.counts[lock] == 0 {
+            delete(ref.counts, lock)
+          }
+        default:
+          trie.RemoveAll(value)
+          for lock := range ref.counts {
+            if lock.value == value {
+              delete(ref.counts, lock)
+            }
+          }
+        }
+
+        if got, want := trieHeld(&trie), ref.held(); !reflect.DeepEqual(got, want) {
+          t.Fatalf("%s: Held() = %v, want %v", where, got, want)
+        }
+        for _, probe := range paths {
+          for _, value := range values {
+            for _, shared := range []bool{false, true} {
+              want := ref.conflictingValues(probe, value, shared)
+              if got := trie.ConflictingValues(probe, value, shared); !reflect.DeepEqual(sortedKeys(toSet(got)), want) {
+                t.Fatalf("%s: ConflictingValues(%s, %s, %v) = %v, want %v", where, probe, value, shared, got, want)
+              }
+              if conflict, other := trie.Conflict(probe, value, shared); conflict != (len(want) > 0) || (conflict && !contains(want, other)) {
+                t.Fatalf("%s: Conflict(%s, %s, %v) = %v, %q, want one of %v", where, probe, value, shared, conflict, other, want)
+              }
+            }
+            if got, want := trie.Overlaps(probe, value), ref.overlaps(probe, value); got != want {
+              t.Fatalf("%s: Overlaps(%s, %s) = %v, want %v", where, probe, value, got, want)
+            }
+          }
+        }
+      }
+    }
+  }
+}
+
+func toSet(values []string) map[string]bool {
+  rtn := make(map[string]bool)
+  for _, value := range values {
+    rtn[value] = true
+  }
+  return rtn
+}
+
+func sortedKeys(set map[string]bool) []string {
+  rtn := keys(set)
+  sort.Strings(rtn)
+  return rtn
+}
+
+func contains(values []string, value string) bool {
+  for _, v := range values {
+    if v == value {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,282 @@
+package metrics
+
+import (
+  "fmt"
+  "math"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+/*
+ * Receives lock-contention measurements from fileScheduler.FileScheduler and
+ * fileServer.Scheduler. `path` is always the top-level component of a locked
+ * path ("/" for the root). Clients can still make up any number of those, so
+ * Registry only keeps the first few (see SetMaxPaths()).
+ *
+ * Each lock request is counted exactly once, by IncGranted() if it succeeds or
+ * by IncDenied() if it fails.
+ *
+ * Implementations are called while the scheduler holds its lock, so they must
+ * be fast and must not call back into the scheduler.
+ */
+type Recorder interface {
+  // How long a task waited in the queue before it was granted.
+  ObserveWait(path string, wait time.Duration)
+  // How long a lock was held before it was released.
+  ObserveHold(path string, hold time.Duration)
+  // The number of tasks waiting after each scheduling pass.
+  SetQueueDepth(depth int)
+  IncGranted(path string)
+  // `reason` is one of "would_block", "canceled", "deadline_exceeded",
+  // "deadlock", "closed", "not_held", "upgrade_conflict" or "error".
+  IncDenied(path string, reason string)
+}
+
+// A Recorder that ignores everything. This is the default.
+var Discard Recorder = discard{}
+
+type discard struct{}
+
+func (discard) ObserveWait(path string, wait time.Duration) {}
+func (discard) ObserveHold(path string, hold time.Duration) {}
+func (discard) SetQueueDepth(depth int) {}
+func (discard) IncGranted(path string) {}
+func (discard) IncDenied(path string, reason string) {}
+
+// Upper bounds (in seconds) of the histogram buckets.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+// How many distinct paths a Registry labels metrics with by default.
+const DefaultMaxPaths = 100
+
+// The label for every path beyond a Registry's first SetMaxPaths() paths.
+const OtherPath = "(other)"
+
+
+
+
+
+/********** Registry **********/
+
+/*
+ * A Recorder that keeps everything in memory and serves it in the Prometheus
+ * text exposition format, so it can be scraped without any extra dependencies.
+ *
+ *   registry := metrics.MakeRegistry("uploads")
+ *   fileScheduler.SetMetrics(registry)
+ *   http.Handle("/metrics", registry)
+ *
+ * serves metrics named `uploads_lock_wait_seconds`, `uploads_lock_hold_seconds`,
+ * `uploads_lock_queue_depth`, `uploads_lock_granted_total` and
+ * `uploads_lock_denied_total`.
+ *
+ * Only the first DefaultMaxPaths paths get their own label; the rest are
+ * lumped together as OtherPath, so clients can't grow the registry without
+ * bound by locking made-up paths.
+ */
+type Registry struct {
+  namespace string
+  buckets []float64
+  mu sync.Mutex // guards everything below
+  maxPaths int
+  paths map[string]bool // the paths with their own label
+  wait map[string]*histogram
+  hold map[string]*histogram
+  queueDepth int
+  granted map[string]uint64
+  denied map[[2]string]uint64 // keyed by path and reason
+}
+
+type histogram struct {
+  counts []uint64 // counts[i] is the number of observations <= buckets[i]; the last entry is +Inf
+  sum float64
+}
+
+func MakeRegistry(namespace string) *Registry {
+  return MakeRegistryWithBuckets(namespace, DefaultBuckets)
+}
+
+/*
+ * Like MakeRegistry(), but with custom histogram buckets (in seconds, ascending).
+ */
+func MakeRegistryWithBuckets(namespace string, buckets []float64) *Registry {
+  return &Registry{
+    namespace: namespace,
+    buckets: buckets,
+    maxPaths: DefaultMaxPaths,
+    paths: make(map[string]bool),
+    wait: make(map[string]*histogram),
+    hold: make(map[string]*histogram),
+    granted: make(map[string]uint64),
+    denied: make(map[[2]string]uint64),
+  }
+}
+
+/*
+ * Sets how many distinct paths get their own label. Paths seen after that are
+ * labelled OtherPath. Paths that already have a label keep it. Defaults to
+ * DefaultMaxPaths.
+ */
+func (registry *Registry) SetMaxPaths(maxPaths int) {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  registry.maxPaths = maxPaths
+}
+
+func (registry *Registry) ObserveWait(path string, wait time.Duration) {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  registry.observe(registry.wait, registry.label(path), wait)
+}
+
+func (registry *Registry) ObserveHold(path string, hold time.Duration) {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  registry.observe(registry.hold, registry.label(path), hold)
+}
+
+func (registry *Registry) SetQueueDepth(depth int) {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  registry.queueDepth = depth
+}
+
+func (registry *Registry) IncGranted(path string) {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  registry.granted[registry.label(path)] += 1
+}
+
+func (registry *Registry) IncDenied(path string, reason string) {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  registry.denied[[2]string{registry.label(path), reason}] += 1
+}
+
+func (registry *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+  writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+  writer.Write([]byte(registry.String()))
+}
+
+/*
+ * Returns the metrics in the Prometheus text exposition format.
+ */
+func (registry *Registry) String() string {
+  registry.mu.Lock()
+  defer registry.mu.Unlock()
+  var builder strings.Builder
+  registry.writeHistograms(&builder, "lock_wait_seconds", "Time tasks spent waiting for locks.", registry.wait)
+  registry.writeHistograms(&builder, "lock_hold_seconds", "Time locks were held before being released.", registry.hold)
+
+  name := registry.namespace + "_lock_queue_depth"
+  fmt.Fprintf(&builder, "# HELP %s Number of tasks waiting for locks.\n# TYPE %s gauge\n", name, name)
+  fmt.Fprintf(&builder, "%s %d\n", name, registry.queueDepth)
+
+  name = registry.namespace + "_lock_granted_total"
+  fmt.Fprintf(&builder, "# HELP %s Number of lock requests granted.\n# TYPE %s counter\n", name, name)
+  for _, path := range sortedKeys(registry.granted) {
+    fmt.Fprintf(&builder, "%s{path=\"%s\"} %d\n", name, escapeLabel(path), registry.granted[path])
+  }
+
+  name = registry.namespace + "_lock_denied_total"
+  fmt.Fprintf(&builder, "# HELP %s Number of lock requests that failed.\n# TYPE %s counter\n", name, name)
+  keys := make([][2]string, 0, len(registry.denied))
+  for key := range registry.denied {
+    keys = append(keys, key)
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    if keys[i][0] != keys[j][0] {
+      return keys[i][0] < keys[j][0]
+    }
+    return keys[i][1] < keys[j][1]
+  })
+  for _, key := range keys {
+    fmt.Fprintf(&builder, "%s{path=\"%s\",reason=\"%s\"} %d\n", name, escapeLabel(key[0]), escapeLabel(key[1]), registry.denied[key])
+  }
+  return builder.String()
+}
+
+/*
+ * Returns the label for the path: the path itself if it already has one or
+ * there is room for another, and OtherPath otherwise.
+ * The caller must hold registry.mu.
+ */
+func (registry *Registry) label(path string) string {
+  if registry.paths[path] {
+    return path
+  }
+  if len(registry.paths) >= registry.maxPaths {
+    return OtherPath
+  }
+  registry.paths[path] = true
+  return path
+}
+
+// The caller must hold registry.mu.
+func (registry *Registry) observe(histograms map[string]*histogram, path string, duration time.Duration) {
+  h, ok := histograms[path]
+  if !ok {
+    h = &histogram{counts: make([]uint64, len(registry.buckets) + 1)}
+    histograms[path] = h
+  }
+  seconds := duration.Seconds()
+  for i, bound := range registry.buckets {
+    if seconds <= bound {
+      h.counts[i] += 1
+    }
+  }
+  h.counts[len(registry.buckets)] += 1
+  h.sum += seconds
+}
+
+// The caller must hold registry.mu.
+func (registry *Registry) writeHistograms(builder *strings.Builder, suffix string, help string, histograms map[string]*histogram) {
+  name := registry.namespace + "_" + suffix
+  fmt.Fprintf(builder, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+  paths := make([]string, 0, len(histograms))
+  for path := range histograms {
+    paths = append(paths, path)
+  }
+  sort.Strings(paths)
+  for _, path := range paths {
+    h := histograms[path]
+    label := escapeLabel(path)
+    for i, bound := range registry.buckets {
+      fmt.Fprintf(builder, "%s_bucket{path=\"%s\",le=\"%s\"} %d\n", name, label, formatFloat(bound), h.counts[i])
+    }
+    fmt.Fprintf(builder, "%s_bucket{path=\"%s\",le=\"+Inf\"} %d\n", name, label, h.counts[len(registry.buckets)])
+    fmt.Fprintf(builder, "%s_sum{path=\"%s\"} %s\n", name, label, formatFloat(h.sum))
+    fmt.Fprintf(builder, "%s_count{path=\"%s\"} %d\n", name, label, h.counts[len(registry.buckets)])
+  }
+}
+
+
+
+
+
+/********** Classless Functions **********/
+
+func sortedKeys(counts map[string]uint64) []string {
+  rtn := make([]string, 0, len(counts))
+  for key := range counts {
+    rtn = append(rtn, key)
+  }
+  sort.Strings(rtn)
+  return rtn
+}
+
+func escapeLabel(value string) string {
+  value = strings.ReplaceAll(value, "\\", "\\\\")
+  value = strings.ReplaceAll(value, "\"", "\\\"")
+  return strings.ReplaceAll(value, "\n", "\\n")
+}
+
+func formatFloat(value float64) string {
+  if math.IsInf(value, 1) {
+    return "+Inf"
+  }
+  return fmt.Sprintf("%g", value)
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestRegistryCapsPaths(t *testing.T) {
+  registry := MakeRegistry("test")
+  registry.SetMaxPaths(2)
+  registry.IncGranted("a")
+  registry.IncGranted("b")
+  registry.IncGranted("c")
+  registry.IncDenied("d", "canceled")
+  registry.ObserveWait("e", time.Millisecond)
+  registry.IncGranted("a")
+
+  text := registry.String()
+  for _, line := range []string{
+    `test_lock_granted_total{path="a"} 2`,
+    `test_lock_granted_total{path="b"} 1`,
+    `test_lock_granted_total{path="(other)"} 1`,
+    `test_lock_denied_total{path="(other)",reason="canceled"} 1`,
+    `test_lock_wait_seconds_count{path="(other)"} 1`,
+  } {
+    if !strings.Contains(text, line + "\n") {
+      t.Errorf("missing %q in:\n%s", line, text)
+    }
+  }
+  for _, path := range []string{"c", "d", "e"} {
+    if strings.Contains(text, `path="` + path + `"`) {
+      t.Errorf("%s has its own label:\n%s", path, text)
+    }
+  }
+}